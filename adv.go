@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/grutz/gatt/constants"
 )
@@ -1914,6 +1917,7 @@ const (
 	typeServiceData128    = 0x21 // Service Data - 128-bit UUID
 	typeLESecConfirm      = 0x22 // LE Secure Connections Confirmation Value
 	typeLESecRandom       = 0x23 // LE Secure Connections Random Value
+	typeURI               = 0x24 // URI
 	typeManufacturerData  = 0xFF // Manufacturer Specific Data
 )
 
@@ -1926,6 +1930,26 @@ const (
 	FlagBothHost            = 0x10 // Simultaneous LE and BR/EDR to Same Device Capable (Host).
 )
 
+// LERole is the value of the LE Role field.
+type LERole uint8
+
+// LE roles of the LE Role field
+const (
+	LERolePeripheral          LERole = 0x00 // Only Peripheral Role supported
+	LERoleCentral             LERole = 0x01 // Only Central Role supported
+	LERolePeripheralPreferred LERole = 0x02 // Peripheral and Central Role supported, Peripheral Role preferred
+	LERoleCentralPreferred    LERole = 0x03 // Peripheral and Central Role supported, Central Role preferred
+)
+
+// uriSchemes are the codes of the URI schemes abbreviated in the URI field.
+var uriSchemes = map[string]rune{
+	"http:":  0x16,
+	"https:": 0x17,
+}
+
+// uriNoScheme is the code of the URI fields carrying the scheme verbatim.
+const uriNoScheme = 0x01
+
 type Flags uint8
 
 func (f Flags) String() string {
@@ -1956,16 +1980,19 @@ func (f Flags) String() string {
 	return strings.Join(bits, ", ")
 }
 
-// FIXME: check the unmarshalling of this data structure.
+// ServiceData is the data advertised for a service.
 type ServiceData struct {
-	UUID constants.UUID
-	Data []byte
+	UUID    constants.UUID
+	Data    []byte
+	Decoded interface{} // the data decoded, if the service has a decoder, see RegisterServiceDataDecoder
 }
 
+// AppearanceData is the advertised appearance of a device, see
+// constants.AppearanceName.
 type AppearanceData struct {
 	Category    string
 	SubCategory string
-	raw         uint16
+	Value       uint16 // the appearance value, 0 if unknown
 }
 
 func (a *AppearanceData) String() string {
@@ -1976,9 +2003,17 @@ func (a *AppearanceData) decode(b []byte) error {
 	if len(b) != 2 {
 		return errors.New("invalid appearance data")
 	}
+	a.Value = binary.LittleEndian.Uint16(b)
+	a.Category, a.SubCategory = constants.AppearanceName(a.Value)
 	return nil
 }
 
+// An AdvField is a field of the advertising data.
+type AdvField struct {
+	Type uint8
+	Data []byte
+}
+
 // This is borrowed from core bluetooth.
 // Embedded/Linux folks might be interested in more details.
 type Advertisement struct {
@@ -1997,102 +2032,165 @@ type Advertisement struct {
 	SolicitedService []constants.UUID
 	Appearance       AppearanceData
 	AddressType      constants.AddressType
-	Raw              []byte
+	Raw              []byte      // the advertising data
+	Fields           []AdvField  // the fields of Raw, in order
+	Beacon           Beacon      // the beacon advertised, if any
+	Manufacturer     interface{} // ManufacturerData decoded, if the company has a decoder, see RegisterManufacturerDecoder
+
+	LERole                  LERole
+	HasLERole               bool               // whether LERole was advertised
+	AdvInterval             time.Duration      // 0 if not advertised
+	URI                     string             // the URI, with its scheme expanded
+	PublicTargetAddress     []net.HardwareAddr // the peers the advertising is meant for
+	RandomTargetAddress     []net.HardwareAddr
+	SecurityManagerOOBFlags uint8
+	ConnIntervalMin         time.Duration // preferred connection interval range; 0 if no specific minimum
+	ConnIntervalMax         time.Duration // 0 if no specific maximum
+
+	// Resolved is set if the advertiser uses a resolvable private address
+	// that has been resolved with the IRK of a bonded device, in which case
+	// IdentityAddress and IdentityAddressType are its identity address.
+	Resolved            bool
+	IdentityAddress     net.HardwareAddr
+	IdentityAddressType constants.AddressType
+
+	// The following are only set for the advertisements reported by the
+	// extended scanning, see LnxExtendedScan.
+	Extended         bool
+	PrimaryPHY       PHY
+	SecondaryPHY     PHY           // 0 if the data wasn't sent on the secondary advertising channels
+	SID              uint8         // advertising set identifier, 0xFF if none
+	TxPower          int           // TX power of the advertiser, 127 if not available
+	PeriodicInterval time.Duration // interval of the periodic advertising of the set, 0 if none
+	Truncated        bool          // the data was truncated by the controller
 }
 
 // This is only used in Linux port.
 func (a *Advertisement) unmarshall(b []byte) error {
+	a.Raw = append([]byte(nil), b...)
+	b = a.Raw
 
 	// Utility function for creating a list of uuids.
 	uuidList := func(u []constants.UUID, d []byte, w int) []constants.UUID {
-		// https://github.com/grutz/gatt/issues/8
-		defer func() {
-			if recover() != nil {
-
-			}
-		}()
-
-		for len(d) > 0 {
+		for ; len(d) >= w; d = d[w:] {
 			u = append(u, constants.UUID{d[:w]})
-			d = d[w:]
 		}
 		return u
 	}
 
 	serviceDataList := func(sd []ServiceData, d []byte, w int) []ServiceData {
-		serviceData := ServiceData{constants.UUID{d[:w]}, make([]byte, len(d)-w)}
-		copy(serviceData.Data, d[2:])
+		if len(d) < w {
+			return sd
+		}
+		serviceData := ServiceData{UUID: constants.UUID{d[:w]}, Data: make([]byte, len(d)-w)}
+		copy(serviceData.Data, d[w:])
+		serviceData.Decoded = decodeServiceData(serviceData)
 		return append(sd, serviceData)
 	}
 
-	for len(b) > 0 {
-		if len(b) < 2 {
-			return errors.New("invalid advertise data")
+	addressList := func(aa []net.HardwareAddr, d []byte) []net.HardwareAddr {
+		for ; len(d) >= 6; d = d[6:] {
+			aa = append(aa, net.HardwareAddr{d[5], d[4], d[3], d[2], d[1], d[0]})
 		}
+		return aa
+	}
 
-		// l is the length of the field, t is the type of the field.
-		l, t := b[0], b[1]
-		right := int(1 + l)
+	connInterval := func(d []byte) time.Duration {
+		ivl := binary.LittleEndian.Uint16(d)
+		if ivl == 0xFFFF {
+			return 0
+		}
+		return time.Duration(ivl) * 1250 * time.Microsecond
+	}
 
-		if l < 1 || len(b) < right || right < 2 {
+	for len(b) > 0 {
+		// l is the length of the field, t is the type of the field.
+		l := int(b[0])
+		if l == 0 {
+			// The rest of the data is zero padding.
+			break
+		}
+		if len(b) < 1+l {
 			return errors.New("invalid advertise data")
 		}
+		t, d := b[1], b[2:1+l]
+		a.Fields = append(a.Fields, AdvField{Type: t, Data: d})
+		b = b[1+l:]
 
-		d := b[2:right]
-		a.Raw = d
-
-		// Depending upon the field type, decode the data.
-		switch t {
-		case typeFlags:
+		// Depending upon the field type, decode the data. The fields too
+		// short for their type are only kept in Fields.
+		switch {
+		case t == typeFlags && len(d) >= 1:
 			a.Flags = Flags(d[0])
-		case typeSomeUUID16:
-			a.Services = uuidList(a.Services, d, 2)
-		case typeAllUUID16:
+		case t == typeSomeUUID16 || t == typeAllUUID16:
 			a.Services = uuidList(a.Services, d, 2)
-		case typeSomeUUID32:
+		case t == typeSomeUUID32 || t == typeAllUUID32:
 			a.Services = uuidList(a.Services, d, 4)
-		case typeAllUUID32:
-			a.Services = uuidList(a.Services, d, 4)
-		case typeSomeUUID128:
-			a.Services = uuidList(a.Services, d, 16)
-		case typeAllUUID128:
+		case t == typeSomeUUID128 || t == typeAllUUID128:
 			a.Services = uuidList(a.Services, d, 16)
-		case typeShortName:
+		case t == typeShortName || t == typeCompleteName:
 			a.LocalName = zeroTruncate(d)
-		case typeCompleteName:
-			a.LocalName = zeroTruncate(d)
-		case typeTxPower:
-			a.TxPowerLevel = int(d[0])
-		case typeServiceSol16:
+		case t == typeTxPower && len(d) >= 1:
+			a.TxPowerLevel = int(int8(d[0]))
+		case t == typeSecManagerOOB && len(d) >= 1:
+			a.SecurityManagerOOBFlags = d[0]
+		case t == typeSlaveConnInt && len(d) >= 4:
+			a.ConnIntervalMin, a.ConnIntervalMax = connInterval(d), connInterval(d[2:])
+		case t == typeServiceSol16:
 			a.SolicitedService = uuidList(a.SolicitedService, d, 2)
-		case typeServiceSol128:
-			a.SolicitedService = uuidList(a.SolicitedService, d, 16)
-		case typeServiceSol32:
+		case t == typeServiceSol32:
 			a.SolicitedService = uuidList(a.SolicitedService, d, 4)
-		case typeManufacturerData:
+		case t == typeServiceSol128:
+			a.SolicitedService = uuidList(a.SolicitedService, d, 16)
+		case t == typeManufacturerData:
 			sz := len(d)
 			a.ManufacturerData = make([]byte, sz)
 			copy(a.ManufacturerData, d)
 			if sz >= 2 {
 				a.CompanyID = binary.LittleEndian.Uint16(a.ManufacturerData[0:2])
 				a.Company = CompanyIdents[a.CompanyID]
+				a.Manufacturer = decodeManufacturerData(a.ManufacturerData)
 			}
-		case typeServiceData16:
+		case t == typeServiceData16:
 			a.ServiceData = serviceDataList(a.ServiceData, d, 2)
-		case typeServiceData32:
+		case t == typeServiceData32:
 			a.ServiceData = serviceDataList(a.ServiceData, d, 4)
-		case typeServiceData128:
+		case t == typeServiceData128:
 			a.ServiceData = serviceDataList(a.ServiceData, d, 16)
-		case typeAppearance:
-			a.Appearance = AppearanceData{raw: binary.LittleEndian.Uint16(d)}
-
-		default:
+		case t == typePubTargetAddr:
+			a.PublicTargetAddress = addressList(a.PublicTargetAddress, d)
+		case t == typeRandTargetAddr:
+			a.RandomTargetAddress = addressList(a.RandomTargetAddress, d)
+		case t == typeAppearance:
+			a.Appearance.decode(d)
+		case t == typeAdvInterval && len(d) >= 2 && len(d) <= 4:
+			var ivl uint32
+			for i := len(d) - 1; i >= 0; i-- {
+				ivl = ivl<<8 | uint32(d[i])
+			}
+			a.AdvInterval = time.Duration(ivl) * 625 * time.Microsecond
+		case t == typeLERole && len(d) >= 1 && d[0] <= 0x03:
+			a.LERole, a.HasLERole = LERole(d[0]), true
+		case t == typeURI:
+			a.URI = decodeURI(d)
 		}
-		b = b[1+l:]
 	}
+	a.Beacon = decodeBeacon(a)
 	return nil
 }
 
+// decodeURI returns the URI of the URI field d, with its scheme expanded.
+// The URIs of the schemes unknown are returned without scheme.
+func decodeURI(d []byte) string {
+	c, n := utf8.DecodeRune(d)
+	for s, sc := range uriSchemes {
+		if sc == c {
+			return s + string(d[n:])
+		}
+	}
+	return string(d[n:])
+}
+
 func zeroTruncate(b []byte) string {
 	i := bytes.Index(b, []byte{0})
 	if i < 0 {
@@ -2193,3 +2291,243 @@ func (a *AdvPacket) AppendUUIDFit(uu []constants.UUID) bool {
 	}
 	return fit
 }
+
+// AppendServices appends the service UUIDs to the packet, as a list per
+// run of UUIDs of the same length. complete tells whether the lists are
+// the complete lists of the services of the device.
+func (a *AdvPacket) AppendServices(uu []constants.UUID, complete bool) *AdvPacket {
+	if complete {
+		return a.appendFields(uuidFields(uu, typeAllUUID16, typeAllUUID32, typeAllUUID128))
+	}
+	return a.appendFields(uuidFields(uu, typeSomeUUID16, typeSomeUUID32, typeSomeUUID128))
+}
+
+// AppendSolicitedServices appends the service solicitation UUIDs to the
+// packet, as a list per run of UUIDs of the same length.
+func (a *AdvPacket) AppendSolicitedServices(uu []constants.UUID) *AdvPacket {
+	return a.appendFields(uuidFields(uu, typeServiceSol16, typeServiceSol32, typeServiceSol128))
+}
+
+// AppendServiceData appends a service data field to the packet.
+func (a *AdvPacket) AppendServiceData(u constants.UUID, b []byte) *AdvPacket {
+	f := serviceDataField(ServiceData{UUID: u, Data: b})
+	return a.AppendField(f.Type, f.Data)
+}
+
+// AppendTxPower appends a TX power level field, in dBm, to the packet.
+func (a *AdvPacket) AppendTxPower(pwr int8) *AdvPacket {
+	return a.AppendField(typeTxPower, []byte{byte(pwr)})
+}
+
+// AppendAppearance appends an appearance field to the packet.
+func (a *AdvPacket) AppendAppearance(v uint16) *AdvPacket {
+	return a.AppendField(typeAppearance, []byte{uint8(v), uint8(v >> 8)})
+}
+
+// AppendSlaveConnIntervalRange appends a slave connection interval range
+// field to the packet. The intervals are rounded down to multiples of
+// 1.25 ms; 0 means no specific minimum or maximum.
+func (a *AdvPacket) AppendSlaveConnIntervalRange(min, max time.Duration) *AdvPacket {
+	return a.AppendField(typeSlaveConnInt, connIntervalRangeData(min, max))
+}
+
+// connIntervalRangeData returns the data of the slave connection interval
+// range field of min and max.
+func connIntervalRangeData(min, max time.Duration) []byte {
+	ivl := func(d time.Duration) uint16 {
+		if d == 0 {
+			return 0xFFFF
+		}
+		return uint16(d / (1250 * time.Microsecond))
+	}
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, ivl(min))
+	binary.LittleEndian.PutUint16(b[2:], ivl(max))
+	return b
+}
+
+// AppendURI appends a URI field to the packet. The http and https schemes
+// are abbreviated.
+func (a *AdvPacket) AppendURI(uri string) *AdvPacket {
+	return a.AppendField(typeURI, uriData(uri))
+}
+
+// uriData returns the data of the URI field of uri.
+func uriData(uri string) []byte {
+	for s, c := range uriSchemes {
+		if strings.HasPrefix(uri, s) {
+			return []byte(string(c) + uri[len(s):])
+		}
+	}
+	return []byte(string(rune(uriNoScheme)) + uri)
+}
+
+// AppendLERole appends an LE role field to the packet.
+func (a *AdvPacket) AppendLERole(r LERole) *AdvPacket {
+	return a.AppendField(typeLERole, []byte{byte(r)})
+}
+
+// AppendAdvInterval appends an advertising interval field to the packet.
+// The interval is rounded down to a multiple of 0.625 ms.
+func (a *AdvPacket) AppendAdvInterval(d time.Duration) *AdvPacket {
+	return a.AppendField(typeAdvInterval, advIntervalData(d))
+}
+
+// advIntervalData returns the data of the advertising interval field of d.
+func advIntervalData(d time.Duration) []byte {
+	ivl := uint32(d / (625 * time.Microsecond))
+	b := []byte{uint8(ivl), uint8(ivl >> 8), uint8(ivl >> 16)}
+	if ivl <= 0xFFFF {
+		b = b[:2]
+	}
+	return b
+}
+
+// AppendTargetAddresses appends a public, or random, target address field
+// to the packet. The addresses are most significant octet first.
+func (a *AdvPacket) AppendTargetAddresses(random bool, aa []net.HardwareAddr) *AdvPacket {
+	f := targetAddressField(random, aa)
+	return a.AppendField(f.Type, f.Data)
+}
+
+// targetAddressField returns the target address field of aa.
+func targetAddressField(random bool, aa []net.HardwareAddr) AdvField {
+	f := AdvField{Type: typePubTargetAddr}
+	if random {
+		f.Type = typeRandTargetAddr
+	}
+	for _, addr := range aa {
+		for i := len(addr) - 1; i >= 0; i-- {
+			f.Data = append(f.Data, addr[i])
+		}
+	}
+	return f
+}
+
+// AppendSecurityManagerOOBFlags appends a Security Manager out of band
+// flags field to the packet.
+func (a *AdvPacket) AppendSecurityManagerOOBFlags(f uint8) *AdvPacket {
+	return a.AppendField(typeSecManagerOOB, []byte{f})
+}
+
+func (a *AdvPacket) appendFields(ff []AdvField) *AdvPacket {
+	for _, f := range ff {
+		a.AppendField(f.Type, f.Data)
+	}
+	return a
+}
+
+// uuidFields returns the fields listing uu, as a list of type typ16, typ32
+// or typ128 per run of UUIDs of the same length, split to fit in the fields.
+func uuidFields(uu []constants.UUID, typ16, typ32, typ128 byte) []AdvField {
+	var ff []AdvField
+	for i := 0; i < len(uu); {
+		f := AdvField{Type: typ128}
+		switch uu[i].Len() {
+		case 2:
+			f.Type = typ16
+		case 4:
+			f.Type = typ32
+		}
+		j := i
+		for j < len(uu) && uu[j].Len() == uu[i].Len() && 2+len(f.Data)+uu[j].Len() <= MaxEIRPacketLength {
+			f.Data = append(f.Data, uu[j].B...)
+			j++
+		}
+		ff = append(ff, f)
+		i = j
+	}
+	return ff
+}
+
+// serviceDataField returns the service data field of sd.
+func serviceDataField(sd ServiceData) AdvField {
+	f := AdvField{Type: typeServiceData128, Data: append(append([]byte(nil), sd.UUID.B...), sd.Data...)}
+	switch sd.UUID.Len() {
+	case 2:
+		f.Type = typeServiceData16
+	case 4:
+		f.Type = typeServiceData32
+	}
+	return f
+}
+
+// AdvPackets returns the advertising data carrying the fields of a, and the
+// scan response data carrying those which don't fit in it, or nil if all
+// do. The fields are laid out so that parsing the advertising data followed
+// by the scan response data yields a again, but for Raw, Fields, Beacon,
+// the data decoded and the fields not carried by the advertising data. The
+// fields whose value is 0 are left out, as is the LE role unless HasLERole
+// is set. ErrEIRPacketTooLong is returned if the fields don't fit in both
+// packets.
+func (a *Advertisement) AdvPackets() (adv, rsp *AdvPacket, err error) {
+	// The fields of each group are kept in order, so once a field of a
+	// group overflows to the scan response, the next ones follow. The flags
+	// come first, as they aren't allowed in the scan response.
+	var groups [][]AdvField
+	if a.Flags != 0 {
+		groups = append(groups, []AdvField{{typeFlags, []byte{byte(a.Flags)}}})
+	}
+	groups = append(groups,
+		uuidFields(a.Services, typeAllUUID16, typeAllUUID32, typeAllUUID128),
+		uuidFields(a.SolicitedService, typeServiceSol16, typeServiceSol32, typeServiceSol128))
+	var sds []AdvField
+	for _, sd := range a.ServiceData {
+		sds = append(sds, serviceDataField(sd))
+	}
+	groups = append(groups, sds)
+	if len(a.ManufacturerData) > 0 {
+		groups = append(groups, []AdvField{{typeManufacturerData, a.ManufacturerData}})
+	}
+	if a.TxPowerLevel != 0 {
+		groups = append(groups, []AdvField{{typeTxPower, []byte{byte(int8(a.TxPowerLevel))}}})
+	}
+	if v := a.Appearance.Value; v != 0 {
+		groups = append(groups, []AdvField{{typeAppearance, []byte{uint8(v), uint8(v >> 8)}}})
+	}
+	if a.HasLERole {
+		groups = append(groups, []AdvField{{typeLERole, []byte{byte(a.LERole)}}})
+	}
+	if a.AdvInterval != 0 {
+		groups = append(groups, []AdvField{{typeAdvInterval, advIntervalData(a.AdvInterval)}})
+	}
+	if a.ConnIntervalMin != 0 || a.ConnIntervalMax != 0 {
+		groups = append(groups, []AdvField{{typeSlaveConnInt, connIntervalRangeData(a.ConnIntervalMin, a.ConnIntervalMax)}})
+	}
+	if a.SecurityManagerOOBFlags != 0 {
+		groups = append(groups, []AdvField{{typeSecManagerOOB, []byte{a.SecurityManagerOOBFlags}}})
+	}
+	if len(a.PublicTargetAddress) > 0 {
+		groups = append(groups, []AdvField{targetAddressField(false, a.PublicTargetAddress)})
+	}
+	if len(a.RandomTargetAddress) > 0 {
+		groups = append(groups, []AdvField{targetAddressField(true, a.RandomTargetAddress)})
+	}
+	if a.URI != "" {
+		groups = append(groups, []AdvField{{typeURI, uriData(a.URI)}})
+	}
+	if a.LocalName != "" {
+		groups = append(groups, []AdvField{{typeCompleteName, []byte(a.LocalName)}})
+	}
+
+	adv, rsp = &AdvPacket{}, &AdvPacket{}
+	for _, g := range groups {
+		spilled := false
+		for _, f := range g {
+			n := 2 + len(f.Data)
+			switch {
+			case !spilled && len(adv.b)+n <= MaxEIRPacketLength:
+				adv.AppendField(f.Type, f.Data)
+			case len(rsp.b)+n <= MaxEIRPacketLength:
+				rsp.AppendField(f.Type, f.Data)
+				spilled = true
+			default:
+				return nil, nil, ErrEIRPacketTooLong
+			}
+		}
+	}
+	if len(rsp.b) == 0 {
+		rsp = nil
+	}
+	return adv, rsp, nil
+}
@@ -1,7 +1,13 @@
 package gatt
 
 import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/grutz/gatt/constants"
 )
@@ -112,3 +118,280 @@ func TestAppendUUIDFit(t *testing.T) {
 	// 	}
 	// }
 }
+
+func TestAppendFields(t *testing.T) {
+	u32 := constants.UUID{B: []byte{0x01, 0x02, 0x03, 0x04}}
+	cases := []struct {
+		name string
+		a    *AdvPacket
+		want []byte
+	}{
+		{
+			name: "service data",
+			a:    (&AdvPacket{}).AppendServiceData(constants.UUID16(0xFEAA), []byte{0x10, 0x20}),
+			want: []byte{0x05, typeServiceData16, 0xAA, 0xFE, 0x10, 0x20},
+		},
+		{
+			name: "32-bit service data",
+			a:    (&AdvPacket{}).AppendServiceData(u32, []byte{0x10}),
+			want: []byte{0x06, typeServiceData32, 0x01, 0x02, 0x03, 0x04, 0x10},
+		},
+		{
+			name: "TX power",
+			a:    (&AdvPacket{}).AppendTxPower(-8),
+			want: []byte{0x02, typeTxPower, 0xF8},
+		},
+		{
+			name: "appearance",
+			a:    (&AdvPacket{}).AppendAppearance(0x03C1),
+			want: []byte{0x03, typeAppearance, 0xC1, 0x03},
+		},
+		{
+			name: "slave connection interval range",
+			a:    (&AdvPacket{}).AppendSlaveConnIntervalRange(10*time.Millisecond, 0),
+			want: []byte{0x05, typeSlaveConnInt, 0x08, 0x00, 0xFF, 0xFF},
+		},
+		{
+			name: "URI",
+			a:    (&AdvPacket{}).AppendURI("https://a.io"),
+			want: append([]byte{0x08, typeURI, 0x17}, "//a.io"...),
+		},
+		{
+			name: "URI without abbreviated scheme",
+			a:    (&AdvPacket{}).AppendURI("ftp://a"),
+			want: append([]byte{0x09, typeURI, 0x01}, "ftp://a"...),
+		},
+		{
+			name: "LE role",
+			a:    (&AdvPacket{}).AppendLERole(LERoleCentralPreferred),
+			want: []byte{0x02, typeLERole, 0x03},
+		},
+		{
+			name: "services",
+			a:    (&AdvPacket{}).AppendServices([]constants.UUID{constants.UUID16(0x180D), constants.UUID16(0x180F), u32}, false),
+			want: []byte{0x05, typeSomeUUID16, 0x0D, 0x18, 0x0F, 0x18, 0x05, typeSomeUUID32, 0x01, 0x02, 0x03, 0x04},
+		},
+		{
+			name: "solicited services",
+			a:    (&AdvPacket{}).AppendSolicitedServices([]constants.UUID{u32}),
+			want: []byte{0x05, typeServiceSol32, 0x01, 0x02, 0x03, 0x04},
+		},
+	}
+	for _, tt := range cases {
+		if !bytes.Equal(tt.a.b, tt.want) {
+			t.Errorf("%s: got % X, want % X", tt.name, tt.a.b, tt.want)
+		}
+	}
+}
+
+func TestAdvPacketsRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		a     Advertisement
+		split bool // whether the fields overflow to the scan response
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "name and services",
+			a: Advertisement{
+				Flags:     FlagGeneralDiscoverable | FlagLEOnly,
+				LocalName: "Heart Rate",
+				Services:  []constants.UUID{constants.UUID16(0x180D), constants.UUID16(0x180F)},
+			},
+		},
+		{
+			name: "all the fields",
+			a: Advertisement{
+				Flags:            FlagLimitedDiscoverable | FlagLEOnly,
+				LocalName:        "Device name",
+				Services:         []constants.UUID{constants.MustParseUUID("ABABABABABABABABABABABABABABABAB")},
+				SolicitedService: []constants.UUID{constants.UUID16(0x1812)},
+				ServiceData: []ServiceData{
+					{UUID: constants.UUID16(0xFEAA), Data: []byte{0x10, 0xF4}},
+					{UUID: constants.UUID{B: []byte{0x01, 0x02, 0x03, 0x04}}, Data: []byte{0x42}},
+				},
+				TxPowerLevel: -12,
+				Appearance:   AppearanceData{Category: "Human Interface Device", SubCategory: "Keyboard", Value: 0x03C1},
+			},
+			split: true,
+		},
+		{
+			name: "LE fields",
+			a: Advertisement{
+				LERole:                  LERolePeripheralPreferred,
+				HasLERole:               true,
+				AdvInterval:             100 * time.Millisecond,
+				ConnIntervalMin:         15 * time.Millisecond,
+				SecurityManagerOOBFlags: 0x01,
+				RandomTargetAddress:     []net.HardwareAddr{{0xC0, 0x01, 0x02, 0x03, 0x04, 0x05}},
+				URI:                     "https://example.com",
+			},
+			split: true,
+		},
+		{
+			name: "manufacturer data",
+			a: Advertisement{
+				ManufacturerData: []byte{0x4C, 0x00, 0x02, 0x15},
+				CompanyID:        0x004C,
+				Company:          CompanyIdents[0x004C],
+			},
+		},
+	}
+	for _, tt := range cases {
+		adv, rsp, err := tt.a.AdvPackets()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (rsp != nil) != tt.split {
+			t.Errorf("%s: got scan response %v, want %t", tt.name, rsp, tt.split)
+		}
+		b := adv.b
+		if rsp != nil {
+			b = append(append([]byte(nil), b...), rsp.b...)
+		}
+		got := Advertisement{}
+		if err := got.unmarshall(b); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got.Raw, got.Fields = nil, nil
+		if !reflect.DeepEqual(got, tt.a) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.a)
+		}
+	}
+
+	tooLong := Advertisement{LocalName: strings.Repeat("n", MaxEIRPacketLength)}
+	if _, _, err := tooLong.AdvPackets(); err != ErrEIRPacketTooLong {
+		t.Errorf("too long: got error %v, want %v", err, ErrEIRPacketTooLong)
+	}
+}
+
+// unhex returns the bytes of the hexadecimal string s, whose spaces are
+// ignored. It panics if s isn't valid.
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestAdvertisementUnmarshall(t *testing.T) {
+	ibeacon := &IBeacon{
+		UUID:          constants.MustParseUUID("E2C56DB5-DFFB-48D2-B060-D0F5A71096E0"),
+		Major:         1,
+		Minor:         2,
+		MeasuredPower: -59,
+	}
+	cases := []struct {
+		name   string
+		b      []byte
+		want   Advertisement // but for Raw and Fields
+		fields int
+		err    bool
+	}{
+		{
+			name: "iBeacon",
+			b:    unhex("02 01 06 1A FF 4C 00 02 15 E2C56DB5DFFB48D2B060D0F5A71096E0 0001 0002 C5"),
+			want: Advertisement{
+				Flags:            FlagGeneralDiscoverable | FlagLEOnly,
+				ManufacturerData: unhex("4C 00 02 15 E2C56DB5DFFB48D2B060D0F5A71096E0 0001 0002 C5"),
+				CompanyID:        0x004C,
+				Company:          CompanyIdents[0x004C],
+				Beacon:           ibeacon,
+				Manufacturer: &AppleData{
+					Messages: []AppleMessage{{Type: AppleIBeacon, Data: unhex("E2C56DB5DFFB48D2B060D0F5A71096E0 0001 0002 C5")}},
+					IBeacon:  ibeacon,
+				},
+			},
+			fields: 2,
+		},
+		{
+			name: "Eddystone URL",
+			b:    unhex("02 01 06 03 03 AA FE 0D 16 AA FE 10 F4 00 67 6F 6F 67 6C 65 07"),
+			want: Advertisement{
+				Flags:       FlagGeneralDiscoverable | FlagLEOnly,
+				Services:    []constants.UUID{constants.UUID16(0xFEAA)},
+				ServiceData: []ServiceData{{UUID: constants.UUID16(0xFEAA), Data: unhex("10 F4 00 67 6F 6F 67 6C 65 07")}},
+				Beacon:      &EddystoneURL{TxPower: -12, URL: "http://www.google.com"},
+			},
+			fields: 3,
+		},
+		{
+			name: "heart rate belt",
+			b:    unhex("02 01 06 03 03 0D 18 03 19 41 03 02 0A F8 0A 09 50 6F 6C 61 72 20 48 31 30"),
+			want: Advertisement{
+				Flags:        FlagGeneralDiscoverable | FlagLEOnly,
+				Services:     []constants.UUID{constants.UUID16(0x180D)},
+				Appearance:   AppearanceData{Category: "Heart Rate Sensor", SubCategory: "Heart Rate Belt", Value: 0x0341},
+				TxPowerLevel: -8,
+				LocalName:    "Polar H10",
+			},
+			fields: 5,
+		},
+		{
+			name: "128-bit service data and 32-bit solicitation",
+			b:    unhex("13 21 ABABABABABABABABABABABABABABABAB 01 02 05 1F 01 02 03 04"),
+			want: Advertisement{
+				ServiceData:      []ServiceData{{UUID: constants.MustParseUUID("ABABABABABABABABABABABABABABABAB"), Data: unhex("01 02")}},
+				SolicitedService: []constants.UUID{{B: unhex("01 02 03 04")}},
+			},
+			fields: 2,
+		},
+		{
+			name: "LE role, URI and target address",
+			b:    unhex("02 1C 00 08 24 17 2F 2F 61 2E 69 6F 07 17 05 04 03 02 01 00 03 1A A0 00 05 12 06 00 FF FF 02 11 03"),
+			want: Advertisement{
+				LERole:                  LERolePeripheral,
+				HasLERole:               true,
+				URI:                     "https://a.io",
+				PublicTargetAddress:     []net.HardwareAddr{{0x00, 0x01, 0x02, 0x03, 0x04, 0x05}},
+				AdvInterval:             100 * time.Millisecond,
+				ConnIntervalMin:         7500 * time.Microsecond,
+				SecurityManagerOOBFlags: 0x03,
+			},
+			fields: 6,
+		},
+		{
+			name:   "zero padding",
+			b:      unhex("02 01 06 00 00 00 00"),
+			want:   Advertisement{Flags: FlagGeneralDiscoverable | FlagLEOnly},
+			fields: 1,
+		},
+		{
+			name:   "fields too short",
+			b:      unhex("01 01 01 0A 01 19 00"),
+			fields: 3,
+		},
+		{
+			name: "truncated field",
+			b:    unhex("02 01 06 05 09 41"),
+			err:  true,
+		},
+	}
+
+	for _, tt := range cases {
+		a := Advertisement{}
+		err := a.unmarshall(tt.b)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, want error %t", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if !bytes.Equal(a.Raw, tt.b) {
+			t.Errorf("%s: got raw % X, want % X", tt.name, a.Raw, tt.b)
+		}
+		if len(a.Fields) != tt.fields {
+			t.Errorf("%s: got %d fields, want %d", tt.name, len(a.Fields), tt.fields)
+		}
+		a.Raw, a.Fields = nil, nil
+		if !reflect.DeepEqual(a, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, a, tt.want)
+		}
+	}
+}
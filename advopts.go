@@ -0,0 +1,127 @@
+package gatt
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// AdvMode is the kind of legacy advertising of Device.AdvertiseWithOptions.
+type AdvMode int
+
+const (
+	AdvModeConnectable      AdvMode = iota // Connectable and scannable (ADV_IND).
+	AdvModeScannable                       // Scannable, not connectable (ADV_SCAN_IND).
+	AdvModeNonConnectable                  // Neither connectable nor scannable (ADV_NONCONN_IND).
+	AdvModeDirectedHighDuty                // Connectable by Peer only, for up to 1.28 s (ADV_DIRECT_IND).
+	AdvModeDirectedLowDuty                 // Connectable by Peer only (ADV_DIRECT_IND).
+)
+
+var advModeName = map[AdvMode]string{
+	AdvModeConnectable:      "Connectable",
+	AdvModeScannable:        "Scannable",
+	AdvModeNonConnectable:   "Non-connectable",
+	AdvModeDirectedHighDuty: "Directed (high duty cycle)",
+	AdvModeDirectedLowDuty:  "Directed (low duty cycle)",
+}
+
+func (m AdvMode) String() string { return advModeName[m] }
+
+// connectable reports whether the centrals can connect to the mode.
+func (m AdvMode) connectable() bool {
+	return m != AdvModeScannable && m != AdvModeNonConnectable
+}
+
+// directed reports whether the mode targets a single peer.
+func (m AdvMode) directed() bool {
+	return m == AdvModeDirectedHighDuty || m == AdvModeDirectedLowDuty
+}
+
+// LimitedDiscoverableTimeout is the longest time a device may stay in the
+// LE Limited Discoverable Mode, TGAP(lim_adv_timeout).
+const LimitedDiscoverableTimeout = 180 * time.Second
+
+// AdvertiseOptions are the options of Device.AdvertiseWithOptions.
+type AdvertiseOptions struct {
+	Mode AdvMode
+
+	// Peer is the identity address of the bonded peer the directed modes
+	// target.
+	Peer net.HardwareAddr
+
+	// LimitedDiscoverable advertises in the LE Limited Discoverable Mode,
+	// with FlagLimitedDiscoverable, for Timeout, or for
+	// LimitedDiscoverableTimeout if Timeout is 0.
+	LimitedDiscoverable bool
+
+	// Timeout stops the advertising once elapsed, if not 0.
+	Timeout time.Duration
+
+	// Interval is the advertising interval; the one of the advertising
+	// parameters if 0. The high duty cycle directed advertising ignores it.
+	Interval time.Duration
+}
+
+// validate checks that the options are consistent.
+func (o *AdvertiseOptions) validate() error {
+	switch {
+	case o.Mode < AdvModeConnectable || o.Mode > AdvModeDirectedLowDuty:
+		return errors.New("invalid advertising mode")
+	case o.Mode.directed() && len(o.Peer) != 6:
+		return errors.New("directed advertising without peer")
+	case o.Mode.directed() && o.LimitedDiscoverable:
+		return errors.New("directed advertising isn't discoverable")
+	case o.LimitedDiscoverable && o.Timeout > LimitedDiscoverableTimeout:
+		return errors.New("limited discoverable mode longer than 180 s")
+	case o.Timeout < 0 || o.Interval < 0:
+		return errors.New("negative advertising timeout or interval")
+	}
+	return nil
+}
+
+// timeout returns how long the advertising lasts, or 0 if it doesn't stop.
+func (o *AdvertiseOptions) timeout() time.Duration {
+	if o.LimitedDiscoverable && o.Timeout == 0 {
+		return LimitedDiscoverableTimeout
+	}
+	return o.Timeout
+}
+
+// packet returns a with the flags the options call for: the discoverable
+// mode is replaced by the limited one in the LE Limited Discoverable Mode,
+// and the connectable modes get the general one if a has no flags.
+func (o *AdvertiseOptions) packet(a *AdvPacket) (*AdvPacket, error) {
+	var flags byte
+	hasFlags := false
+	var rest []byte // the fields of a, but the flags
+	for b := a.b; len(b) > 1; {
+		n := int(b[0]) + 1
+		if n > len(b) {
+			n = len(b)
+		}
+		if b[1] == typeFlags && n >= 3 {
+			flags, hasFlags = b[2], true
+		} else if b[0] != 0 {
+			rest = append(rest, b[:n]...)
+		}
+		b = b[n:]
+	}
+	switch {
+	case o.LimitedDiscoverable:
+		if !hasFlags {
+			flags = FlagLEOnly
+		}
+		flags = flags&^FlagGeneralDiscoverable | FlagLimitedDiscoverable
+	case hasFlags || !o.Mode.connectable():
+		return a, nil
+	default:
+		flags = FlagGeneralDiscoverable | FlagLEOnly
+	}
+	p := &AdvPacket{}
+	p.AppendFlags(flags)
+	p.b = append(p.b, rest...)
+	if len(p.b) > MaxEIRPacketLength {
+		return nil, ErrEIRPacketTooLong
+	}
+	return p, nil
+}
@@ -0,0 +1,69 @@
+package gatt
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdvertiseOptionsValidate(t *testing.T) {
+	peer := net.HardwareAddr{0xC0, 0x01, 0x02, 0x03, 0x04, 0x05}
+	cases := []struct {
+		name string
+		o    AdvertiseOptions
+		err  string // a part of the error wanted, none if empty
+	}{
+		{name: "connectable", o: AdvertiseOptions{}},
+		{name: "non-connectable", o: AdvertiseOptions{Mode: AdvModeNonConnectable, Timeout: time.Minute}},
+		{name: "invalid mode", o: AdvertiseOptions{Mode: AdvModeDirectedLowDuty + 1}, err: "invalid advertising mode"},
+		{name: "directed", o: AdvertiseOptions{Mode: AdvModeDirectedHighDuty, Peer: peer}},
+		{name: "directed without peer", o: AdvertiseOptions{Mode: AdvModeDirectedLowDuty}, err: "without peer"},
+		{name: "directed limited", o: AdvertiseOptions{Mode: AdvModeDirectedLowDuty, Peer: peer, LimitedDiscoverable: true}, err: "isn't discoverable"},
+		{name: "limited", o: AdvertiseOptions{LimitedDiscoverable: true, Timeout: 30 * time.Second}},
+		{name: "limited too long", o: AdvertiseOptions{LimitedDiscoverable: true, Timeout: 181 * time.Second}, err: "longer than 180 s"},
+		{name: "negative interval", o: AdvertiseOptions{Interval: -time.Millisecond}, err: "negative"},
+	}
+
+	for _, tt := range cases {
+		checkError(t, tt.name, tt.o.validate(), tt.err)
+	}
+}
+
+func TestAdvertiseOptionsPacket(t *testing.T) {
+	name := (&AdvPacket{}).AppendName("n").b
+	withFlags := func(f byte) []byte {
+		return append((&AdvPacket{}).AppendFlags(f).b, name...)
+	}
+	cases := []struct {
+		name string
+		o    AdvertiseOptions
+		in   []byte
+		want []byte
+	}{
+		{name: "general", in: name, want: withFlags(FlagGeneralDiscoverable | FlagLEOnly)},
+		{name: "flags kept", in: withFlags(FlagLEOnly), want: withFlags(FlagLEOnly)},
+		{name: "non-connectable", o: AdvertiseOptions{Mode: AdvModeNonConnectable}, in: name, want: name},
+		{name: "limited", o: AdvertiseOptions{LimitedDiscoverable: true}, in: withFlags(FlagGeneralDiscoverable | FlagLEOnly), want: withFlags(FlagLimitedDiscoverable | FlagLEOnly)},
+		{name: "limited without flags", o: AdvertiseOptions{LimitedDiscoverable: true}, in: name, want: withFlags(FlagLimitedDiscoverable | FlagLEOnly)},
+	}
+
+	for _, tt := range cases {
+		p, err := tt.o.packet(&AdvPacket{b: tt.in})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(p.b, tt.want) {
+			t.Errorf("%s: got % X, want % X", tt.name, p.b, tt.want)
+		}
+	}
+	if tt := (AdvertiseOptions{LimitedDiscoverable: true}); tt.timeout() != LimitedDiscoverableTimeout {
+		t.Errorf("limited: got timeout %v, want %v", tt.timeout(), LimitedDiscoverableTimeout)
+	}
+
+	long := append([]byte{MaxEIRPacketLength - 1, typeCompleteName}, bytes.Repeat([]byte{'n'}, MaxEIRPacketLength-2)...)
+	if _, err := (&AdvertiseOptions{}).packet(&AdvPacket{b: long}); err != ErrEIRPacketTooLong {
+		t.Errorf("too long: got error %v, want %v", err, ErrEIRPacketTooLong)
+	}
+}
@@ -0,0 +1,215 @@
+package gatt
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// An AdvEntry is an advertising payload rotated by an AdvScheduler.
+type AdvEntry struct {
+	Data         *AdvPacket // advertising data
+	ScanResponse *AdvPacket // scan response data, if any
+
+	// Duration is how long the payload is advertised in each rotation. With
+	// the extended advertising sets, the payloads are advertised at once,
+	// and Duration weights how often each one is sent instead.
+	Duration time.Duration
+}
+
+// The range of the advertising intervals of the legacy advertising PDUs.
+const (
+	minAdvInterval = 20 * time.Millisecond
+	maxAdvInterval = 10240 * time.Millisecond
+)
+
+// An advertiser is a device which an AdvScheduler can run on.
+type advertiser interface {
+	Device
+
+	// advertiseData sets the legacy advertising data, and scan response
+	// data, without interrupting the advertising. startAdvertising starts
+	// the legacy advertising.
+	advertiseData(a, rsp *AdvPacket) error
+	startAdvertising() error
+
+	// advertisingPaused reports whether the advertising is paused until a
+	// connection is lost, as no more connections can be accepted.
+	advertisingPaused() bool
+
+	// extendedMode reports whether the extended advertising commands are
+	// used, and advSetsAvailable whether they can be, as the controller
+	// supports them and the legacy advertising and scanning are disabled.
+	extendedMode() bool
+	advSetsAvailable() bool
+
+	// advInterval returns the interval of the legacy advertising, and
+	// advKind whether it's connectable, and scannable.
+	advInterval() time.Duration
+	advKind() (connectable, scannable bool)
+}
+
+// An AdvScheduler advertises several payloads in turn, e.g. an iBeacon and
+// the name and services of the device. The legacy advertising data is
+// swapped without interrupting the advertising, and the rotation is paused
+// while no more connections can be accepted.
+//
+// When the controller supports the extended advertising, and the legacy
+// advertising and scanning aren't enabled, each payload is advertised by an advertising
+// set of its own instead, see Device.AdvertiseSet. The sets are connectable
+// and scannable as the legacy advertising parameters of the device tell.
+// Once the sets are used, the legacy advertising commands are disallowed
+// until the device is reset.
+type AdvScheduler struct {
+	// AdvSets forces advertising the payloads with sets, so Start fails
+	// unless they can be used. It must be set before Start.
+	AdvSets bool
+
+	d       advertiser
+	entries []AdvEntry
+
+	mu    sync.Mutex
+	sets  []*AdvSet     // the sets advertising the entries, if supported
+	stopc chan struct{} // closed to stop the rotation
+	donec chan struct{} // closed once the rotation is stopped
+}
+
+// NewAdvScheduler returns a scheduler rotating entries on the device d.
+func NewAdvScheduler(d Device, entries ...AdvEntry) (*AdvScheduler, error) {
+	a, ok := d.(advertiser)
+	if !ok {
+		return nil, errors.New("advertising scheduler not supported")
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no advertising entries")
+	}
+	for _, e := range entries {
+		if e.Data == nil || e.Duration <= 0 {
+			return nil, errors.New("advertising entry without data or duration")
+		}
+	}
+	return &AdvScheduler{d: a, entries: entries}, nil
+}
+
+// Start starts advertising the entries.
+func (s *AdvScheduler) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sets != nil || s.stopc != nil {
+		return errors.New("advertising scheduler already started")
+	}
+	if s.AdvSets || s.d.extendedMode() || s.d.advSetsAvailable() {
+		return s.startSets()
+	}
+	e := s.entries[0]
+	if err := s.d.advertiseData(e.Data, e.ScanResponse); err != nil {
+		return err
+	}
+	if err := s.d.startAdvertising(); err != nil {
+		return err
+	}
+	if len(s.entries) > 1 {
+		s.stopc, s.donec = make(chan struct{}), make(chan struct{})
+		go s.rotate(s.stopc, s.donec)
+	}
+	return nil
+}
+
+// startSets advertises each entry with a legacy advertising set, whose
+// interval is inversely proportional to the duration of the entry, see
+// setInterval. s.mu must be held.
+func (s *AdvScheduler) startSets() error {
+	var longest time.Duration
+	for _, e := range s.entries {
+		if e.Duration > longest {
+			longest = e.Duration
+		}
+	}
+	ivl := s.d.advInterval()
+	conn, scan := s.d.advKind()
+	for _, e := range s.entries {
+		set := &AdvSet{
+			Data:        e.Data.b,
+			Connectable: conn,
+			Scannable:   scan,
+			Legacy:      true,
+			Interval:    setInterval(ivl, longest, e.Duration),
+		}
+		if e.ScanResponse != nil {
+			set.ScanResponse = e.ScanResponse.b
+		}
+		if err := s.d.AdvertiseSet(set); err != nil {
+			s.stopSets()
+			return err
+		}
+		s.sets = append(s.sets, set)
+	}
+	return nil
+}
+
+// setInterval returns the interval of the set of an entry lasting d, when
+// the set of the longest entry, lasting longest, is advertised every ivl.
+// The interval is kept within the legal range.
+func setInterval(ivl, longest, d time.Duration) time.Duration {
+	i := time.Duration(float64(ivl) * float64(longest) / float64(d))
+	switch {
+	case i < minAdvInterval:
+		return minAdvInterval
+	case i > maxAdvInterval:
+		return maxAdvInterval
+	}
+	return i
+}
+
+// stopSets stops the sets advertising the entries. s.mu must be held.
+func (s *AdvScheduler) stopSets() error {
+	var err error
+	for _, set := range s.sets {
+		if e := s.d.StopAdvertiseSet(set); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.sets = nil
+	return err
+}
+
+// rotate swaps the legacy advertising data in turn, until stopc is closed.
+func (s *AdvScheduler) rotate(stopc, donec chan struct{}) {
+	defer close(donec)
+	i := 0
+	for {
+		t := time.NewTimer(s.entries[i].Duration)
+		select {
+		case <-stopc:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if s.d.advertisingPaused() {
+			// Hold on to the current entry until the advertising resumes.
+			continue
+		}
+		i = (i + 1) % len(s.entries)
+		e := s.entries[i]
+		if err := s.d.advertiseData(e.Data, e.ScanResponse); err != nil {
+			log.Printf("advertising scheduler: %v", err)
+		}
+	}
+}
+
+// Stop stops advertising the entries.
+func (s *AdvScheduler) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sets != nil {
+		return s.stopSets()
+	}
+	if s.stopc == nil {
+		return s.d.StopAdvertising()
+	}
+	close(s.stopc)
+	<-s.donec
+	s.stopc, s.donec = nil, nil
+	return s.d.StopAdvertising()
+}
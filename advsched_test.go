@@ -0,0 +1,182 @@
+package gatt
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAdvertiser is a simulated device, which records the advertising.
+type testAdvertiser struct {
+	*simDevice
+	mu     sync.Mutex
+	ext    bool // extended commands used
+	avail  bool // extended commands usable
+	conn   bool // connectable legacy advertising
+	scan   bool // scannable legacy advertising
+	paused bool
+	data   []string
+	adv    map[*AdvSet]bool
+}
+
+func (d *testAdvertiser) advertiseData(a, rsp *AdvPacket) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.data = append(d.data, string(a.b))
+	return nil
+}
+
+func (d *testAdvertiser) startAdvertising() error { return nil }
+func (d *testAdvertiser) StopAdvertising() error  { return nil }
+func (d *testAdvertiser) extendedMode() bool      { return d.ext }
+func (d *testAdvertiser) advSetsAvailable() bool  { return d.avail }
+func (d *testAdvertiser) advKind() (bool, bool)   { return d.conn, d.scan }
+func (d *testAdvertiser) advInterval() time.Duration {
+	return 100 * time.Millisecond
+}
+
+func (d *testAdvertiser) advertisingPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+func (d *testAdvertiser) AdvertiseSet(s *AdvSet) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	d.adv[s] = true
+	return nil
+}
+
+func (d *testAdvertiser) StopAdvertiseSet(s *AdvSet) error {
+	delete(d.adv, s)
+	return nil
+}
+
+func (d *testAdvertiser) advertised() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.data...)
+}
+
+func TestAdvScheduler(t *testing.T) {
+	entries := []AdvEntry{
+		{Data: (&AdvPacket{}).AppendName("a"), Duration: 20 * time.Millisecond},
+		{Data: (&AdvPacket{}).AppendName("b"), Duration: 10 * time.Millisecond},
+	}
+
+	d := &testAdvertiser{simDevice: &simDevice{}, adv: map[*AdvSet]bool{}}
+	s, err := NewAdvScheduler(d, entries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	d.mu.Lock()
+	d.paused = true
+	d.mu.Unlock()
+	time.Sleep(40 * time.Millisecond)
+	n := len(d.advertised())
+	time.Sleep(60 * time.Millisecond)
+	if m := len(d.advertised()); m != n {
+		t.Errorf("rotated %d times while paused", m-n)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := d.advertised()
+	if len(data) < 4 {
+		t.Fatalf("advertised %d payloads, want at least 4", len(data))
+	}
+	for i, b := range data {
+		if want := string(entries[i%2].Data.b); b != want {
+			t.Errorf("payload %d: got % X, want % X", i, b, want)
+		}
+	}
+
+	// With the extended advertising, each entry gets a set, of the kind of
+	// the legacy advertising.
+	s.AdvSets, d.scan = true, true
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.adv) != 2 {
+		t.Fatalf("advertised %d sets, want 2", len(d.adv))
+	}
+	for set := range d.adv {
+		want := 100 * time.Millisecond
+		if string(set.Data) == string(entries[1].Data.b) {
+			want = 200 * time.Millisecond
+		}
+		if set.Interval != want || !set.Legacy {
+			t.Errorf("set %q: interval %v, legacy %t; want %v, true", set.Data, set.Interval, set.Legacy, want)
+		}
+		if set.Connectable || !set.Scannable {
+			t.Errorf("set %q: connectable %t, scannable %t; want false, true", set.Data, set.Connectable, set.Scannable)
+		}
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.adv) != 0 {
+		t.Errorf("%d sets left advertised", len(d.adv))
+	}
+
+	// The sets are used whenever the extended commands can be used.
+	s.AdvSets, d.avail = false, true
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.adv) != 2 {
+		t.Fatalf("advertised %d sets with the extended commands available, want 2", len(d.adv))
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the device uses the extended commands, the sets are used anyway.
+	d.avail, d.ext = false, true
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.adv) != 2 {
+		t.Fatalf("advertised %d sets in extended mode, want 2", len(d.adv))
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetInterval(t *testing.T) {
+	cases := []struct {
+		ivl, longest, d time.Duration
+		want            time.Duration
+	}{
+		{100 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond, 200 * time.Millisecond},
+		{1280 * time.Millisecond, 10 * time.Second, 5 * time.Second, 2560 * time.Millisecond},
+		{1280 * time.Millisecond, time.Hour, time.Second, maxAdvInterval},
+		{10 * time.Millisecond, time.Second, time.Second, minAdvInterval},
+	}
+	for _, tt := range cases {
+		if got := setInterval(tt.ivl, tt.longest, tt.d); got != tt.want {
+			t.Errorf("setInterval(%v, %v, %v): got %v, want %v", tt.ivl, tt.longest, tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestNewAdvScheduler(t *testing.T) {
+	d := &testAdvertiser{simDevice: &simDevice{}}
+	if _, err := NewAdvScheduler(d); err == nil {
+		t.Error("no entries: got no error")
+	}
+	if _, err := NewAdvScheduler(d, AdvEntry{Data: &AdvPacket{}}); err == nil {
+		t.Error("no duration: got no error")
+	}
+	if _, err := NewAdvScheduler(&simDevice{}, AdvEntry{Data: &AdvPacket{}, Duration: time.Second}); err == nil {
+		t.Error("simulated device: got no error")
+	}
+}
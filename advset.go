@@ -0,0 +1,84 @@
+package gatt
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// MaxExtAdvDataLength is the maximum length of the advertising data, or scan
+// response data, of an extended advertising set. Controllers might support
+// less; the sets are limited to what the controller reports.
+const MaxExtAdvDataLength = 1650
+
+// An AdvSet is an extended advertising set. Several sets are advertised at
+// once, each with its own data, parameters, and possibly address.
+// The sets are started, and updated, with Device.AdvertiseSet.
+type AdvSet struct {
+	// Data is the advertising data, up to MaxExtAdvDataLength bytes, or
+	// MaxEIRPacketLength bytes for the legacy sets.
+	Data []byte
+
+	// ScanResponse is the scan response data of the scannable sets.
+	ScanResponse []byte
+
+	// Connectable sets accept connections, and Scannable sets answer the scan
+	// requests with ScanResponse. An extended set can't be both; a legacy
+	// set can.
+	Connectable bool
+	Scannable   bool
+
+	// Legacy sets use the legacy advertising PDUs, seen by the scanners
+	// which don't support the extended advertising.
+	Legacy bool
+
+	// Interval is the advertising interval; 1.28 s if 0.
+	Interval time.Duration
+
+	// PrimaryPHY is the PHY of the advertising channels: PHY1M or PHYCoded.
+	// SecondaryPHY is the PHY the data is sent on. They default to PHY1M, and
+	// to PrimaryPHY. Legacy sets always use PHY1M.
+	PrimaryPHY   PHY
+	SecondaryPHY PHY
+
+	// SID identifies the set to the scanners, among the sets of the device.
+	// It ranges from 0x00 to 0x0F.
+	SID uint8
+
+	// Address is the static random address the set is advertised with. The
+	// public address of the device is used if it's nil.
+	Address net.HardwareAddr
+
+	// PeriodicInterval is the interval of the periodic advertising of the
+	// set, which broadcasts PeriodicData to the scanners synchronized to it,
+	// see Device.SyncPeriodic. The set advertises periodically if it's not 0;
+	// it must then be an extended set neither connectable nor scannable.
+	PeriodicInterval time.Duration
+	PeriodicData     []byte
+}
+
+// validate checks that the set is consistent.
+func (s *AdvSet) validate() error {
+	switch {
+	case s.Legacy && (len(s.Data) > MaxEIRPacketLength || len(s.ScanResponse) > MaxEIRPacketLength):
+		return errors.New("legacy advertising data longer than 31 bytes")
+	case len(s.Data) > MaxExtAdvDataLength || len(s.ScanResponse) > MaxExtAdvDataLength:
+		return errors.New("advertising data longer than 1650 bytes")
+	case !s.Legacy && s.Connectable && s.Scannable:
+		return errors.New("an extended advertising set can't be both connectable and scannable")
+	case s.PrimaryPHY == PHY2M:
+		return errors.New("the LE 2M PHY can't be used on the advertising channels")
+	case s.SID > 0x0F:
+		return errors.New("invalid advertising SID")
+	case s.Address != nil && len(s.Address) != 6:
+		return errors.New("invalid advertising set address")
+	case s.PeriodicInterval == 0:
+	case s.Legacy || s.Connectable || s.Scannable:
+		return errors.New("only the non-connectable and non-scannable extended sets advertise periodically")
+	case s.PeriodicInterval < 7500*time.Microsecond:
+		return errors.New("periodic advertising interval shorter than 7.5 ms")
+	case len(s.PeriodicData) > MaxExtAdvDataLength:
+		return errors.New("periodic advertising data longer than 1650 bytes")
+	}
+	return nil
+}
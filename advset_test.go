@@ -0,0 +1,35 @@
+package gatt
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdvSetValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		s    AdvSet
+		err  string // a part of the error wanted, none if empty
+	}{
+		{name: "extended", s: AdvSet{Data: make([]byte, MaxExtAdvDataLength), Connectable: true}},
+		{name: "too long", s: AdvSet{Data: make([]byte, MaxExtAdvDataLength+1)}, err: "advertising data longer than 1650"},
+		{name: "legacy", s: AdvSet{Data: make([]byte, 31), Connectable: true, Scannable: true, Legacy: true}},
+		{name: "legacy too long", s: AdvSet{Data: make([]byte, 32), Legacy: true}, err: "longer than 31"},
+		{name: "connectable and scannable", s: AdvSet{Connectable: true, Scannable: true}, err: "both connectable and scannable"},
+		{name: "2M primary PHY", s: AdvSet{PrimaryPHY: PHY2M}, err: "LE 2M PHY"},
+		{name: "coded PHY", s: AdvSet{PrimaryPHY: PHYCoded, SecondaryPHY: PHY2M}},
+		{name: "SID", s: AdvSet{SID: 0x10}, err: "invalid advertising SID"},
+		{name: "address", s: AdvSet{Address: net.HardwareAddr{0xC0, 0x01, 0x02, 0x03, 0x04, 0x05}}},
+		{name: "short address", s: AdvSet{Address: net.HardwareAddr{0xC0}}, err: "invalid advertising set address"},
+		{name: "periodic", s: AdvSet{PeriodicInterval: 100 * time.Millisecond, PeriodicData: make([]byte, MaxExtAdvDataLength)}},
+		{name: "periodic connectable", s: AdvSet{Connectable: true, PeriodicInterval: 100 * time.Millisecond}, err: "advertise periodically"},
+		{name: "periodic legacy", s: AdvSet{Legacy: true, PeriodicInterval: 100 * time.Millisecond}, err: "advertise periodically"},
+		{name: "periodic interval", s: AdvSet{PeriodicInterval: 5 * time.Millisecond}, err: "shorter than 7.5 ms"},
+		{name: "periodic too long", s: AdvSet{PeriodicInterval: time.Second, PeriodicData: make([]byte, MaxExtAdvDataLength+1)}, err: "periodic advertising data longer"},
+	}
+
+	for _, tt := range cases {
+		checkError(t, tt.name, tt.s.validate(), tt.err)
+	}
+}
@@ -0,0 +1,336 @@
+package gatt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/grutz/gatt/constants"
+)
+
+// A Beacon is a beacon advertised by a device: an *IBeacon, *EddystoneUID,
+// *EddystoneURL, *EddystoneTLM, *EddystoneEID or *AltBeacon.
+type Beacon interface {
+	// AdvPacket returns the advertising data of the beacon.
+	AdvPacket() (*AdvPacket, error)
+}
+
+// companyApple is the company identifier of the iBeacons.
+const companyApple = 0x004C
+
+// An IBeacon is an Apple iBeacon.
+type IBeacon struct {
+	UUID          constants.UUID
+	Major         uint16
+	Minor         uint16
+	MeasuredPower int8 // RSSI at 1 m, in dBm
+}
+
+// AdvPacket returns the advertising data of the beacon.
+func (b *IBeacon) AdvPacket() (*AdvPacket, error) {
+	if b.UUID.Len() != 16 {
+		return nil, errors.New("iBeacon UUID not 128-bit")
+	}
+	d := make([]byte, 23)
+	d[0] = 0x02                                 // Data type: iBeacon
+	d[1] = 0x15                                 // Data length: 21 bytes
+	copy(d[2:], constants.Reverse(b.UUID.B))    // Big endian
+	binary.BigEndian.PutUint16(d[18:], b.Major) // Big endian
+	binary.BigEndian.PutUint16(d[20:], b.Minor) // Big endian
+	d[22] = uint8(b.MeasuredPower)              // Measured Tx Power
+	a := &AdvPacket{}
+	a.AppendFlags(FlagGeneralDiscoverable | FlagLEOnly)
+	a.AppendManufacturerData(companyApple, d)
+	return a, nil
+}
+
+// decodeIBeacon decodes the iBeacon of the manufacturer data md.
+func decodeIBeacon(md []byte) (*IBeacon, bool) {
+	if len(md) < 2 || binary.LittleEndian.Uint16(md) != companyApple {
+		return nil, false
+	}
+	return decodeIBeaconPayload(md[2:])
+}
+
+// decodeIBeaconPayload decodes the iBeacon of the manufacturer data b
+// following the company identifier.
+func decodeIBeaconPayload(b []byte) (*IBeacon, bool) {
+	if len(b) != 23 || b[0] != 0x02 || b[1] != 0x15 {
+		return nil, false
+	}
+	return &IBeacon{
+		UUID:          constants.UUID{B: constants.Reverse(b[2:18])},
+		Major:         binary.BigEndian.Uint16(b[18:]),
+		Minor:         binary.BigEndian.Uint16(b[20:]),
+		MeasuredPower: int8(b[22]),
+	}, true
+}
+
+// An AltBeacon is a beacon of the AltBeacon specification.
+type AltBeacon struct {
+	ManufacturerID uint16   // company identifier of the beacon manufacturer
+	ID             [20]byte // beacon identifier, usually a 16-byte UUID followed by two 2-byte values
+	ReferenceRSSI  int8     // RSSI at 1 m, in dBm
+	Reserved       uint8    // reserved for the manufacturer
+}
+
+// altBeaconCode is the code of the AltBeacons.
+const altBeaconCode = 0xBEAC
+
+// AdvPacket returns the advertising data of the beacon.
+func (b *AltBeacon) AdvPacket() (*AdvPacket, error) {
+	d := make([]byte, 24)
+	binary.BigEndian.PutUint16(d, altBeaconCode)
+	copy(d[2:], b.ID[:])
+	d[22] = uint8(b.ReferenceRSSI)
+	d[23] = b.Reserved
+	a := &AdvPacket{}
+	a.AppendFlags(FlagGeneralDiscoverable | FlagLEOnly)
+	a.AppendManufacturerData(b.ManufacturerID, d)
+	return a, nil
+}
+
+// decodeAltBeacon decodes the AltBeacon of the manufacturer data md.
+func decodeAltBeacon(md []byte) (*AltBeacon, bool) {
+	if len(md) != 26 || binary.BigEndian.Uint16(md[2:]) != altBeaconCode {
+		return nil, false
+	}
+	b := &AltBeacon{
+		ManufacturerID: binary.LittleEndian.Uint16(md),
+		ReferenceRSSI:  int8(md[24]),
+		Reserved:       md[25],
+	}
+	copy(b.ID[:], md[4:24])
+	return b, true
+}
+
+// eddystoneUUID is the service UUID of the Eddystone frames.
+var eddystoneUUID = constants.UUID16(0xFEAA)
+
+// Eddystone frame types
+const (
+	eddystoneUID = 0x00
+	eddystoneURL = 0x10
+	eddystoneTLM = 0x20
+	eddystoneEID = 0x30
+)
+
+// eddystonePacket returns the advertising data of the Eddystone frame f.
+func eddystonePacket(f []byte) *AdvPacket {
+	a := &AdvPacket{}
+	a.AppendFlags(FlagGeneralDiscoverable | FlagLEOnly)
+	a.AppendServices([]constants.UUID{eddystoneUUID}, true)
+	a.AppendServiceData(eddystoneUUID, f)
+	return a
+}
+
+// An EddystoneUID is an Eddystone-UID frame.
+type EddystoneUID struct {
+	TxPower   int8 // TX power at 0 m, in dBm
+	Namespace [10]byte
+	Instance  [6]byte
+}
+
+// AdvPacket returns the advertising data of the beacon.
+func (b *EddystoneUID) AdvPacket() (*AdvPacket, error) {
+	f := make([]byte, 20) // the last 2 bytes are reserved
+	f[0] = eddystoneUID
+	f[1] = uint8(b.TxPower)
+	copy(f[2:], b.Namespace[:])
+	copy(f[12:], b.Instance[:])
+	return eddystonePacket(f), nil
+}
+
+// An EddystoneURL is an Eddystone-URL frame.
+type EddystoneURL struct {
+	TxPower int8 // TX power at 0 m, in dBm
+	URL     string
+}
+
+// The prefixes of the Eddystone-URL schemes, by code.
+var eddystoneURLSchemes = []string{
+	"http://www.",
+	"https://www.",
+	"http://",
+	"https://",
+}
+
+// The expansions of the Eddystone-URL text, by code.
+var eddystoneURLExpansions = []string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
+
+// eddystoneURLMaxLen is the longest encoded URL of an Eddystone-URL frame.
+const eddystoneURLMaxLen = 17
+
+// AdvPacket returns the advertising data of the beacon. The URL must start
+// with http:// or https://, and be at most 17 bytes long once encoded.
+func (b *EddystoneURL) AdvPacket() (*AdvPacket, error) {
+	f := []byte{eddystoneURL, uint8(b.TxPower)}
+	url := b.URL
+	scheme := -1
+	for i, s := range eddystoneURLSchemes {
+		// The longest prefix of the ones matching comes first.
+		if strings.HasPrefix(url, s) && (scheme < 0 || len(s) > len(eddystoneURLSchemes[scheme])) {
+			scheme = i
+		}
+	}
+	if scheme < 0 {
+		return nil, errors.New("Eddystone-URL scheme not http or https")
+	}
+	f = append(f, byte(scheme))
+	url = url[len(eddystoneURLSchemes[scheme]):]
+	for len(url) > 0 {
+		code := -1
+		for i, e := range eddystoneURLExpansions {
+			// The expansions ending with a slash come first.
+			if strings.HasPrefix(url, e) {
+				code = i
+				break
+			}
+		}
+		if code >= 0 {
+			f = append(f, byte(code))
+			url = url[len(eddystoneURLExpansions[code]):]
+			continue
+		}
+		if url[0] <= 0x20 || url[0] >= 0x7F {
+			return nil, errors.New("Eddystone-URL with invalid character")
+		}
+		f = append(f, url[0])
+		url = url[1:]
+	}
+	if len(f) > 3+eddystoneURLMaxLen {
+		return nil, errors.New("Eddystone-URL too long")
+	}
+	return eddystonePacket(f), nil
+}
+
+// decodeEddystoneURL returns the URL of the encoded URL b.
+func decodeEddystoneURL(scheme byte, b []byte) (string, bool) {
+	if int(scheme) >= len(eddystoneURLSchemes) {
+		return "", false
+	}
+	url := eddystoneURLSchemes[scheme]
+	for _, c := range b {
+		switch {
+		case int(c) < len(eddystoneURLExpansions):
+			url += eddystoneURLExpansions[c]
+		case c > 0x20 && c < 0x7F:
+			url += string(c)
+		default:
+			return "", false
+		}
+	}
+	return url, true
+}
+
+// An EddystoneTLM is an unencrypted Eddystone-TLM frame, telemetry
+// interleaved with the other frames of a beacon.
+type EddystoneTLM struct {
+	BatteryVoltage uint16        // in mV, 0 if not supported
+	Temperature    float64       // in °C, NaN if not supported
+	AdvCount       uint32        // frames advertised since the beacon booted
+	Uptime         time.Duration // time since the beacon booted, by steps of 0.1 s
+}
+
+// AdvPacket returns the advertising data of the beacon.
+func (b *EddystoneTLM) AdvPacket() (*AdvPacket, error) {
+	f := make([]byte, 14)
+	f[0] = eddystoneTLM
+	f[1] = 0x00 // Version: unencrypted
+	binary.BigEndian.PutUint16(f[2:], b.BatteryVoltage)
+	temp := uint16(0x8000)
+	if !math.IsNaN(b.Temperature) {
+		temp = uint16(int16(math.Round(b.Temperature * 256))) // 8.8 fixed point
+	}
+	binary.BigEndian.PutUint16(f[4:], temp)
+	binary.BigEndian.PutUint32(f[6:], b.AdvCount)
+	binary.BigEndian.PutUint32(f[10:], uint32(b.Uptime/(100*time.Millisecond)))
+	return eddystonePacket(f), nil
+}
+
+// An EddystoneEID is an Eddystone-EID frame, whose identifier is rotated
+// so that only the owners of the beacon can resolve it.
+type EddystoneEID struct {
+	TxPower int8 // TX power at 0 m, in dBm
+	EID     [8]byte
+}
+
+// AdvPacket returns the advertising data of the beacon.
+func (b *EddystoneEID) AdvPacket() (*AdvPacket, error) {
+	f := make([]byte, 10)
+	f[0] = eddystoneEID
+	f[1] = uint8(b.TxPower)
+	copy(f[2:], b.EID[:])
+	return eddystonePacket(f), nil
+}
+
+// decodeEddystone decodes the Eddystone frame f.
+func decodeEddystone(f []byte) (Beacon, bool) {
+	if len(f) < 2 {
+		return nil, false
+	}
+	switch f[0] {
+	case eddystoneUID:
+		if len(f) < 18 {
+			return nil, false
+		}
+		b := &EddystoneUID{TxPower: int8(f[1])}
+		copy(b.Namespace[:], f[2:12])
+		copy(b.Instance[:], f[12:18])
+		return b, true
+	case eddystoneURL:
+		if len(f) < 3 {
+			return nil, false
+		}
+		url, ok := decodeEddystoneURL(f[2], f[3:])
+		if !ok {
+			return nil, false
+		}
+		return &EddystoneURL{TxPower: int8(f[1]), URL: url}, true
+	case eddystoneTLM:
+		if len(f) < 14 || f[1] != 0x00 {
+			return nil, false
+		}
+		b := &EddystoneTLM{
+			BatteryVoltage: binary.BigEndian.Uint16(f[2:]),
+			Temperature:    math.NaN(),
+			AdvCount:       binary.BigEndian.Uint32(f[6:]),
+			Uptime:         time.Duration(binary.BigEndian.Uint32(f[10:])) * 100 * time.Millisecond,
+		}
+		if temp := binary.BigEndian.Uint16(f[4:]); temp != 0x8000 {
+			b.Temperature = float64(int16(temp)) / 256
+		}
+		return b, true
+	case eddystoneEID:
+		if len(f) < 10 {
+			return nil, false
+		}
+		b := &EddystoneEID{TxPower: int8(f[1])}
+		copy(b.EID[:], f[2:10])
+		return b, true
+	}
+	return nil, false
+}
+
+// decodeBeacon returns the beacon advertised by a, if any.
+func decodeBeacon(a *Advertisement) Beacon {
+	if b, ok := decodeIBeacon(a.ManufacturerData); ok {
+		return b
+	}
+	if b, ok := decodeAltBeacon(a.ManufacturerData); ok {
+		return b
+	}
+	for _, sd := range a.ServiceData {
+		if sd.UUID.Equal(eddystoneUUID) {
+			if b, ok := decodeEddystone(sd.Data); ok {
+				return b
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package gatt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grutz/gatt/constants"
+)
+
+func TestBeaconRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		b    Beacon
+	}{
+		{
+			name: "iBeacon",
+			b:    &IBeacon{UUID: constants.MustParseUUID("E2C56DB5-DFFB-48D2-B060-D0F5A71096E0"), Major: 0x1234, Minor: 0x5678, MeasuredPower: -59},
+		},
+		{
+			name: "AltBeacon",
+			b:    &AltBeacon{ManufacturerID: 0x0118, ID: [20]byte{0x01, 0x02, 19: 0x14}, ReferenceRSSI: -65, Reserved: 0x42},
+		},
+		{
+			name: "Eddystone-UID",
+			b:    &EddystoneUID{TxPower: -20, Namespace: [10]byte{0xED, 9: 0x09}, Instance: [6]byte{0x01, 5: 0x06}},
+		},
+		{
+			name: "Eddystone-URL",
+			b:    &EddystoneURL{TxPower: -10, URL: "https://goo.gl/S6zT6P"},
+		},
+		{
+			name: "Eddystone-URL expansions",
+			b:    &EddystoneURL{TxPower: -10, URL: "http://www.example.org/a.net"},
+		},
+		{
+			name: "Eddystone-TLM",
+			b:    &EddystoneTLM{BatteryVoltage: 3000, Temperature: -4.5, AdvCount: 1000, Uptime: 90 * time.Second},
+		},
+		{
+			name: "Eddystone-EID",
+			b:    &EddystoneEID{TxPower: -4, EID: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		},
+	}
+
+	for _, tt := range cases {
+		p, err := tt.b.AdvPacket()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		a := &Advertisement{}
+		if err := a.unmarshall(p.b); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(a.Beacon, tt.b) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, a.Beacon, tt.b)
+		}
+	}
+}
+
+func TestEddystoneURLAdvPacket(t *testing.T) {
+	cases := []struct {
+		url string
+		ok  bool
+	}{
+		{url: "https://www.example.com/", ok: true},
+		{url: "ftp://example.com"},
+		{url: "https://a very long url.com"},
+		{url: "https://example.com/this/is/too/long"},
+	}
+
+	for _, tt := range cases {
+		if _, err := (&EddystoneURL{URL: tt.url}).AdvPacket(); (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v, want ok %t", tt.url, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package gatt
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/smp/crypto"
+)
+
+// A Bond holds the keys distributed by a remote device during pairing.
+// All keys are stored most significant octet first, as printed in the spec.
+type Bond struct {
+	// Address and AddressType are the identity address of the remote device.
+	Address     net.HardwareAddr
+	AddressType constants.AddressType
+
+	// IRK is the Identity Resolving Key of the remote device.
+	// A zero IRK means the device doesn't use private addresses.
+	IRK [16]byte
+
+	// LTK is the Long Term Key used to encrypt the link with the remote
+	// device, and EDiv and Rand identify it. Both are zero for keys
+	// generated by LE Secure Connections pairing.
+	LTK  [16]byte
+	EDiv uint16
+	Rand uint64
+
+	// Authenticated reports whether the LTK was generated by a pairing
+	// method with MITM protection.
+	Authenticated bool
+}
+
+// hasIRK reports whether the bond carries an Identity Resolving Key.
+func (b *Bond) hasIRK() bool {
+	return b.IRK != [16]byte{}
+}
+
+// A BondStore keeps the bonds of the device.
+type BondStore interface {
+	// Bonds returns all the bonds in the store.
+	Bonds() []Bond
+
+	// Put adds a bond to the store, replacing any bond with the same identity address.
+	Put(b Bond) error
+
+	// Delete removes the bond of the specified identity address.
+	Delete(addr net.HardwareAddr) error
+}
+
+// NewBondStore returns a BondStore which keeps the bonds in memory.
+func NewBondStore() BondStore {
+	return &bondStore{}
+}
+
+type bondStore struct {
+	mu    sync.Mutex
+	bonds []Bond
+}
+
+func (s *bondStore) Bonds() []Bond {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Bond(nil), s.bonds...)
+}
+
+func (s *bondStore) Put(b Bond) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.bonds {
+		if s.bonds[i].Address.String() == b.Address.String() {
+			s.bonds[i] = b
+			return nil
+		}
+	}
+	s.bonds = append(s.bonds, b)
+	return nil
+}
+
+func (s *bondStore) Delete(addr net.HardwareAddr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.bonds {
+		if s.bonds[i].Address.String() == addr.String() {
+			s.bonds = append(s.bonds[:i], s.bonds[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// hasLTK reports whether the bond carries a Long Term Key.
+func (b *Bond) hasLTK() bool {
+	return b.LTK != [16]byte{}
+}
+
+// findBond returns the bond of the identity address a (most significant
+// octet first), if any.
+func findBond(bonds []Bond, a [6]byte) (*Bond, bool) {
+	for i := range bonds {
+		b := &bonds[i]
+		if bytes.Equal(b.Address, a[:]) {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// resolvePrivateAddress returns the bond whose IRK generated the resolvable
+// private address a (most significant octet first), if any.
+func resolvePrivateAddress(bonds []Bond, a [6]byte) (*Bond, bool) {
+	for i := range bonds {
+		b := &bonds[i]
+		if b.hasIRK() && crypto.VerifyRPA(b.IRK, a) {
+			return b, true
+		}
+	}
+	return nil, false
+}
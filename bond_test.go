@@ -0,0 +1,40 @@
+package gatt
+
+import (
+	"net"
+	"testing"
+
+	"github.com/grutz/gatt/constants"
+)
+
+func TestResolvePrivateAddress(t *testing.T) {
+	// Sample data from Vol 3, Part H, D.7.
+	irk := [16]byte{
+		0xec, 0x02, 0x34, 0xa3, 0x57, 0xc8, 0xad, 0x05,
+		0x34, 0x10, 0x10, 0xa6, 0x0a, 0x39, 0x7d, 0x9b,
+	}
+	identity := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	bonds := []Bond{
+		{Address: net.HardwareAddr{0xc0, 0, 0, 0, 0, 1}, AddressType: constants.AddressTypeRandom},
+		{Address: identity, AddressType: constants.AddressTypePublic, IRK: irk},
+	}
+
+	cases := []struct {
+		addr [6]byte
+		want bool
+	}{
+		{[6]byte{0x70, 0x81, 0x94, 0x0d, 0xfb, 0xaa}, true},
+		{[6]byte{0x70, 0x81, 0x94, 0x0d, 0xfb, 0xab}, false}, // wrong hash
+		{[6]byte{0xf0, 0x81, 0x94, 0x0d, 0xfb, 0xaa}, false}, // not an RPA
+	}
+	for _, tt := range cases {
+		b, ok := resolvePrivateAddress(bonds, tt.addr)
+		if ok != tt.want {
+			t.Errorf("resolvePrivateAddress(% X) got %v want %v", tt.addr, ok, tt.want)
+			continue
+		}
+		if ok && b.Address.String() != identity.String() {
+			t.Errorf("resolvePrivateAddress(% X) got %s want %s", tt.addr, b.Address, identity)
+		}
+	}
+}
@@ -12,6 +12,18 @@ type Central interface {
 	ID() string   // ID returns platform specific ID of the remote central device.
 	Close() error // Close disconnects the connection.
 	MTU() int     // MTU returns the current connection mtu.
+
+	// SecurityLevel returns the current security level of the connection.
+	SecurityLevel() SecurityLevel
+
+	// ConnInfo returns the current parameters of the connection.
+	ConnInfo() ConnInfo
+
+	// SetPHY asks to transmit on the PHY tx, and to receive on the PHY rx, on
+	// the connection; 0 leaves the choice to the controller. It returns once
+	// the PHYs are negotiated with the remote device, which might keep others;
+	// ConnInfo reports the PHYs used.
+	SetPHY(tx, rx PHY) error
 }
 
 type ResponseWriter interface {
@@ -29,6 +29,16 @@ func (c *central) ID() string   { return c.uuid.String() }
 func (c *central) Close() error { return nil }
 func (c *central) MTU() int     { return c.mtu }
 
+// SecurityLevel always returns SecurityLow, as the link security is not
+// reported by CoreBluetooth.
+func (c *central) SecurityLevel() SecurityLevel { return SecurityLow }
+
+// ConnInfo always returns the zero value, as the connection parameters are
+// not reported by CoreBluetooth.
+func (c *central) ConnInfo() ConnInfo { return ConnInfo{} }
+
+func (c *central) SetPHY(tx, rx PHY) error { return notImplemented }
+
 func (c *central) sendNotification(a *attr, b []byte) (int, error) {
 	data := make([]byte, len(b))
 	copy(data, b) // have to make a copy, why?
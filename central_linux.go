@@ -2,6 +2,7 @@ package gatt
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -9,34 +10,56 @@ import (
 	"github.com/grutz/gatt/constants"
 )
 
-type security int
+type central struct {
+	attrs *attrRange
+	addr  net.HardwareAddr
 
-const (
-	securityLow = iota
-	securityMed
-	securityHigh
-)
+	att *bearer // the unenhanced ATT bearer
+
+	bearers   map[*bearer]struct{} // the enhanced ATT bearers
+	bearersmu *sync.Mutex
+
+	mu       *sync.Mutex
+	security SecurityLevel
+	info     ConnInfo
+	phy      func(tx, rx PHY) error // sets the PHYs of the connection
+	features byte                   // Client Supported Features
+	cccs     map[uint16]uint16      // Client Characteristic Configurations, by handle
+	prepq    []prepWrite            // prepared writes, waiting to be executed
 
-type central struct {
-	attrs       *attrRange
-	mtu         uint16
-	addr        net.HardwareAddr
-	security    security
-	l2conn      io.ReadWriteCloser
 	notifiers   map[uint16]*notifier
 	notifiersmu *sync.Mutex
+
+	ntfq     []notification // notifications waiting to be packed, one per notifier at most
+	flushing bool
+	ntfmu    *sync.Mutex
+}
+
+// A bearer is an ATT bearer of a central; either the unenhanced bearer on
+// the fixed ATT channel, or an enhanced bearer on an L2CAP CoC channel.
+// Each bearer serves its requests in turn, independently of the others.
+type bearer struct {
+	*central
+	mtu    uint16
+	l2conn io.ReadWriteCloser
+	eatt   bool
 }
 
 func newCentral(a *attrRange, addr net.HardwareAddr, l2conn io.ReadWriteCloser) *central {
-	return &central{
+	c := &central{
 		attrs:       a,
-		mtu:         23,
 		addr:        addr,
-		security:    securityLow,
-		l2conn:      l2conn,
+		bearers:     make(map[*bearer]struct{}),
+		bearersmu:   &sync.Mutex{},
+		mu:          &sync.Mutex{},
+		security:    SecurityLow,
+		cccs:        make(map[uint16]uint16),
 		notifiers:   make(map[uint16]*notifier),
 		notifiersmu: &sync.Mutex{},
+		ntfmu:       &sync.Mutex{},
 	}
+	c.att = &bearer{central: c, mtu: 23, l2conn: l2conn}
+	return c
 }
 
 func (c *central) ID() string {
@@ -45,25 +68,99 @@ func (c *central) ID() string {
 
 func (c *central) Close() error {
 	c.notifiersmu.Lock()
-	defer c.notifiersmu.Unlock()
 	for _, n := range c.notifiers {
 		n.stop()
 	}
-	return c.l2conn.Close()
+	c.notifiersmu.Unlock()
+	c.bearersmu.Lock()
+	for b := range c.bearers {
+		b.l2conn.Close()
+	}
+	c.bearersmu.Unlock()
+	return c.att.l2conn.Close()
 }
 
 func (c *central) MTU() int {
-	return int(c.mtu)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.att.mtu)
+}
+
+func (c *central) SecurityLevel() SecurityLevel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.security
+}
+
+func (c *central) setSecurityLevel(l SecurityLevel) {
+	c.mu.Lock()
+	c.security = l
+	c.mu.Unlock()
+}
+
+func (c *central) ConnInfo() ConnInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+func (c *central) setConnInfo(ci ConnInfo) {
+	c.mu.Lock()
+	c.info = ci
+	c.mu.Unlock()
+}
+
+func (c *central) SetPHY(tx, rx PHY) error {
+	if c.phy == nil {
+		return errors.New("not connected")
+	}
+	return c.phy(tx, rx)
+}
+
+// clientFeatures returns the Client Supported Features of the central.
+func (c *central) clientFeatures() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.features
+}
+
+// setClientFeatures records the features enabled by the central.
+// Once enabled, a feature can't be disabled.
+func (c *central) setClientFeatures(f byte) {
+	c.mu.Lock()
+	c.features |= f
+	c.mu.Unlock()
 }
 
 func (c *central) loop() {
+	c.att.loop()
+	c.Close()
+}
+
+// serve serves the requests of an enhanced ATT bearer, until it is closed.
+func (c *central) serve(l2conn io.ReadWriteCloser, mtu int) {
+	b := &bearer{central: c, mtu: uint16(mtu), l2conn: l2conn, eatt: true}
+	c.bearersmu.Lock()
+	c.bearers[b] = struct{}{}
+	c.bearersmu.Unlock()
+	b.loop()
+	c.bearersmu.Lock()
+	delete(c.bearers, b)
+	c.bearersmu.Unlock()
+	l2conn.Close()
+}
+
+func (c *bearer) loop() {
+	// L2CAP implementations shall support a minimum MTU size of 48 bytes.
+	// The default value is 672 bytes
+	size := 672
+	if int(c.mtu) > size {
+		size = int(c.mtu)
+	}
 	for {
-		// L2CAP implementations shall support a minimum MTU size of 48 bytes.
-		// The default value is 672 bytes
-		b := make([]byte, 672)
+		b := make([]byte, size)
 		n, err := c.l2conn.Read(b)
 		if n == 0 || err != nil {
-			c.Close()
 			break
 		}
 		if rsp := c.handleReq(b[:n]); rsp != nil {
@@ -75,10 +172,15 @@ func (c *central) loop() {
 // handleReq dispatches a raw request from the central shim
 // to an appropriate handler, based on its type.
 // It panics if len(b) == 0.
-func (c *central) handleReq(b []byte) []byte {
+func (c *bearer) handleReq(b []byte) []byte {
 	var resp []byte
 	switch reqType, req := b[0], b[1:]; reqType {
 	case constants.AttOpMtuReq:
+		if c.eatt {
+			// The MTU of an enhanced bearer is the MTU of its channel.
+			resp = constants.AttErrorRsp(reqType, 0x0000, constants.AttEcodeReqNotSupp)
+			break
+		}
 		resp = c.handleMTU(req)
 	case constants.AttOpFindInfoReq:
 		resp = c.handleFindInfo(req)
@@ -94,7 +196,11 @@ func (c *central) handleReq(b []byte) []byte {
 		resp = c.handleReadByGroup(req)
 	case constants.AttOpWriteReq, constants.AttOpWriteCmd:
 		resp = c.handleWrite(reqType, req)
-	case constants.AttOpReadMultiReq, constants.AttOpPrepWriteReq, constants.AttOpExecWriteReq, constants.AttOpSignedWriteCmd:
+	case constants.AttOpPrepWriteReq:
+		resp = c.handlePrepWrite(req)
+	case constants.AttOpExecWriteReq:
+		resp = c.handleExecWrite(req)
+	case constants.AttOpReadMultiReq, constants.AttOpSignedWriteCmd:
 		fallthrough
 	default:
 		resp = constants.AttErrorRsp(reqType, 0x0000, constants.AttEcodeReqNotSupp)
@@ -102,20 +208,23 @@ func (c *central) handleReq(b []byte) []byte {
 	return resp
 }
 
-func (c *central) handleMTU(b []byte) []byte {
-	c.mtu = binary.LittleEndian.Uint16(b[:2])
-	if c.mtu < 23 {
-		c.mtu = 23
+func (c *bearer) handleMTU(b []byte) []byte {
+	mtu := binary.LittleEndian.Uint16(b[:2])
+	if mtu < 23 {
+		mtu = 23
 	}
-	if c.mtu >= 256 {
-		c.mtu = 256
+	if mtu >= 256 {
+		mtu = 256
 	}
-	return []byte{constants.AttOpMtuRsp, uint8(c.mtu), uint8(c.mtu >> 8)}
+	c.mu.Lock()
+	c.mtu = mtu
+	c.mu.Unlock()
+	return []byte{constants.AttOpMtuRsp, uint8(mtu), uint8(mtu >> 8)}
 }
 
 // REQ: FindInfoReq(0x04), StartHandle, EndHandle
 // RSP: FindInfoRsp(0x05), UUIDFormat, Handle, UUID, Handle, UUID, ...
-func (c *central) handleFindInfo(b []byte) []byte {
+func (c *bearer) handleFindInfo(b []byte) []byte {
 	start, end := readHandleRange(b[:4])
 
 	w := newL2capWriter(c.mtu)
@@ -150,7 +259,7 @@ func (c *central) handleFindInfo(b []byte) []byte {
 
 // REQ: FindByTypeValueReq(0x06), StartHandle, EndHandle, Type(UUID), Value
 // RSP: FindByTypeValueRsp(0x07), AttrHandle, GroupEndHandle, AttrHandle, GroupEndHandle, ...
-func (c *central) handleFindByTypeValue(b []byte) []byte {
+func (c *bearer) handleFindByTypeValue(b []byte) []byte {
 	start, end := readHandleRange(b[:4])
 	t := constants.UUID{b[4:6]}
 	u := constants.UUID{b[6:]}
@@ -190,7 +299,7 @@ func (c *central) handleFindByTypeValue(b []byte) []byte {
 
 // REQ: ReadByType(0x08), StartHandle, EndHandle, Type(UUID)
 // RSP: ReadByType(0x09), LenOfEachDataField, DataField, DataField, ...
-func (c *central) handleReadByType(b []byte) []byte {
+func (c *bearer) handleReadByType(b []byte) []byte {
 	start, end := readHandleRange(b[:4])
 	t := constants.UUID{b[4:]}
 
@@ -201,14 +310,14 @@ func (c *central) handleReadByType(b []byte) []byte {
 		if !a.typ.Equal(t) {
 			continue
 		}
-		if (a.secure&CharRead) != 0 && c.security > securityLow {
+		if a.secure&CharRead != 0 && c.SecurityLevel() == SecurityLow {
 			return constants.AttErrorRsp(constants.AttOpReadByTypeReq, start, constants.AttEcodeAuthentication)
 		}
-		v := a.value
+		v := c.value(a)
 		if v == nil {
 			rsp := newResponseWriter(int(c.mtu - 1))
 			req := &ReadRequest{
-				Request: Request{Central: c},
+				Request: Request{Central: c.central},
 				Cap:     int(c.mtu - 1),
 				Offset:  0,
 			}
@@ -241,7 +350,7 @@ func (c *central) handleReadByType(b []byte) []byte {
 
 // REQ: ReadReq(0x0A), Handle
 // RSP: ReadRsp(0x0B), Value
-func (c *central) handleRead(b []byte) []byte {
+func (c *bearer) handleRead(b []byte) []byte {
 	h := binary.LittleEndian.Uint16(b)
 	a, ok := c.attrs.At(h)
 	if !ok {
@@ -250,13 +359,13 @@ func (c *central) handleRead(b []byte) []byte {
 	if a.props&CharRead == 0 {
 		return constants.AttErrorRsp(constants.AttOpReadReq, h, constants.AttEcodeReadNotPerm)
 	}
-	if a.secure&CharRead != 0 && c.security > securityLow {
+	if a.secure&CharRead != 0 && c.SecurityLevel() == SecurityLow {
 		return constants.AttErrorRsp(constants.AttOpReadReq, h, constants.AttEcodeAuthentication)
 	}
-	v := a.value
+	v := c.value(a)
 	if v == nil {
 		req := &ReadRequest{
-			Request: Request{Central: c},
+			Request: Request{Central: c.central},
 			Cap:     int(c.mtu - 1),
 			Offset:  0,
 		}
@@ -278,7 +387,7 @@ func (c *central) handleRead(b []byte) []byte {
 }
 
 // FIXME: check this, untested, might be broken
-func (c *central) handleReadBlob(b []byte) []byte {
+func (c *bearer) handleReadBlob(b []byte) []byte {
 	h := binary.LittleEndian.Uint16(b)
 	offset := binary.LittleEndian.Uint16(b[2:])
 	a, ok := c.attrs.At(h)
@@ -288,13 +397,13 @@ func (c *central) handleReadBlob(b []byte) []byte {
 	if a.props&CharRead == 0 {
 		return constants.AttErrorRsp(constants.AttOpReadBlobReq, h, constants.AttEcodeReadNotPerm)
 	}
-	if a.secure&CharRead != 0 && c.security > securityLow {
+	if a.secure&CharRead != 0 && c.SecurityLevel() == SecurityLow {
 		return constants.AttErrorRsp(constants.AttOpReadBlobReq, h, constants.AttEcodeAuthentication)
 	}
-	v := a.value
+	v := c.value(a)
 	if v == nil {
 		req := &ReadRequest{
-			Request: Request{Central: c},
+			Request: Request{Central: c.central},
 			Cap:     int(c.mtu - 1),
 			Offset:  int(offset),
 		}
@@ -318,7 +427,7 @@ func (c *central) handleReadBlob(b []byte) []byte {
 	return w.Bytes()
 }
 
-func (c *central) handleReadByGroup(b []byte) []byte {
+func (c *bearer) handleReadByGroup(b []byte) []byte {
 	start, end := readHandleRange(b)
 	t := constants.UUID{b[4:]}
 
@@ -357,7 +466,7 @@ func (c *central) handleReadByGroup(b []byte) []byte {
 	return w.Bytes()
 }
 
-func (c *central) handleWrite(reqType byte, b []byte) []byte {
+func (c *bearer) handleWrite(reqType byte, b []byte) []byte {
 	h := binary.LittleEndian.Uint16(b[:2])
 	value := b[2:]
 
@@ -374,7 +483,7 @@ func (c *central) handleWrite(reqType byte, b []byte) []byte {
 	if a.props&charFlag == 0 {
 		return constants.AttErrorRsp(reqType, h, constants.AttEcodeWriteNotPerm)
 	}
-	if a.secure&charFlag == 0 && c.security > securityLow {
+	if a.secure&charFlag != 0 && c.SecurityLevel() == SecurityLow {
 		return constants.AttErrorRsp(reqType, h, constants.AttEcodeAuthentication)
 	}
 
@@ -383,13 +492,7 @@ func (c *central) handleWrite(reqType byte, b []byte) []byte {
 	// (Characteristic's value is implemented with descriptor)
 	if !a.typ.Equal(constants.AttrClientCharacteristicConfigUUID) {
 		// Regular write, not CCC
-		r := Request{Central: c}
-		result := byte(0)
-		if c, ok := a.pvt.(*Characteristic); ok {
-			result = c.whandler.ServeWrite(r, value)
-		} else if d, ok := a.pvt.(*Characteristic); ok {
-			result = d.whandler.ServeWrite(r, value)
-		}
+		result := c.writeValue(a, value)
 		if noRsp {
 			return nil
 		} else {
@@ -407,9 +510,12 @@ func (c *central) handleWrite(reqType byte, b []byte) []byte {
 		return constants.AttErrorRsp(reqType, h, constants.AttEcodeInvalAttrValueLen)
 	}
 	ccc := binary.LittleEndian.Uint16(value)
+	c.mu.Lock()
+	c.cccs[a.h] = ccc
+	c.mu.Unlock()
 	// char := a.pvt.(*Descriptor).char
 	if ccc&(constants.GATTCCCNotifyFlag|constants.GATTCCCIndicateFlag) != 0 {
-		c.startNotify(&a, int(c.mtu-3))
+		c.startNotify(&a, c.MTU()-3)
 	} else {
 		c.stopNotify(&a)
 	}
@@ -419,8 +525,102 @@ func (c *central) handleWrite(reqType byte, b []byte) []byte {
 	return []byte{constants.AttOpWriteRsp}
 }
 
+// writeValue serves the write of value to the characteristic or descriptor
+// a, and returns the resulting ATT error code.
+func (c *bearer) writeValue(a attr, value []byte) byte {
+	if a.typ.Equal(constants.AttrClientSupportedFeaturesUUID) && len(value) > 0 {
+		c.setClientFeatures(value[0])
+	}
+	r := Request{Central: c.central}
+	result := byte(0)
+	if c, ok := a.pvt.(*Characteristic); ok {
+		result = c.whandler.ServeWrite(r, value)
+	} else if d, ok := a.pvt.(*Descriptor); ok && d.whandler != nil {
+		result = d.whandler.ServeWrite(r, value)
+	}
+	return result
+}
+
+// maxPrepWrites is the number of prepared writes queued for each central.
+const maxPrepWrites = 64
+
+// A prepWrite is a part of a long write, prepared by a central.
+type prepWrite struct {
+	h      uint16
+	offset int
+	value  []byte
+}
+
+// REQ: PrepWriteReq(0x16), Handle, Offset, Value
+// RSP: PrepWriteRsp(0x17), Handle, Offset, Value
+func (c *bearer) handlePrepWrite(b []byte) []byte {
+	if len(b) < 4 {
+		return constants.AttErrorRsp(constants.AttOpPrepWriteReq, 0x0000, constants.AttEcodeInvalidPDU)
+	}
+	h := binary.LittleEndian.Uint16(b)
+	offset := binary.LittleEndian.Uint16(b[2:])
+	a, ok := c.attrs.At(h)
+	if !ok {
+		return constants.AttErrorRsp(constants.AttOpPrepWriteReq, h, constants.AttEcodeInvalidHandle)
+	}
+	if a.props&CharWrite == 0 || a.typ.Equal(constants.AttrClientCharacteristicConfigUUID) {
+		return constants.AttErrorRsp(constants.AttOpPrepWriteReq, h, constants.AttEcodeWriteNotPerm)
+	}
+	if a.secure&CharWrite != 0 && c.SecurityLevel() == SecurityLow {
+		return constants.AttErrorRsp(constants.AttOpPrepWriteReq, h, constants.AttEcodeAuthentication)
+	}
+	c.mu.Lock()
+	if len(c.prepq) >= maxPrepWrites {
+		c.mu.Unlock()
+		return constants.AttErrorRsp(constants.AttOpPrepWriteReq, h, constants.AttEcodePrepQueueFull)
+	}
+	c.prepq = append(c.prepq, prepWrite{h: h, offset: int(offset), value: append([]byte(nil), b[4:]...)})
+	c.mu.Unlock()
+	return append([]byte{constants.AttOpPrepWriteRsp}, b...)
+}
+
+// REQ: ExecWriteReq(0x18), Flags
+// RSP: ExecWriteRsp(0x19)
+func (c *bearer) handleExecWrite(b []byte) []byte {
+	if len(b) < 1 || b[0] > 0x01 {
+		return constants.AttErrorRsp(constants.AttOpExecWriteReq, 0x0000, constants.AttEcodeInvalidPDU)
+	}
+	c.mu.Lock()
+	pp := c.prepq
+	c.prepq = nil
+	c.mu.Unlock()
+	if b[0] == 0x00 {
+		// Cancel all the prepared writes.
+		return []byte{constants.AttOpExecWriteRsp}
+	}
+
+	// Reassemble the values, in the order their first part was prepared.
+	var hh []uint16
+	values := make(map[uint16][]byte)
+	for _, p := range pp {
+		v, ok := values[p.h]
+		if !ok {
+			hh = append(hh, p.h)
+		}
+		if p.offset != len(v) {
+			return constants.AttErrorRsp(constants.AttOpExecWriteReq, p.h, constants.AttEcodeInvalidOffset)
+		}
+		values[p.h] = append(v, p.value...)
+	}
+	for _, h := range hh {
+		a, _ := c.attrs.At(h)
+		if result := constants.AttEcode(c.writeValue(a, values[h])); result != constants.AttEcodeSuccess {
+			return constants.AttErrorRsp(constants.AttOpExecWriteReq, h, result)
+		}
+	}
+	return []byte{constants.AttOpExecWriteRsp}
+}
+
 func (c *central) sendNotification(a *attr, data []byte) (int, error) {
-	w := newL2capWriter(c.mtu)
+	if c.clientFeatures()&constants.GATTClientMultiHandleNotify != 0 {
+		return c.queueNotification(a.pvt.(*Descriptor).char.vh, data)
+	}
+	w := newL2capWriter(uint16(c.MTU()))
 	added := 0
 	if w.WriteByteFit(constants.AttOpHandleNotify) {
 		added += 1
@@ -429,13 +629,120 @@ func (c *central) sendNotification(a *attr, data []byte) (int, error) {
 		added += 2
 	}
 	w.WriteFit(data)
-	n, err := c.l2conn.Write(w.Bytes())
+	n, err := c.att.l2conn.Write(w.Bytes())
 	if err != nil {
 		return n, err
 	}
 	return n - added, err
 }
 
+// A notification is a value to notify, and the handle it is notified for.
+// The outcome of the batch it is sent in is reported to done.
+type notification struct {
+	h    uint16
+	v    []byte
+	done chan error
+}
+
+// queueNotification queues a notification, to be sent along with the other
+// notifications queued meanwhile, and waits for the batch carrying it to be
+// written. The queue thus holds at most one notification per notifier.
+func (c *central) queueNotification(h uint16, data []byte) (int, error) {
+	if max := c.MTU() - 3; len(data) > max {
+		data = data[:max]
+	}
+	done := make(chan error, 1)
+	c.ntfmu.Lock()
+	c.ntfq = append(c.ntfq, notification{h: h, v: append([]byte(nil), data...), done: done})
+	flushing := c.flushing
+	c.flushing = true
+	c.ntfmu.Unlock()
+	if !flushing {
+		go c.flushNotifications()
+	}
+	if err := <-done; err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// flushNotifications sends the queued notifications in batches, until the
+// queue is empty. The first write error of a batch is reported to all its
+// notifications, and the rest of the batch isn't sent.
+func (c *central) flushNotifications() {
+	for {
+		c.ntfmu.Lock()
+		nn := c.ntfq
+		c.ntfq = nil
+		if len(nn) == 0 {
+			c.flushing = false
+			c.ntfmu.Unlock()
+			return
+		}
+		c.ntfmu.Unlock()
+		var err error
+		for _, b := range packNotifications(c.MTU(), nn) {
+			if _, err = c.att.l2conn.Write(b); err != nil {
+				break
+			}
+		}
+		for _, n := range nn {
+			n.done <- err
+		}
+	}
+}
+
+// packNotifications packs the notifications into as few Multiple Handle
+// Value Notification PDUs as the mtu allows. A notification left alone in a
+// PDU is sent as a Handle Value Notification.
+func packNotifications(mtu int, nn []notification) [][]byte {
+	var pdus [][]byte
+	var pdu []notification
+	size := 1
+	flush := func() {
+		switch len(pdu) {
+		case 0:
+		case 1:
+			n := pdu[0]
+			b := []byte{constants.AttOpHandleNotify, uint8(n.h), uint8(n.h >> 8)}
+			pdus = append(pdus, append(b, n.v...))
+		default:
+			b := []byte{constants.AttOpMultiHandleNotify}
+			for _, n := range pdu {
+				b = append(b, uint8(n.h), uint8(n.h>>8), uint8(len(n.v)), uint8(len(n.v)>>8))
+				b = append(b, n.v...)
+			}
+			pdus = append(pdus, b)
+		}
+		pdu, size = nil, 1
+	}
+	for _, n := range nn {
+		if size+4+len(n.v) > mtu {
+			flush()
+		}
+		pdu = append(pdu, n)
+		size += 4 + len(n.v)
+	}
+	flush()
+	return pdus
+}
+
+// value returns the static value of an attribute, if any.
+// The Client Supported Features and the Client Characteristic
+// Configurations are kept for each central.
+func (c *central) value(a attr) []byte {
+	switch {
+	case a.typ.Equal(constants.AttrClientSupportedFeaturesUUID):
+		return []byte{c.clientFeatures()}
+	case a.typ.Equal(constants.AttrClientCharacteristicConfigUUID):
+		c.mu.Lock()
+		ccc := c.cccs[a.h]
+		c.mu.Unlock()
+		return []byte{uint8(ccc), uint8(ccc >> 8)}
+	}
+	return a.value
+}
+
 func readHandleRange(b []byte) (start, end uint16) {
 	return binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:])
 }
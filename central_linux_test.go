@@ -255,3 +255,151 @@ func TestServing(t *testing.T) {
 		}
 	}
 }
+
+func TestPackNotifications(t *testing.T) {
+	a := notification{h: 0x0003, v: []byte{0x01, 0x02}}
+	b := notification{h: 0x0010, v: []byte("abcdefghijklmnop")}
+	c := notification{h: 0x0012, v: []byte("0123456789012345678")}
+	tests := []struct {
+		name string
+		mtu  int
+		nn   []notification
+		want []string
+	}{
+		{
+			name: "one notification -- handle value notification",
+			mtu:  23,
+			nn:   []notification{a},
+			want: []string{"1b03000102"},
+		},
+		{
+			name: "two fitting notifications -- multiple handle value notification",
+			mtu:  30,
+			nn:   []notification{a, b},
+			want: []string{"2303000200010210001000" + hex.EncodeToString(b.v)},
+		},
+		{
+			name: "three notifications, mtu fits two -- multiple, then single",
+			mtu:  30,
+			nn:   []notification{a, b, c},
+			want: []string{"2303000200010210001000" + hex.EncodeToString(b.v), "1b1200" + hex.EncodeToString(c.v)},
+		},
+		{
+			name: "notifications too long to share a pdu -- singles",
+			mtu:  23,
+			nn:   []notification{b, c},
+			want: []string{"1b1000" + hex.EncodeToString(b.v), "1b1200" + hex.EncodeToString(c.v)},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, b := range packNotifications(tt.mtu, tt.nn) {
+			if len(b) > tt.mtu {
+				t.Errorf("%s: pdu of %d bytes exceeds mtu %d", tt.name, len(b), tt.mtu)
+			}
+			got = append(got, hex.EncodeToString(b))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A failingConn fails its writes with err.
+type failingConn struct {
+	io.ReadCloser
+	err error
+}
+
+func (f failingConn) Write(b []byte) (int, error) { return 0, f.err }
+
+func TestQueueNotification(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte, 1)}
+	c := newCentral(nil, nil, h)
+	if n, err := c.queueNotification(0x0003, []byte{0x01, 0x02}); n != 2 || err != nil {
+		t.Errorf("got %d, %v, want 2, <nil>", n, err)
+	}
+	if got, want := hex.EncodeToString(<-h.writec), "1b03000102"; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+
+	// The error of the batch is reported to the notifier.
+	want := fmt.Errorf("link lost")
+	c = newCentral(nil, nil, failingConn{ReadCloser: h, err: want})
+	if n, err := c.queueNotification(0x0003, []byte{0x01, 0x02}); n != 0 || err != want {
+		t.Errorf("got %d, %v, want 0, %v", n, err, want)
+	}
+}
+
+func TestMultipleCentrals(t *testing.T) {
+	wrote := make(map[string]string)
+	svc := &Service{uuid: constants.MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b")}
+	svc.AddCharacteristic(constants.MustParseUUID("16fe0d80-c111-11e3-b8c8-0002a5d5c51b")).HandleWriteFunc(
+		func(r Request, data []byte) (status byte) {
+			wrote[r.Central.ID()] += string(data)
+			return StatusSuccess
+		})
+	svc.AddCharacteristic(constants.MustParseUUID("1c927b50-c116-11e3-8a33-0800200c9a66")).HandleNotifyFunc(
+		func(r Request, n Notifier) {})
+	a := generateAttributes([]*Service{svc}, uint16(1))
+
+	// 0x0001	0x2800	*gatt.Service
+	// 0x0002	0x2803	*gatt.Characteristic
+	// 0x0003	0x16fe0d80c11111e3b8c80002a5d5c51b	*gatt.Characteristic	(write)
+	// 0x0004	0x2803	*gatt.Characteristic
+	// 0x0005	0x1c927b50c11611e38a330800200c9a66	*gatt.Characteristic	(notify)
+	// 0x0006	0x2902	*gatt.Descriptor
+	hh := []*testHandler{
+		{readc: make(chan []byte), writec: make(chan []byte)},
+		{readc: make(chan []byte), writec: make(chan []byte)},
+	}
+	cc := []*central{
+		newCentral(a, net.HardwareAddr{0, 0, 0, 0, 0, 1}, hh[0]),
+		newCentral(a, net.HardwareAddr{0, 0, 0, 0, 0, 2}, hh[1]),
+	}
+	for _, c := range cc {
+		go c.loop()
+	}
+
+	rxtx := []struct {
+		name    string
+		central int
+		send    string
+		want    string
+	}{
+		{name: "central 0 sets mtu to 100", central: 0, send: "026400", want: "036400"},
+		{name: "central 1 sets mtu to 50", central: 1, send: "023200", want: "033200"},
+		{name: "central 0 starts notify", central: 0, send: "1206000100", want: "13"},
+		{name: "central 0 reads its ccc -- notify", central: 0, send: "0a0600", want: "0b0100"},
+		{name: "central 1 reads its ccc -- none", central: 1, send: "0a0600", want: "0b0000"},
+		{name: "central 0 prepares 'abc'", central: 0, send: "1603000000616263", want: "1703000000616263"},
+		{name: "central 1 prepares 'xyz'", central: 1, send: "160300000078797a", want: "170300000078797a"},
+		{name: "central 0 prepares 'def' at 3", central: 0, send: "1603000300646566", want: "1703000300646566"},
+		{name: "central 0 executes", central: 0, send: "1801", want: "19"},
+		{name: "central 1 cancels", central: 1, send: "1800", want: "19"},
+		{name: "central 1 prepares 'xyz' at 1 -- invalid offset", central: 1, send: "160300010078797a", want: "170300010078797a"},
+		{name: "central 1 executes -- invalid offset", central: 1, send: "1801", want: "0118030007"},
+	}
+	for _, tt := range rxtx {
+		s, _ := hex.DecodeString(tt.send)
+		h := hh[tt.central]
+		h.readc <- s
+		got := hex.EncodeToString(<-h.writec)
+		if got != tt.want {
+			t.Errorf("%s: sent %s got %s want %s", tt.name, tt.send, got, tt.want)
+		}
+	}
+
+	if got := cc[0].MTU(); got != 100 {
+		t.Errorf("central 0 mtu: got %d want 100", got)
+	}
+	if got := cc[1].MTU(); got != 50 {
+		t.Errorf("central 1 mtu: got %d want 50", got)
+	}
+	if got := wrote[cc[0].ID()]; got != "abcdef" {
+		t.Errorf("central 0 wrote: got %q want %q", got, "abcdef")
+	}
+	if got, ok := wrote[cc[1].ID()]; ok {
+		t.Errorf("central 1 wrote: got %q want nothing", got)
+	}
+}
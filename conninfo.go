@@ -0,0 +1,60 @@
+package gatt
+
+import (
+	"time"
+
+	"github.com/grutz/gatt/constants"
+)
+
+// ConnRole is the role of the local device in a connection.
+type ConnRole int
+
+const (
+	RoleMaster ConnRole = iota // The local device initiated the connection, as a central.
+	RoleSlave                  // The local device accepted the connection, as a peripheral.
+)
+
+var connRoleName = map[ConnRole]string{
+	RoleMaster: "Master",
+	RoleSlave:  "Slave",
+}
+
+func (r ConnRole) String() string { return connRoleName[r] }
+
+// PHY is a physical layer of the LE radio.
+type PHY int
+
+const (
+	PHY1M    PHY = 0x01 // LE 1M
+	PHY2M    PHY = 0x02 // LE 2M
+	PHYCoded PHY = 0x03 // LE Coded
+)
+
+var phyName = map[PHY]string{
+	PHY1M:    "LE 1M",
+	PHY2M:    "LE 2M",
+	PHYCoded: "LE Coded",
+}
+
+func (p PHY) String() string { return phyName[p] }
+
+// ConnInfo is the current state of a connection. It's the zero value on
+// the platforms which don't expose it.
+type ConnInfo struct {
+	Handle   uint16        // Connection handle.
+	Role     ConnRole      // Role of the local device.
+	Interval time.Duration // Connection interval.
+	Latency  int           // Number of connection events the slave may skip.
+	Timeout  time.Duration // Supervision timeout.
+
+	OwnAddressType  constants.AddressType
+	PeerAddressType constants.AddressType
+
+	TxPHY PHY
+	RxPHY PHY
+
+	MaxTxOctets int           // Maximum payload of the LE data packets sent.
+	MaxTxTime   time.Duration // Maximum time to send an LE data packet.
+	MaxRxOctets int           // Maximum payload of the LE data packets received.
+	MaxRxTime   time.Duration // Maximum time to receive an LE data packet.
+}
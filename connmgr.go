@@ -0,0 +1,434 @@
+package gatt
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/grutz/gatt/constants"
+)
+
+// PeerState is the state of a peer of a ConnectionManager.
+type PeerState int
+
+const (
+	PeerConnecting PeerState = iota // a connection to the peer is being established
+	PeerRestoring                   // connected; the services are being discovered and the subscriptions restored
+	PeerConnected                   // connected and restored
+	PeerWaiting                     // waiting to reconnect, after a failure or a disconnection
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnecting:
+		return "connecting"
+	case PeerRestoring:
+		return "restoring"
+	case PeerConnected:
+		return "connected"
+	case PeerWaiting:
+		return "waiting"
+	}
+	return fmt.Sprintf("PeerState(%d)", int(s))
+}
+
+// PeerHealth is the health of a peer of a ConnectionManager.
+type PeerHealth struct {
+	ID        string    // ID of the peer
+	State     PeerState // current state
+	Since     time.Time // time the current state was entered
+	Connects  int       // connections established since the peer was added
+	Failures  int       // consecutive connections which failed to be established, or restored
+	LastError error     // error of the last failure or disconnection, if any
+	Retry     time.Time // time of the next connection attempt, while waiting
+}
+
+// Default backoff of the ConnectionManager.
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// A ConnectionManager keeps a set of remote peripherals, its peers,
+// connected. When a peer fails to connect or disconnects, it's reconnected
+// after an exponential backoff. Once connected, its services are discovered
+// again, and the notifications and indications enabled on the previous
+// connections are enabled again.
+//
+// The connections are requested with Device.Connect, so they obey the
+// connection options of the device, e.g. LnxConnectTimeout. The handlers of
+// the device keep being called for the peers as well.
+type ConnectionManager struct {
+	// MinBackoff is the delay before the first reconnection attempt.
+	// It doubles on each consecutive failure, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Connected is called each time a peer is connected, once its services
+	// are discovered and its subscriptions restored. The notifications and
+	// indications set through p are restored on the next connections.
+	Connected func(p Peripheral)
+
+	// Disconnected is called each time a connected peer disconnects.
+	Disconnected func(p Peripheral, err error)
+
+	// HealthChanged is called each time a peer changes state.
+	HealthChanged func(h PeerHealth)
+
+	d     Device
+	mu    sync.Mutex
+	peers map[string]*peer
+}
+
+// A peer is a remote peripheral kept connected by a ConnectionManager.
+type peer struct {
+	p        Peripheral         // the peripheral to connect
+	services []constants.UUID   // services to discover on each connection
+	conn     *managedPeripheral // the current connection, if any
+	subs     []subscription     // subscriptions to restore on each connection
+	health   PeerHealth
+	timer    *time.Timer
+	gen      int // incremented on each connection, to spot stale restorations
+	removed  bool
+}
+
+// A subscription is a notification or indication enabled on a peer.
+type subscription struct {
+	svc, char constants.UUID
+	indicate  bool
+	f         func(*Characteristic, []byte, error)
+}
+
+// NewConnectionManager returns a ConnectionManager of the peripherals
+// connected by d.
+func NewConnectionManager(d Device) *ConnectionManager {
+	m := &ConnectionManager{
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		d:          d,
+		peers:      make(map[string]*peer),
+	}
+	if h := getDeviceHandler(d); h != nil {
+		h.managersmu.Lock()
+		h.managers = append(h.managers, m)
+		h.managersmu.Unlock()
+	}
+	return m
+}
+
+// Add adds p to the peers, and connects it. The services ss are discovered
+// on each connection; all of them if ss is nil.
+func (m *ConnectionManager) Add(p Peripheral, ss []constants.UUID) {
+	m.mu.Lock()
+	if _, ok := m.peers[p.ID()]; ok {
+		m.mu.Unlock()
+		return
+	}
+	pr := &peer{p: p, services: ss, health: PeerHealth{ID: p.ID()}}
+	m.peers[p.ID()] = pr
+	h := m.setState(pr, PeerConnecting)
+	m.mu.Unlock()
+	m.healthChanged(h)
+	m.d.Connect(p)
+}
+
+// Remove removes p from the peers, and disconnects it.
+func (m *ConnectionManager) Remove(p Peripheral) {
+	m.mu.Lock()
+	pr, ok := m.peers[p.ID()]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.peers, p.ID())
+	pr.removed = true
+	if pr.timer != nil {
+		pr.timer.Stop()
+	}
+	conn, state := pr.conn, pr.health.State
+	m.mu.Unlock()
+	switch {
+	case conn != nil:
+		m.d.CancelConnection(conn.Peripheral)
+	case state == PeerConnecting:
+		m.d.CancelConnection(pr.p)
+	}
+}
+
+// Close removes all the peers, and stops managing the connections of the device.
+func (m *ConnectionManager) Close() {
+	m.mu.Lock()
+	var pp []Peripheral
+	for _, pr := range m.peers {
+		pp = append(pp, pr.p)
+	}
+	m.mu.Unlock()
+	for _, p := range pp {
+		m.Remove(p)
+	}
+	if h := getDeviceHandler(m.d); h != nil {
+		h.managersmu.Lock()
+		for i, mm := range h.managers {
+			if mm == m {
+				h.managers = append(h.managers[:i], h.managers[i+1:]...)
+				break
+			}
+		}
+		h.managersmu.Unlock()
+	}
+}
+
+// Health returns the health of the peer identified by id.
+func (m *ConnectionManager) Health(id string) (PeerHealth, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pr, ok := m.peers[id]
+	if !ok {
+		return PeerHealth{}, false
+	}
+	return pr.health, true
+}
+
+// Peers returns the health of all the peers.
+func (m *ConnectionManager) Peers() []PeerHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hh := make([]PeerHealth, 0, len(m.peers))
+	for _, pr := range m.peers {
+		hh = append(hh, pr.health)
+	}
+	return hh
+}
+
+// setState changes the state of pr, and returns its new health.
+// m.mu must be held.
+func (m *ConnectionManager) setState(pr *peer, s PeerState) PeerHealth {
+	pr.health.State = s
+	pr.health.Since = time.Now()
+	if s != PeerWaiting {
+		pr.health.Retry = time.Time{}
+	}
+	return pr.health
+}
+
+func (m *ConnectionManager) healthChanged(h PeerHealth) {
+	if m.HealthChanged != nil {
+		m.HealthChanged(h)
+	}
+}
+
+// backoff returns the delay before the next connection attempt of pr.
+// m.mu must be held.
+func (m *ConnectionManager) backoff(pr *peer) time.Duration {
+	d := m.MinBackoff
+	for i := 1; i < pr.health.Failures && d < m.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > m.MaxBackoff {
+		d = m.MaxBackoff
+	}
+	// Spread the attempts of the peers which failed together.
+	if d > 1 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	return d
+}
+
+// reconnect schedules the next connection attempt of pr, and returns its
+// new health. m.mu must be held.
+func (m *ConnectionManager) reconnect(pr *peer) PeerHealth {
+	d := m.backoff(pr)
+	h := m.setState(pr, PeerWaiting)
+	pr.health.Retry = h.Since.Add(d)
+	pr.timer = time.AfterFunc(d, func() {
+		m.mu.Lock()
+		if pr.removed || pr.health.State != PeerWaiting {
+			m.mu.Unlock()
+			return
+		}
+		h := m.setState(pr, PeerConnecting)
+		m.mu.Unlock()
+		m.healthChanged(h)
+		m.d.Connect(pr.p)
+	})
+	return pr.health
+}
+
+func (m *ConnectionManager) peripheralConnected(p Peripheral, err error) {
+	m.mu.Lock()
+	pr, ok := m.peers[p.ID()]
+	if !ok || pr.health.State != PeerConnecting {
+		m.mu.Unlock()
+		return
+	}
+	var h PeerHealth
+	if err != nil {
+		pr.health.Failures++
+		pr.health.LastError = err
+		h = m.reconnect(pr)
+	} else {
+		pr.health.Connects++
+		pr.gen++
+		pr.conn = &managedPeripheral{Peripheral: p, m: m, pr: pr}
+		h = m.setState(pr, PeerRestoring)
+		go m.restore(pr, pr.conn, pr.gen)
+	}
+	m.mu.Unlock()
+	m.healthChanged(h)
+}
+
+func (m *ConnectionManager) peripheralDisconnected(p Peripheral, err error) {
+	m.mu.Lock()
+	pr, ok := m.peers[p.ID()]
+	if !ok || pr.conn == nil || pr.conn.Peripheral != p {
+		m.mu.Unlock()
+		return
+	}
+	conn, restored := pr.conn, pr.health.State == PeerConnected
+	pr.conn = nil
+	pr.gen++
+	if !restored {
+		pr.health.Failures++
+	}
+	if restored || err != nil {
+		// Otherwise, keep the error the restoration failed with.
+		pr.health.LastError = err
+	}
+	h := m.reconnect(pr)
+	m.mu.Unlock()
+	m.healthChanged(h)
+	if restored && m.Disconnected != nil {
+		m.Disconnected(conn, err)
+	}
+}
+
+// restore discovers the services of a new connection to pr, and enables
+// its subscriptions again. The connection is dropped if it fails.
+func (m *ConnectionManager) restore(pr *peer, conn *managedPeripheral, gen int) {
+	err := m.discover(pr, conn)
+	m.mu.Lock()
+	if pr.gen != gen || pr.removed {
+		m.mu.Unlock()
+		return
+	}
+	if err != nil {
+		pr.health.LastError = err
+		m.mu.Unlock()
+		// The failure is accounted when the disconnection is reported.
+		m.d.CancelConnection(conn.Peripheral)
+		return
+	}
+	pr.health.Failures = 0
+	pr.health.LastError = nil
+	h := m.setState(pr, PeerConnected)
+	m.mu.Unlock()
+	m.healthChanged(h)
+	if m.Connected != nil {
+		m.Connected(conn)
+	}
+}
+
+// discover discovers the services of pr on a new connection, and enables its
+// subscriptions again. It runs on every connection on purpose: the handles
+// of the attributes may have changed while disconnected, and the Service
+// Changed indication of an unbonded peer is lost then, so nothing discovered
+// on a previous connection is reused.
+func (m *ConnectionManager) discover(pr *peer, conn *managedPeripheral) error {
+	p := conn.Peripheral
+	ss, err := p.DiscoverServices(pr.services)
+	if err != nil {
+		return err
+	}
+	for _, s := range ss {
+		cc, err := p.DiscoverCharacteristics(nil, s)
+		if err != nil {
+			return err
+		}
+		for _, c := range cc {
+			if c.Properties()&(CharNotify|CharIndicate) == 0 {
+				continue
+			}
+			if _, err := p.DiscoverDescriptors(nil, c); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.mu.Lock()
+	subs := append([]subscription(nil), pr.subs...)
+	m.mu.Unlock()
+	for _, sub := range subs {
+		c := findCharacteristic(ss, sub.svc, sub.char)
+		if c == nil {
+			return fmt.Errorf("characteristic %s of service %s not found", sub.char, sub.svc)
+		}
+		if sub.indicate {
+			err = p.SetIndicateValue(c, sub.f)
+		} else {
+			err = p.SetNotifyValue(c, sub.f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribe records the subscription of pr to c, or its removal if f is nil.
+func (m *ConnectionManager) subscribe(pr *peer, c *Characteristic, indicate bool, f func(*Characteristic, []byte, error)) {
+	if c.Service() == nil {
+		return
+	}
+	sub := subscription{svc: c.Service().UUID(), char: c.UUID(), indicate: indicate, f: f}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, s := range pr.subs {
+		if s.svc.Equal(sub.svc) && s.char.Equal(sub.char) {
+			pr.subs = append(pr.subs[:i], pr.subs[i+1:]...)
+			break
+		}
+	}
+	if f != nil {
+		pr.subs = append(pr.subs, sub)
+	}
+}
+
+func findCharacteristic(ss []*Service, svc, char constants.UUID) *Characteristic {
+	for _, s := range ss {
+		if !s.UUID().Equal(svc) {
+			continue
+		}
+		for _, c := range s.Characteristics() {
+			if c.UUID().Equal(char) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// A managedPeripheral is a connection to a peer of a ConnectionManager. It
+// records the notifications and indications set, to restore them on the
+// next connections.
+type managedPeripheral struct {
+	Peripheral
+	m  *ConnectionManager
+	pr *peer
+}
+
+func (p *managedPeripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	if err := p.Peripheral.SetNotifyValue(c, f); err != nil {
+		return err
+	}
+	p.m.subscribe(p.pr, c, false, f)
+	return nil
+}
+
+func (p *managedPeripheral) SetIndicateValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	if err := p.Peripheral.SetIndicateValue(c, f); err != nil {
+		return err
+	}
+	p.m.subscribe(p.pr, c, true, f)
+	return nil
+}
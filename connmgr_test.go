@@ -0,0 +1,117 @@
+package gatt
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grutz/gatt/constants"
+)
+
+// testPeer is a simulated peripheral, which counts the notifications enabled.
+type testPeer struct {
+	*simPeripheral
+	mu      sync.Mutex
+	notify  int
+	discErr error
+}
+
+func (p *testPeer) ID() string { return "test peer" }
+
+func (p *testPeer) DiscoverServices(ss []constants.UUID) ([]*Service, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discErr != nil {
+		return nil, p.discErr
+	}
+	return p.simPeripheral.DiscoverServices(ss)
+}
+
+func (p *testPeer) DiscoverCharacteristics(cc []constants.UUID, s *Service) ([]*Characteristic, error) {
+	return s.Characteristics(), nil
+}
+
+func (p *testPeer) DiscoverDescriptors(dd []constants.UUID, c *Characteristic) ([]*Descriptor, error) {
+	return nil, nil
+}
+
+func (p *testPeer) SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f != nil {
+		p.notify++
+	}
+	return nil
+}
+
+func (p *testPeer) notified() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.notify
+}
+
+func TestConnectionManager(t *testing.T) {
+	svcUUID := constants.MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b")
+	svc := NewService(svcUUID)
+	char := svc.AddCharacteristic(constants.MustParseUUID("1c927b50-c116-11e3-8a33-0800200c9a66"))
+	char.HandleNotifyFunc(func(r Request, n Notifier) {})
+
+	d := NewSimDeviceClient(svc, "sim")
+	p := &testPeer{simPeripheral: &simPeripheral{d: d}}
+
+	m := NewConnectionManager(d)
+	m.MinBackoff = time.Millisecond
+	m.MaxBackoff = 4 * time.Millisecond
+	connc := make(chan Peripheral, 1)
+	m.Connected = func(p Peripheral) { connc <- p }
+
+	connected := func(what string) Peripheral {
+		select {
+		case p := <-connc:
+			return p
+		case <-time.After(time.Second):
+			t.Fatalf("%s: not connected", what)
+		}
+		return nil
+	}
+
+	m.Add(p, []constants.UUID{svcUUID})
+	c := connected("first connection")
+	if h, _ := m.Health(p.ID()); h.State != PeerConnected || h.Connects != 1 {
+		t.Errorf("first connection: got %v, %d connects; want connected, 1 connect", h.State, h.Connects)
+	}
+	if err := c.SetNotifyValue(c.Services()[0].Characteristics()[0], func(*Characteristic, []byte, error) {}); err != nil {
+		t.Fatalf("set notify value: %v", err)
+	}
+
+	// A disconnection reconnects, and restores the notification.
+	d.CancelConnection(p)
+	connected("reconnection")
+	if n := p.notified(); n != 2 {
+		t.Errorf("reconnection: notifications enabled %d times, want 2", n)
+	}
+
+	// A failed restoration is retried with backoff.
+	p.mu.Lock()
+	p.discErr = errors.New("discovery failed")
+	p.mu.Unlock()
+	d.CancelConnection(p)
+	time.Sleep(50 * time.Millisecond)
+	h, _ := m.Health(p.ID())
+	if h.Failures == 0 || h.LastError == nil {
+		t.Errorf("failed restoration: got %d failures, error %v; want failures", h.Failures, h.LastError)
+	}
+	p.mu.Lock()
+	p.discErr = nil
+	p.mu.Unlock()
+	connected("recovery")
+	if h, _ := m.Health(p.ID()); h.Failures != 0 || h.State != PeerConnected {
+		t.Errorf("recovery: got %v, %d failures; want connected, 0 failures", h.State, h.Failures)
+	}
+
+	m.Close()
+	if _, ok := m.Health(p.ID()); ok {
+		t.Errorf("closed: peer still managed")
+	}
+}
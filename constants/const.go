@@ -1,5 +1,7 @@
 package constants
 
+import "fmt"
+
 // This file includes constants from the BLE spec.
 
 var (
@@ -20,6 +22,9 @@ var (
 	AttrReconnectionAddrUUID  = UUID16(0x2A03)
 	AttrPeferredParamsUUID    = UUID16(0x2A04)
 	AttrServiceChangedUUID    = UUID16(0x2A05)
+
+	AttrClientSupportedFeaturesUUID = UUID16(0x2B29)
+	AttrServerSupportedFeaturesUUID = UUID16(0x2B3A)
 )
 
 const (
@@ -27,6 +32,18 @@ const (
 	GATTCCCIndicateFlag = 0x0002
 )
 
+// Bits of the Client Supported Features characteristic.
+const (
+	GATTClientRobustCaching     = 0x01
+	GATTClientEATT              = 0x02
+	GATTClientMultiHandleNotify = 0x04
+)
+
+// Bits of the Server Supported Features characteristic.
+const (
+	GATTServerEATT = 0x01
+)
+
 const (
 	AttOpError              = 0x01
 	AttOpMtuReq             = 0x02
@@ -55,6 +72,7 @@ const (
 	AttOpHandleNotify       = 0x1b
 	AttOpHandleInd          = 0x1d
 	AttOpHandleCnf          = 0x1e
+	AttOpMultiHandleNotify  = 0x23
 	AttOpSignedWriteCmd     = 0xd2
 )
 
@@ -152,6 +170,65 @@ func (e AttErr) Marshal() []byte {
 	return []byte{AttOpError, e.Opcode, byte(e.Attr), byte(e.Attr >> 8), byte(e.Status)}
 }
 
+// HCIStatus is a status code of the controller, as reported by the HCI events,
+// e.g. the reason a connection was lost, or failed to be established.
+type HCIStatus byte
+
+const (
+	HCIStatusSuccess                 HCIStatus = 0x00 // Success
+	HCIStatusUnknownConnID           HCIStatus = 0x02 // Unknown Connection Identifier
+	HCIStatusAuthenticationFailure   HCIStatus = 0x05 // Authentication Failure
+	HCIStatusPINOrKeyMissing         HCIStatus = 0x06 // PIN or Key Missing
+	HCIStatusConnTimeout             HCIStatus = 0x08 // Connection Timeout, i.e. the supervision timeout expired
+	HCIStatusCommandDisallowed       HCIStatus = 0x0C // Command Disallowed
+	HCIStatusRemoteUserTerminated    HCIStatus = 0x13 // Remote User Terminated Connection
+	HCIStatusRemoteLowResources      HCIStatus = 0x14 // Remote Device Terminated Connection due to Low Resources
+	HCIStatusRemotePowerOff          HCIStatus = 0x15 // Remote Device Terminated Connection due to Power Off
+	HCIStatusLocalHostTerminated     HCIStatus = 0x16 // Connection Terminated By Local Host
+	HCIStatusUnsupportedRemoteFeat   HCIStatus = 0x1A // Unsupported Remote Feature
+	HCIStatusLLResponseTimeout       HCIStatus = 0x22 // LL Response Timeout
+	HCIStatusLLProcedureCollision    HCIStatus = 0x23 // LL Procedure Collision
+	HCIStatusInstantPassed           HCIStatus = 0x28 // Instant Passed
+	HCIStatusUnacceptableConnParams  HCIStatus = 0x3B // Unacceptable Connection Parameters
+	HCIStatusAdvertisingTimeout      HCIStatus = 0x3C // Advertising Timeout
+	HCIStatusMICFailure              HCIStatus = 0x3D // Connection Terminated due to MIC Failure
+	HCIStatusConnFailedToEstablish   HCIStatus = 0x3E // Connection Failed to be Established
+	HCIStatusUnknownAdvIdentifier    HCIStatus = 0x42 // Unknown Advertising Identifier
+	HCIStatusLimitReached            HCIStatus = 0x43 // Limit Reached
+	HCIStatusOperationCanceledByHost HCIStatus = 0x44 // Operation Cancelled by Host
+)
+
+func (s HCIStatus) Error() string {
+	if n, ok := HCIStatusName[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("HCI status 0x%02X", byte(s))
+}
+
+var HCIStatusName = map[HCIStatus]string{
+	HCIStatusSuccess:                 "success",
+	HCIStatusUnknownConnID:           "unknown connection identifier",
+	HCIStatusAuthenticationFailure:   "authentication failure",
+	HCIStatusPINOrKeyMissing:         "PIN or key missing",
+	HCIStatusConnTimeout:             "connection timeout",
+	HCIStatusCommandDisallowed:       "command disallowed",
+	HCIStatusRemoteUserTerminated:    "remote user terminated connection",
+	HCIStatusRemoteLowResources:      "remote device terminated connection due to low resources",
+	HCIStatusRemotePowerOff:          "remote device terminated connection due to power off",
+	HCIStatusLocalHostTerminated:     "connection terminated by local host",
+	HCIStatusUnsupportedRemoteFeat:   "unsupported remote feature",
+	HCIStatusLLResponseTimeout:       "LL response timeout",
+	HCIStatusLLProcedureCollision:    "LL procedure collision",
+	HCIStatusInstantPassed:           "instant passed",
+	HCIStatusUnacceptableConnParams:  "unacceptable connection parameters",
+	HCIStatusAdvertisingTimeout:      "advertising timeout",
+	HCIStatusMICFailure:              "connection terminated due to MIC failure",
+	HCIStatusConnFailedToEstablish:   "connection failed to be established",
+	HCIStatusUnknownAdvIdentifier:    "unknown advertising identifier",
+	HCIStatusLimitReached:            "limit reached",
+	HCIStatusOperationCanceledByHost: "operation cancelled by host",
+}
+
 // EventType are Advertisement event types
 type EventType uint8
 
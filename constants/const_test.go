@@ -0,0 +1,52 @@
+package constants
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestHCIStatus(t *testing.T) {
+	cases := []struct {
+		s    HCIStatus
+		want string
+	}{
+		{s: HCIStatusConnTimeout, want: "connection timeout"},
+		{s: HCIStatusRemoteUserTerminated, want: "remote user terminated connection"},
+		{s: HCIStatusMICFailure, want: "connection terminated due to MIC failure"},
+		{s: HCIStatusConnFailedToEstablish, want: "connection failed to be established"},
+		{s: 0xF0, want: "HCI status 0xF0"},
+	}
+
+	for _, tt := range cases {
+		if got := tt.s.Error(); got != tt.want {
+			t.Errorf("HCIStatus(0x%02X): got %q, want %q", byte(tt.s), got, tt.want)
+		}
+	}
+
+	var s HCIStatus
+	err := fmt.Errorf("disconnected: %w", HCIStatusConnTimeout)
+	if !errors.As(err, &s) || s != HCIStatusConnTimeout {
+		t.Errorf("errors.As: got 0x%02X, want 0x%02X", byte(s), byte(HCIStatusConnTimeout))
+	}
+}
+
+func TestAppearanceName(t *testing.T) {
+	cases := []struct {
+		v             uint16
+		category, sub string
+	}{
+		{v: 0x0000, category: "Unknown", sub: "Generic Unknown"},
+		{v: 0x0040, category: "Phone", sub: "Generic Phone"},
+		{v: 0x0083, category: "Computer", sub: "Laptop"},
+		{v: 0x03C2, category: "Human Interface Device", sub: "Mouse"},
+		{v: 0x03FF, category: "Human Interface Device", sub: "Reserved (0x3F)"},
+		{v: 0xFFC0, category: "Reserved (0x3FF)", sub: "Reserved (0x00)"},
+	}
+
+	for _, tt := range cases {
+		if c, s := AppearanceName(tt.v); c != tt.category || s != tt.sub {
+			t.Errorf("AppearanceName(0x%04X): got %q, %q, want %q, %q", tt.v, c, s, tt.category, tt.sub)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package gatt
 
 import (
+	"context"
 	"errors"
+	"net"
+	"sync"
 
 	"github.com/grutz/gatt/constants"
 )
@@ -54,9 +57,41 @@ type Device interface {
 	// AdvertisingIbeacon advertises iBeacon with specified parameters.
 	AdvertiseIBeacon(u constants.UUID, major, minor uint16, pwr int8) error
 
+	// AdvertiseWithOptions advertises a in the mode, and for the time, set
+	// by o. The options only last until the next Advertise.
+	AdvertiseWithOptions(a *AdvPacket, o AdvertiseOptions) error
+
+	// AdvertiseEddystoneUID advertises an Eddystone-UID beacon.
+	AdvertiseEddystoneUID(namespace [10]byte, instance [6]byte, pwr int8) error
+
+	// AdvertiseEddystoneURL advertises an Eddystone-URL beacon.
+	AdvertiseEddystoneURL(url string, pwr int8) error
+
+	// AdvertiseAltBeacon advertises an AltBeacon of the manufacturer mfgID.
+	// The other beacons, e.g. Eddystone-TLM, are advertised with Advertise
+	// and the AdvPacket of the Beacon.
+	AdvertiseAltBeacon(mfgID uint16, id [20]byte, refRSSI int8) error
+
 	// StopAdvertising stops advertising.
 	StopAdvertising() error
 
+	// AdvertiseSet starts advertising the extended advertising set s, along
+	// with the other sets advertised, or updates it if it's already advertised.
+	// The controller must support the extended advertising. It disallows the
+	// legacy commands once the extended ones are used, so from then on the
+	// scanning and the connections use their extended equivalents, and the
+	// legacy advertising of Advertise and the like fails. AdvertiseSet fails
+	// while the legacy advertising or scanning is enabled.
+	AdvertiseSet(s *AdvSet) error
+
+	// StopAdvertiseSet stops advertising the extended advertising set s.
+	StopAdvertiseSet(s *AdvSet) error
+
+	// SyncPeriodic synchronizes to the periodic advertising of the set sid of
+	// the peripheral p, which must be discovered by the extended scanning.
+	// The scanning must go on until the sync is established, or ctx is done.
+	SyncPeriodic(ctx context.Context, p Peripheral, sid uint8) (*PeriodicSync, error)
+
 	// RemoveAllServices removes all services that are currently in the database.
 	RemoveAllServices() error
 
@@ -80,11 +115,21 @@ type Device interface {
 	Stop() error
 
 	// Connect connects to a remote peripheral.
+	// The result is reported with the PeripheralConnected handler, for each
+	// peripheral. Connections requested while another is being established
+	// are queued.
 	Connect(p Peripheral)
 
 	// CancelConnection disconnects a remote peripheral.
 	CancelConnection(p Peripheral)
 
+	// Centrals returns the remote centrals currently connected.
+	Centrals() []Central
+
+	// ListenL2CAP listens for L2CAP LE Credit Based Connections from the
+	// connected remote devices to the LE_PSM psm.
+	ListenL2CAP(psm uint16) (net.Listener, error)
+
 	// Handle registers the specified handlers.
 	Handle(h ...Handler)
 
@@ -101,7 +146,7 @@ type deviceHandler struct {
 	centralConnected func(c Central)
 
 	// disconnect is called when a remote central device disconnects to the device.
-	centralDisconnected func(c Central)
+	centralDisconnected func(c Central, err error)
 
 	// peripheralDiscovered is called when a remote peripheral device is found during scan procedure.
 	peripheralDiscovered func(p Peripheral, a *Advertisement, rssi int)
@@ -111,6 +156,53 @@ type deviceHandler struct {
 
 	// peripheralConnected is called when a remote peripheral is disconneted.
 	peripheralDisconnected func(p Peripheral, err error)
+
+	// centralSecurityChanged is called when the security level of a connection to a remote central changes.
+	centralSecurityChanged func(c Central, l SecurityLevel, err error)
+
+	// peripheralSecurityChanged is called when the security level of a connection to a remote peripheral changes.
+	peripheralSecurityChanged func(p Peripheral, l SecurityLevel, err error)
+
+	// centralConnInfoChanged is called when the parameters of a connection to a remote central change.
+	centralConnInfoChanged func(c Central, ci ConnInfo)
+
+	// peripheralConnInfoChanged is called when the parameters of a connection to a remote peripheral change.
+	peripheralConnInfoChanged func(p Peripheral, ci ConnInfo)
+
+	// advertisingStopped is called when the advertising of AdvertiseWithOptions stops on its own.
+	advertisingStopped func(d Device)
+
+	// managers are notified of the connections to remote peripherals before the application.
+	managers   []*ConnectionManager
+	managersmu sync.Mutex
+}
+
+// reportPeripheralConnected reports the result of a connection to a remote
+// peripheral to the connection managers, and then to the application.
+func (h *deviceHandler) reportPeripheralConnected(p Peripheral, err error) {
+	for _, m := range h.connectionManagers() {
+		m.peripheralConnected(p, err)
+	}
+	if h.peripheralConnected != nil {
+		go h.peripheralConnected(p, err)
+	}
+}
+
+// reportPeripheralDisconnected reports the loss of the connection to a
+// remote peripheral to the connection managers, and then to the application.
+func (h *deviceHandler) reportPeripheralDisconnected(p Peripheral, err error) {
+	for _, m := range h.connectionManagers() {
+		m.peripheralDisconnected(p, err)
+	}
+	if h.peripheralDisconnected != nil {
+		h.peripheralDisconnected(p, err)
+	}
+}
+
+func (h *deviceHandler) connectionManagers() []*ConnectionManager {
+	h.managersmu.Lock()
+	defer h.managersmu.Unlock()
+	return append([]*ConnectionManager(nil), h.managers...)
 }
 
 func getDeviceHandler(d Device) *deviceHandler {
@@ -141,7 +233,8 @@ func CentralConnected(f func(Central)) Handler {
 }
 
 // CentralDisconnected returns a Handler, which sets the specified function to be called when a device disconnects from the server.
-func CentralDisconnected(f func(Central)) Handler {
+// The error is the reason the connection was lost, e.g. a constants.HCIStatus, or nil if it was closed locally.
+func CentralDisconnected(f func(Central, error)) Handler {
 	return func(d Device) { getDeviceHandler(d).centralDisconnected = f }
 }
 
@@ -151,15 +244,42 @@ func PeripheralDiscovered(f func(Peripheral, *Advertisement, int)) Handler {
 }
 
 // PeripheralConnected returns a Handler, which sets the specified function to be called when a remote peripheral device connects.
+// The error is set if the connection failed to be established, e.g. a constants.HCIStatus reported by the controller.
 func PeripheralConnected(f func(Peripheral, error)) Handler {
 	return func(d Device) { getDeviceHandler(d).peripheralConnected = f }
 }
 
 // PeripheralDisconnected returns a Handler, which sets the specified function to be called when a remote peripheral device disconnects.
+// The error is the reason the connection was lost, e.g. a constants.HCIStatus, or nil if it was closed locally.
 func PeripheralDisconnected(f func(Peripheral, error)) Handler {
 	return func(d Device) { getDeviceHandler(d).peripheralDisconnected = f }
 }
 
+// CentralSecurityChanged returns a Handler, which sets the specified function to be called when the encryption of the connection to a remote central changes, or fails to.
+func CentralSecurityChanged(f func(Central, SecurityLevel, error)) Handler {
+	return func(d Device) { getDeviceHandler(d).centralSecurityChanged = f }
+}
+
+// PeripheralSecurityChanged returns a Handler, which sets the specified function to be called when the encryption of the connection to a remote peripheral changes, or fails to.
+func PeripheralSecurityChanged(f func(Peripheral, SecurityLevel, error)) Handler {
+	return func(d Device) { getDeviceHandler(d).peripheralSecurityChanged = f }
+}
+
+// CentralConnInfoChanged returns a Handler, which sets the specified function to be called when the parameters of the connection to a remote central change.
+func CentralConnInfoChanged(f func(Central, ConnInfo)) Handler {
+	return func(d Device) { getDeviceHandler(d).centralConnInfoChanged = f }
+}
+
+// PeripheralConnInfoChanged returns a Handler, which sets the specified function to be called when the parameters of the connection to a remote peripheral change.
+func PeripheralConnInfoChanged(f func(Peripheral, ConnInfo)) Handler {
+	return func(d Device) { getDeviceHandler(d).peripheralConnInfoChanged = f }
+}
+
+// AdvertisingStopped returns a Handler, which sets the specified function to be called when the advertising of AdvertiseWithOptions stops on its own: once its timeout elapses, or the high duty cycle directed advertising ends without a connection.
+func AdvertisingStopped(f func(Device)) Handler {
+	return func(d Device) { getDeviceHandler(d).advertisingStopped = f }
+}
+
 // An Option is a self-referential function, which sets the option specified.
 // Most Options are platform-specific, which gives more fine-grained control over the device at a cost of losing portibility.
 // See http://commandcenter.blogspot.com.au/2014/01/self-referential-functions-and-design.html for more discussion.
@@ -2,10 +2,12 @@ package gatt
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"sync"
 	"time"
 
@@ -150,6 +152,34 @@ func (d *device) StopAdvertising() error {
 	return nil
 }
 
+func (d *device) AdvertiseEddystoneUID(namespace [10]byte, instance [6]byte, pwr int8) error {
+	return notImplemented
+}
+
+func (d *device) AdvertiseEddystoneURL(url string, pwr int8) error {
+	return notImplemented
+}
+
+func (d *device) AdvertiseAltBeacon(mfgID uint16, id [20]byte, refRSSI int8) error {
+	return notImplemented
+}
+
+func (d *device) AdvertiseWithOptions(a *AdvPacket, o AdvertiseOptions) error {
+	return notImplemented
+}
+
+func (d *device) AdvertiseSet(s *AdvSet) error {
+	return notImplemented
+}
+
+func (d *device) StopAdvertiseSet(s *AdvSet) error {
+	return notImplemented
+}
+
+func (d *device) SyncPeriodic(ctx context.Context, p Peripheral, sid uint8) (*PeriodicSync, error) {
+	return nil, notImplemented
+}
+
 func (d *device) Stop() error {
 	// No Implementation
 	defer d.stateChanged(d, StatePoweredOff)
@@ -418,6 +448,20 @@ func (d *device) CancelConnection(p Peripheral) {
 	d.sendCmd(32, xpc.Dict{"kCBMsgArgDeviceUUID": p.(*peripheral).id})
 }
 
+// Centrals returns the centrals which subscribed to a characteristic; the
+// others aren't known to the device.
+func (d *device) Centrals() []Central {
+	cc := make([]Central, 0, len(d.subscribers))
+	for _, c := range d.subscribers {
+		cc = append(cc, c)
+	}
+	return cc
+}
+
+func (d *device) ListenL2CAP(psm uint16) (net.Listener, error) {
+	return nil, notImplemented
+}
+
 // process device events and asynchronous errors
 // (implements XpcEventHandler)
 func (d *device) HandleXpcEvent(event xpc.Dict, err error) {
@@ -508,9 +552,7 @@ func (d *device) HandleXpcEvent(event xpc.Dict, err error) {
 		d.plistmu.Unlock()
 		go p.loop()
 
-		if d.peripheralConnected != nil {
-			go d.peripheralConnected(p, nil)
-		}
+		d.reportPeripheralConnected(p, nil)
 
 	case peripheralDisconnected:
 		u := constants.UUID{args.MustGetUUID("kCBMsgArgDeviceUUID")}
@@ -519,9 +561,7 @@ func (d *device) HandleXpcEvent(event xpc.Dict, err error) {
 		delete(d.plist, u.String())
 		d.plistmu.Unlock()
 		if p != nil {
-			if d.peripheralDisconnected != nil {
-				d.peripheralDisconnected(p, nil) // TODO: Get Result as error?
-			}
+			d.reportPeripheralDisconnected(p, nil) // TODO: Get Result as error?
 			close(p.quitc)
 		}
 
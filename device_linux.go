@@ -1,9 +1,12 @@
 package gatt
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/grutz/gatt/constants"
 	"github.com/grutz/gatt/linux"
@@ -24,10 +27,44 @@ type device struct {
 	chkLE   bool
 	maxConn int
 
+	bonds BondStore
+
+	// advmu serializes the legacy advertising: the settings below, up to
+	// advOpts, and their flushing to the controller.
+	advmu     sync.Mutex
 	advData   *cmd.LESetAdvertisingData
 	scanResp  *cmd.LESetScanResponseData
 	advParam  *cmd.LESetAdvertisingParameters
 	scanParam *cmd.LESetScanParameters
+	extScan   bool  // use the extended scanning, if the controller supports it
+	scanPHYs  []PHY // PHYs of the extended scanning; LE 1M if empty
+
+	curAdvParam cmd.LESetAdvertisingParameters // the advertising parameters last flushed to the device
+	advOpts     bool                           // the device has the parameters of AdvertiseWithOptions instead
+
+	advTimermu sync.Mutex
+	advTimer   *time.Timer // stops the advertising of AdvertiseWithOptions
+
+	advSetsmu sync.Mutex
+	advSets   map[*AdvSet]uint8 // handles of the extended advertising sets
+
+	connParamsPolicy func(p Peripheral, c linux.ConnParams) (linux.ConnParams, bool)
+
+	connMulti   bool          // connect to several peripherals at once
+	connTimeout time.Duration // timeout of each connection attempt, if not 0
+
+	txOctets uint16 // default maximum payload of the LE data packets sent, if not 0
+	txTime   uint16 // default maximum transmission time of the LE data packets sent
+
+	txPHY, rxPHY PHY // default PHYs of the connections, if not 0
+
+	eattBearers int          // enhanced ATT bearers to open to each peripheral
+	eattl       net.Listener // enhanced ATT bearers opened by the centrals
+
+	// connected remote devices, by their platform specific data.
+	connsmu     *sync.Mutex
+	centrals    map[*linux.PlatData]*central
+	peripherals map[*linux.PlatData]*peripheral
 }
 
 func NewDevice(opts ...Option) (Device, error) {
@@ -47,6 +84,10 @@ func NewDevice(opts ...Option) (Device, error) {
 			AdvertisingFilterPolicy: 0x00,
 		},
 		scanParam: cmd.NewLESetScanParameters(),
+
+		connsmu:     &sync.Mutex{},
+		centrals:    make(map[*linux.PlatData]*central),
+		peripherals: make(map[*linux.PlatData]*peripheral),
 	}
 
 	d.Option(opts...)
@@ -61,14 +102,28 @@ func NewDevice(opts ...Option) (Device, error) {
 
 func (d *device) Init(f func(Device, State)) error {
 	d.hci.AcceptMasterHandler = func(pd *linux.PlatData) {
+		d.resolve(pd)
 		a := pd.Address
+		if pd.Resolved {
+			a = pd.IdentityAddress
+		}
 		c := newCentral(d.attrs, net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]}), pd.Conn)
+		c.phy = func(tx, rx PHY) error { return d.setPHY(pd, tx, rx) }
+		d.connsmu.Lock()
+		d.centrals[pd] = c
+		d.connsmu.Unlock()
+		if ci, ok := d.hci.ConnInfo(pd); ok {
+			c.setConnInfo(connInfo(ci))
+		}
 		if d.centralConnected != nil {
 			d.centralConnected(c)
 		}
 		c.loop()
+		d.connsmu.Lock()
+		delete(d.centrals, pd)
+		d.connsmu.Unlock()
 		if d.centralDisconnected != nil {
-			d.centralDisconnected(c)
+			d.centralDisconnected(c, d.hci.DisconnectReason(pd))
 		}
 	}
 	d.hci.AcceptSlaveHandler = func(pd *linux.PlatData) {
@@ -77,16 +132,24 @@ func (d *device) Init(f func(Device, State)) error {
 			pd:    pd,
 			l2c:   pd.Conn,
 			reqc:  make(chan message),
+			attc:  make(chan message),
 			quitc: make(chan struct{}),
 			sub:   newSubscriber(),
+
+			securitymu: &sync.Mutex{},
 		}
-		if d.peripheralConnected != nil {
-			go d.peripheralConnected(p, nil)
+		d.connsmu.Lock()
+		d.peripherals[pd] = p
+		d.connsmu.Unlock()
+		d.reportPeripheralConnected(p, nil)
+		if d.eattBearers > 0 {
+			go p.openEATT(d.eattBearers)
 		}
 		p.loop()
-		if d.peripheralDisconnected != nil {
-			d.peripheralDisconnected(p, nil)
-		}
+		d.connsmu.Lock()
+		delete(d.peripherals, pd)
+		d.connsmu.Unlock()
+		d.reportPeripheralDisconnected(p, d.hci.DisconnectReason(pd))
 	}
 	d.hci.AdvertisementHandler = func(pd *linux.PlatData) {
 		a := &Advertisement{}
@@ -95,16 +158,63 @@ func (d *device) Init(f func(Device, State)) error {
 			log.Printf("unmarshall advertisement error: %v", err)
 			return
 		}
+		d.resolve(pd)
 		a.Connectable = pd.Connectable
 		a.Scannable = pd.Scannable
 		a.EventType = pd.EventType
 		a.AddressType = pd.AddressType
-		p := &peripheral{pd: pd, d: d}
+		if pd.Resolved {
+			a.Resolved = true
+			a.IdentityAddressType = pd.IdentityAddressType
+			a.IdentityAddress = net.HardwareAddr(append([]byte(nil), pd.IdentityAddress[:]...))
+		}
+		if pd.Extended {
+			a.Extended = true
+			a.PrimaryPHY = PHY(pd.PrimaryPHY)
+			a.SecondaryPHY = PHY(pd.SecondaryPHY)
+			a.SID = pd.SID
+			a.TxPower = int(pd.TxPower)
+			a.PeriodicInterval = time.Duration(pd.PeriodicInterval) * 1250 * time.Microsecond
+			a.Truncated = pd.Truncated
+		}
+		p := &peripheral{pd: pd, d: d, securitymu: &sync.Mutex{}}
 		if d.peripheralDiscovered != nil {
 			pd.Name = a.LocalName
 			d.peripheralDiscovered(p, a, int(pd.RSSI))
 		}
 	}
+	d.hci.ConnectFailedHandler = func(pd *linux.PlatData, err error) {
+		d.reportPeripheralConnected(&peripheral{pd: pd, d: d, securitymu: &sync.Mutex{}}, err)
+	}
+	d.hci.SetConnectMultiple(d.connMulti)
+	d.hci.SetConnectTimeout(d.connTimeout)
+	d.hci.EncryptionChangeHandler = d.encryptionChanged
+	d.hci.LTKRequestHandler = d.longTermKey
+	d.hci.ConnParamsRequestHandler = d.connParamsRequested
+	d.hci.ConnInfoChangeHandler = d.connInfoChanged
+	d.hci.AdvertisingTimeoutHandler = func() {
+		d.stopAdvTimer()
+		d.advertisingTimedOut()
+	}
+	if l, err := d.hci.ListenCoC(psmEATT); err != nil {
+		log.Printf("listen EATT error: %v", err)
+	} else {
+		d.eattl = l
+		go d.serveEATT()
+	}
+	if err := d.loadResolvingList(); err != nil {
+		log.Printf("load resolving list error: %v", err)
+	}
+	if d.txOctets != 0 {
+		if err := d.hci.SetDefaultDataLength(d.txOctets, d.txTime); err != nil {
+			log.Printf("set default data length error: %v", err)
+		}
+	}
+	if d.txPHY != 0 || d.rxPHY != 0 {
+		if err := d.hci.SetDefaultPHY(phyBits(d.txPHY), phyBits(d.rxPHY)); err != nil {
+			log.Printf("set default PHY error: %v", err)
+		}
+	}
 	d.state = StatePoweredOn
 	d.stateChanged = f
 	go d.stateChanged(d, d.state)
@@ -112,6 +222,9 @@ func (d *device) Init(f func(Device, State)) error {
 }
 
 func (d *device) Stop() error {
+	if d.eattl != nil {
+		d.eattl.Close()
+	}
 	d.state = StatePoweredOff
 	defer d.stateChanged(d, d.state)
 	return d.hci.Close()
@@ -137,6 +250,14 @@ func (d *device) SetServices(s []*Service) error {
 }
 
 func (d *device) Advertise(a *AdvPacket) error {
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
+	return d.advertise(a)
+}
+
+// advertise starts advertising a. d.advmu must be held.
+func (d *device) advertise(a *AdvPacket) error {
+	d.stopAdvTimer()
 	d.advData = &cmd.LESetAdvertisingData{
 		AdvertisingDataLength: uint8(a.Len()),
 		AdvertisingData:       a.Bytes(),
@@ -150,6 +271,8 @@ func (d *device) Advertise(a *AdvPacket) error {
 }
 
 func (d *device) AdvertiseNameAndServices(name string, uu []constants.UUID) error {
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
 	a := &AdvPacket{}
 	a.AppendFlags(FlagGeneralDiscoverable | FlagLEOnly)
 	a.AppendUUIDFit(uu)
@@ -166,7 +289,7 @@ func (d *device) AdvertiseNameAndServices(name string, uu []constants.UUID) erro
 		}
 	}
 
-	return d.Advertise(a)
+	return d.advertise(a)
 }
 
 func (d *device) AdvertiseIBeaconData(b []byte) error {
@@ -178,20 +301,394 @@ func (d *device) AdvertiseIBeaconData(b []byte) error {
 }
 
 func (d *device) AdvertiseIBeacon(u constants.UUID, major, minor uint16, pwr int8) error {
-	b := make([]byte, 23)
-	b[0] = 0x02                               // Data type: iBeacon
-	b[1] = 0x15                               // Data length: 21 bytes
-	copy(b[2:], constants.Reverse(u.B))       // Big endian
-	binary.BigEndian.PutUint16(b[18:], major) // Big endian
-	binary.BigEndian.PutUint16(b[20:], minor) // Big endian
-	b[22] = uint8(pwr)                        // Measured Tx Power
-	return d.AdvertiseIBeaconData(b)
+	return d.advertiseBeacon(&IBeacon{UUID: u, Major: major, Minor: minor, MeasuredPower: pwr})
+}
+
+// advTypes are the advertising types of the advertising modes.
+var advTypes = map[AdvMode]uint8{
+	AdvModeConnectable:      cmd.AdvInd,
+	AdvModeScannable:        cmd.AdvScanInd,
+	AdvModeNonConnectable:   cmd.AdvNonconnInd,
+	AdvModeDirectedHighDuty: cmd.AdvDirectIndHighDuty,
+	AdvModeDirectedLowDuty:  cmd.AdvDirectIndLowDuty,
+}
+
+func (d *device) AdvertiseEddystoneUID(namespace [10]byte, instance [6]byte, pwr int8) error {
+	return d.advertiseBeacon(&EddystoneUID{TxPower: pwr, Namespace: namespace, Instance: instance})
+}
+
+func (d *device) AdvertiseEddystoneURL(url string, pwr int8) error {
+	return d.advertiseBeacon(&EddystoneURL{TxPower: pwr, URL: url})
+}
+
+func (d *device) AdvertiseAltBeacon(mfgID uint16, id [20]byte, refRSSI int8) error {
+	return d.advertiseBeacon(&AltBeacon{ManufacturerID: mfgID, ID: id, ReferenceRSSI: refRSSI})
+}
+
+func (d *device) advertiseBeacon(b Beacon) error {
+	a, err := b.AdvPacket()
+	if err != nil {
+		return err
+	}
+	return d.Advertise(a)
+}
+
+func (d *device) AdvertiseWithOptions(a *AdvPacket, o AdvertiseOptions) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
+	p := d.curAdvParam
+	if d.advParam != nil {
+		p = *d.advParam
+	}
+	p.AdvertisingType = advTypes[o.Mode]
+	if o.Interval != 0 {
+		ivl := o.Interval / (625 * time.Microsecond)
+		if ivl < 0x20 || ivl > 0x4000 {
+			return errors.New("advertising interval out of range")
+		}
+		p.AdvertisingIntervalMin, p.AdvertisingIntervalMax = uint16(ivl), uint16(ivl)
+	}
+	if o.Mode.directed() {
+		var addr [6]byte
+		copy(addr[:], o.Peer)
+		var b *Bond
+		if d.bonds != nil {
+			b, _ = findBond(d.bonds.Bonds(), addr)
+		}
+		if b == nil {
+			return errors.New("directed advertising to a peer not bonded")
+		}
+		p.DirectAddressType = uint8(b.AddressType) & 0x01
+		p.DirectAddress = addr
+	}
+
+	d.stopAdvTimer()
+	if err := d.hci.SendCmdWithAdvOff(&p); err != nil {
+		return err
+	}
+	// The next update flushes the parameters of the device back.
+	d.advOpts = true
+	if !o.Mode.directed() {
+		// The directed advertising carries no data.
+		pkt, err := o.packet(a)
+		if err != nil {
+			return err
+		}
+		d.advData = &cmd.LESetAdvertisingData{
+			AdvertisingDataLength: uint8(pkt.Len()),
+			AdvertisingData:       pkt.Bytes(),
+		}
+		if err := d.hci.SetAdvertisingData(d.advData); err != nil {
+			return err
+		}
+		d.advData = nil
+	}
+	if err := d.hci.SetAdvertiseEnable(true); err != nil {
+		return err
+	}
+	if t := o.timeout(); t != 0 {
+		d.startAdvTimer(t)
+	}
+	return nil
+}
+
+// startAdvTimer stops the advertising once t elapses.
+func (d *device) startAdvTimer(t time.Duration) {
+	d.advTimermu.Lock()
+	defer d.advTimermu.Unlock()
+	var tm *time.Timer
+	tm = time.AfterFunc(t, func() {
+		d.advmu.Lock()
+		d.advTimermu.Lock()
+		cur := d.advTimer == tm
+		if cur {
+			d.advTimer = nil
+		}
+		d.advTimermu.Unlock()
+		if !cur {
+			d.advmu.Unlock()
+			return
+		}
+		err := d.hci.SetAdvertiseEnable(false)
+		d.advmu.Unlock()
+		if err != nil {
+			log.Printf("stop advertising error: %v", err)
+		}
+		d.advertisingTimedOut()
+	})
+	d.advTimer = tm
+}
+
+// stopAdvTimer stops the timer of startAdvTimer, if any.
+func (d *device) stopAdvTimer() {
+	d.advTimermu.Lock()
+	defer d.advTimermu.Unlock()
+	if d.advTimer != nil {
+		d.advTimer.Stop()
+		d.advTimer = nil
+	}
+}
+
+// advertisingTimedOut reports the end of the advertising of
+// AdvertiseWithOptions to the application.
+func (d *device) advertisingTimedOut() {
+	if d.advertisingStopped != nil {
+		d.advertisingStopped(d)
+	}
+}
+
+func (d *device) advertiseData(a, rsp *AdvPacket) error {
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
+	d.advData = &cmd.LESetAdvertisingData{
+		AdvertisingDataLength: uint8(a.Len()),
+		AdvertisingData:       a.Bytes(),
+	}
+	d.scanResp = &cmd.LESetScanResponseData{}
+	if rsp != nil {
+		d.scanResp.ScanResponseDataLength = uint8(rsp.Len())
+		d.scanResp.ScanResponseData = rsp.Bytes()
+	}
+	return d.update()
+}
+
+func (d *device) startAdvertising() error {
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
+	return d.hci.SetAdvertiseEnable(true)
+}
+
+func (d *device) advertisingPaused() bool { return d.hci.AdvertisingPaused() }
+func (d *device) extendedMode() bool      { return d.hci.ExtendedMode() }
+func (d *device) advSetsAvailable() bool  { return d.hci.CanUseExtended() }
+
+// advInterval returns the interval of the legacy advertising parameters.
+func (d *device) advInterval() time.Duration {
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
+	p := d.curAdvParam
+	if d.advParam != nil {
+		p = *d.advParam
+	}
+	return time.Duration(p.AdvertisingIntervalMin) * 625 * time.Microsecond
+}
+
+// advKind reports whether the legacy advertising parameters make the
+// advertising connectable, and scannable. The directed advertising, which
+// carries no data, is reported as neither.
+func (d *device) advKind() (connectable, scannable bool) {
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
+	p := d.curAdvParam
+	if d.advParam != nil {
+		p = *d.advParam
+	}
+	switch p.AdvertisingType {
+	case cmd.AdvInd:
+		return true, true
+	case cmd.AdvScanInd:
+		return false, true
+	}
+	return false, false
+}
+
+func (d *device) Centrals() []Central {
+	d.connsmu.Lock()
+	defer d.connsmu.Unlock()
+	cc := make([]Central, 0, len(d.centrals))
+	for _, c := range d.centrals {
+		cc = append(cc, c)
+	}
+	return cc
 }
 
 func (d *device) StopAdvertising() error {
+	d.advmu.Lock()
+	defer d.advmu.Unlock()
+	d.stopAdvTimer()
 	return d.hci.SetAdvertiseEnable(false)
 }
 
+func (d *device) AdvertiseSet(s *AdvSet) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	d.advSetsmu.Lock()
+	defer d.advSetsmu.Unlock()
+	hdl, ok := d.advSets[s]
+	if !ok {
+		var err error
+		if hdl, err = d.newAdvSetHandle(); err != nil {
+			return err
+		}
+	}
+	p := advSetParams(s)
+	p.AdvertisingHandle = hdl
+	var addr *[6]byte
+	if s.Address != nil {
+		addr = &[6]byte{}
+		copy(addr[:], s.Address)
+	}
+	if err := d.hci.SetAdvertisingSet(p, addr, s.Data, s.ScanResponse); err != nil {
+		return err
+	}
+	if d.advSets == nil {
+		d.advSets = make(map[*AdvSet]uint8)
+	}
+	d.advSets[s] = hdl
+	if s.PeriodicInterval != 0 {
+		if err := d.hci.SetPeriodicAdvertising(periodicAdvParams(s, hdl), s.PeriodicData); err != nil {
+			return err
+		}
+	} else if err := d.hci.StopPeriodicAdvertising(hdl); err != nil {
+		return err
+	}
+	return d.hci.SetAdvertisingSetEnable(hdl, true)
+}
+
+// periodicAdvParams returns the periodic advertising parameters of s.
+func periodicAdvParams(s *AdvSet, hdl uint8) cmd.LESetPeriodicAdvertisingParameters {
+	ivl := s.PeriodicInterval / (1250 * time.Microsecond)
+	if ivl > 0xFFFF {
+		ivl = 0xFFFF // 81.91 s, the longest interval allowed
+	}
+	return cmd.LESetPeriodicAdvertisingParameters{
+		AdvertisingHandle:              hdl,
+		PeriodicAdvertisingIntervalMin: uint16(ivl),
+		PeriodicAdvertisingIntervalMax: uint16(ivl),
+	}
+}
+
+func (d *device) SyncPeriodic(ctx context.Context, p Peripheral, sid uint8) (*PeriodicSync, error) {
+	pp, ok := p.(*peripheral)
+	if !ok {
+		return nil, errors.New("unknown peripheral")
+	}
+	pd := pp.pd
+	c := cmd.LEPeriodicAdvertisingCreateSync{
+		AdvertisingSID:        sid,
+		AdvertiserAddressType: uint8(pd.AddressType) & 0x01, // public or random
+		AdvertiserAddress:     pd.Address,
+		SyncTimeout:           syncTimeout(pd.PeriodicInterval),
+	}
+	if pd.Resolved {
+		c.AdvertiserAddressType = uint8(pd.IdentityAddressType) & 0x01
+		c.AdvertiserAddress = pd.IdentityAddress
+	}
+	ls, err := d.hci.CreateSync(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	reports := make(chan PeriodicReport, cap(ls.Reports()))
+	s := &PeriodicSync{
+		SID:      ls.SID,
+		PHY:      PHY(ls.PHY),
+		Interval: time.Duration(ls.Interval) * 1250 * time.Microsecond,
+		Reports:  reports,
+		close:    ls.Close,
+	}
+	go func() {
+		for r := range ls.Reports() {
+			select {
+			case reports <- PeriodicReport{Data: r.Data, TxPower: int(r.TxPower), RSSI: int(r.RSSI), Truncated: r.Truncated}:
+			default:
+			}
+		}
+		s.err = ls.Err()
+		close(reports)
+	}()
+	return s, nil
+}
+
+// syncTimeout returns the sync timeout, in units of 10 ms, for a periodic
+// advertising of the interval ivl, in units of 1.25 ms: 6 intervals, or
+// 10 s if the interval isn't known yet.
+func syncTimeout(ivl uint16) uint16 {
+	if ivl == 0 {
+		return 1000
+	}
+	t := uint32(ivl) * 6 * 125 / 1000
+	switch {
+	case t < 0x000A:
+		t = 0x000A // 100 ms, the shortest timeout allowed
+	case t > 0x4000:
+		t = 0x4000 // 163.84 s, the longest timeout allowed
+	}
+	return uint16(t)
+}
+
+func (d *device) StopAdvertiseSet(s *AdvSet) error {
+	d.advSetsmu.Lock()
+	defer d.advSetsmu.Unlock()
+	hdl, ok := d.advSets[s]
+	if !ok {
+		return nil
+	}
+	delete(d.advSets, s)
+	return d.hci.RemoveAdvertisingSet(hdl)
+}
+
+// newAdvSetHandle returns the lowest advertising handle unused.
+// d.advSetsmu must be held.
+func (d *device) newAdvSetHandle() (uint8, error) {
+	used := make(map[uint8]bool, len(d.advSets))
+	for _, h := range d.advSets {
+		used[h] = true
+	}
+	for h := uint8(0x00); h <= 0xEF; h++ {
+		if !used[h] {
+			return h, nil
+		}
+	}
+	return 0, errors.New("too many advertising sets")
+}
+
+// advSetParams returns the extended advertising parameters of s.
+func advSetParams(s *AdvSet) cmd.LESetExtendedAdvertisingParameters {
+	var props uint16
+	if s.Connectable {
+		props |= cmd.AdvPropConnectable
+	}
+	if s.Scannable {
+		props |= cmd.AdvPropScannable
+	}
+	if s.Legacy {
+		props |= cmd.AdvPropLegacy
+	}
+	ivl := uint32(0x0800) // 0.625 ms * 0x0800 = 1280.0 ms
+	if s.Interval > 0 {
+		ivl = uint32(s.Interval / (625 * time.Microsecond))
+		if ivl < 0x0020 {
+			ivl = 0x0020 // 20 ms, the shortest interval allowed
+		}
+	}
+	pri, sec := s.PrimaryPHY, s.SecondaryPHY
+	if pri == 0 || s.Legacy {
+		pri = PHY1M
+	}
+	if sec == 0 || s.Legacy {
+		sec = pri
+	}
+	own := uint8(0x00) // public
+	if s.Address != nil {
+		own = 0x01 // random
+	}
+	return cmd.LESetExtendedAdvertisingParameters{
+		AdvertisingEventProperties:    props,
+		PrimaryAdvertisingIntervalMin: ivl,
+		PrimaryAdvertisingIntervalMax: ivl,
+		PrimaryAdvertisingChannelMap:  0x07, // all the advertising channels
+		OwnAddressType:                own,
+		AdvertisingTxPower:            0x7F, // no preference
+		PrimaryAdvertisingPHY:         uint8(pri),
+		SecondaryAdvertisingPHY:       uint8(sec),
+		AdvertisingSID:                s.SID,
+	}
+}
+
 func (d *device) Scan(ss []constants.UUID, dup bool) {
 	if d.scanParam != nil {
 		if d.scanParam.LEScanType == cmd.LEScanTypeActive {
@@ -200,6 +697,20 @@ func (d *device) Scan(ss []constants.UUID, dup bool) {
 			log.Printf("start passive scan")
 		}
 
+		// Once the extended advertising is used, the controller disallows
+		// the legacy scanning commands.
+		if ext := d.hci.ExtendedMode(); d.extScan || ext {
+			err := d.hci.SetExtendedScanParameters(extScanParams(d.scanParam, d.scanPHYs))
+			if err == nil {
+				d.hci.SetScanEnable(true, dup)
+				return
+			}
+			log.Printf("setup extended scan error: %v", err)
+			if ext {
+				return
+			}
+		}
+
 		resp, err := d.hci.SendRawCommand(d.scanParam)
 
 		if err != nil {
@@ -213,6 +724,52 @@ func (d *device) Scan(ss []constants.UUID, dup bool) {
 	d.hci.SetScanEnable(true, dup)
 }
 
+// extScanParams returns the extended scan parameters matching the legacy
+// ones p, on each of phys, or on the LE 1M PHY if phys is empty.
+func extScanParams(p *cmd.LESetScanParameters, phys []PHY) cmd.LESetExtendedScanParameters {
+	ep := cmd.LESetExtendedScanParameters{
+		OwnAddressType:       p.OwnAddressType,
+		ScanningFilterPolicy: p.ScanningFilterPolicy,
+	}
+	for _, phy := range phys {
+		ep.ScanningPHYs |= phyBits(phy)
+	}
+	if ep.ScanningPHYs == 0 {
+		ep.ScanningPHYs = cmd.ScanPHY1M
+	}
+	// One set of parameters per PHY, in the order of their bits.
+	for _, bit := range []uint8{cmd.ScanPHY1M, cmd.ScanPHYCoded} {
+		if ep.ScanningPHYs&bit != 0 {
+			ep.PHYs = append(ep.PHYs, cmd.ExtendedScanPHY{
+				ScanType:     p.LEScanType,
+				ScanInterval: p.LEScanInterval,
+				ScanWindow:   p.LEScanWindow,
+			})
+		}
+	}
+	return ep
+}
+
+// phyBits returns the bit of the PHY p in the PHY fields of the HCI
+// commands, or 0 for no preference.
+func phyBits(p PHY) uint8 {
+	switch p {
+	case PHY1M:
+		return cmd.PHY1MBit
+	case PHY2M:
+		return cmd.PHY2MBit
+	case PHYCoded:
+		return cmd.PHYCodedBit
+	}
+	return 0
+}
+
+// setPHY asks the controller to use the PHYs tx and rx on the connection
+// to pd.
+func (d *device) setPHY(pd *linux.PlatData, tx, rx PHY) error {
+	return d.hci.SetPHY(pd, phyBits(tx), phyBits(rx), cmd.PHYOptionNoPreference)
+}
+
 func (d *device) StopScanning() {
 	d.hci.SetScanEnable(false, true)
 }
@@ -225,26 +782,235 @@ func (d *device) CancelConnection(p Peripheral) {
 	d.hci.CancelConnection(p.(*peripheral).pd)
 }
 
+// pendingAdvParam returns the advertising parameters to be flushed to the
+// device by the next update, starting from the current ones if none are pending.
+// d.advmu must be held.
+func (d *device) pendingAdvParam() *cmd.LESetAdvertisingParameters {
+	if d.advParam == nil {
+		p := d.curAdvParam
+		d.advParam = &p
+	}
+	return d.advParam
+}
+
+// psmEATT is the LE_PSM of the enhanced ATT bearers.
+const psmEATT = 0x0027
+
+// serveEATT hands the enhanced ATT bearers opened by the centrals to them.
+func (d *device) serveEATT() {
+	for {
+		conn, err := d.eattl.Accept()
+		if err != nil {
+			return
+		}
+		ch := conn.(*linux.CoC)
+		d.connsmu.Lock()
+		c, ok := d.centrals[ch.PlatData()]
+		d.connsmu.Unlock()
+		if !ok {
+			// Only the centrals are served.
+			ch.Close()
+			continue
+		}
+		go c.serve(ch, ch.MTU())
+	}
+}
+
+func (d *device) ListenL2CAP(psm uint16) (net.Listener, error) {
+	l, err := d.hci.ListenCoC(psm)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
 func (d *device) SendHCIRawCommand(c cmd.CmdParam) ([]byte, error) {
 	return d.hci.SendRawCommand(c)
 }
 
-// Flush pending advertising settings to the device.
+// resolve resolves the private address of pd against the IRKs in the bond
+// store, unless the controller has already done so.
+func (d *device) resolve(pd *linux.PlatData) {
+	if pd.Resolved || d.bonds == nil || pd.AddressType != constants.AddressTypeRandom {
+		return
+	}
+	if b, ok := resolvePrivateAddress(d.bonds.Bonds(), pd.Address); ok {
+		pd.Resolved = true
+		pd.IdentityAddressType = b.AddressType
+		copy(pd.IdentityAddress[:], b.Address)
+	}
+}
+
+// bond returns the bond of the remote device of pd, if any.
+func (d *device) bond(pd *linux.PlatData) (*Bond, bool) {
+	if d.bonds == nil {
+		return nil, false
+	}
+	a := pd.Address
+	if pd.Resolved {
+		a = pd.IdentityAddress
+	}
+	return findBond(d.bonds.Bonds(), a)
+}
+
+// longTermKey returns the bonded LTK identified by rand and ediv for the
+// remote device of pd.
+func (d *device) longTermKey(pd *linux.PlatData, rand uint64, ediv uint16) ([16]byte, bool) {
+	b, ok := d.bond(pd)
+	if !ok || !b.hasLTK() || b.Rand != rand || b.EDiv != ediv {
+		return [16]byte{}, false
+	}
+	return b.LTK, true
+}
+
+// encryptionChanged updates the security level of the connection of pd,
+// and reports it to the application.
+func (d *device) encryptionChanged(pd *linux.PlatData, encrypted bool, err error) {
+	l := SecurityLow
+	if encrypted {
+		l = SecurityMedium
+		if b, ok := d.bond(pd); ok && b.Authenticated {
+			l = SecurityHigh
+		}
+	}
+
+	d.connsmu.Lock()
+	c, isCentral := d.centrals[pd]
+	p, isPeripheral := d.peripherals[pd]
+	d.connsmu.Unlock()
+	switch {
+	case isCentral:
+		c.setSecurityLevel(l)
+		if d.centralSecurityChanged != nil {
+			d.centralSecurityChanged(c, l, err)
+		}
+	case isPeripheral:
+		p.setSecurityLevel(l)
+		if d.peripheralSecurityChanged != nil {
+			d.peripheralSecurityChanged(p, l, err)
+		}
+	}
+}
+
+// connInfoChanged updates the parameters of the connection of pd, and
+// reports them to the application.
+func (d *device) connInfoChanged(pd *linux.PlatData, ci linux.ConnInfo) {
+	info := connInfo(ci)
+	d.connsmu.Lock()
+	c, isCentral := d.centrals[pd]
+	p, isPeripheral := d.peripherals[pd]
+	d.connsmu.Unlock()
+	switch {
+	case isCentral:
+		c.setConnInfo(info)
+		if d.centralConnInfoChanged != nil {
+			d.centralConnInfoChanged(c, info)
+		}
+	case isPeripheral:
+		if d.peripheralConnInfoChanged != nil {
+			d.peripheralConnInfoChanged(p, info)
+		}
+	}
+}
+
+// connInfo converts the state of a connection from the controller units.
+func connInfo(ci linux.ConnInfo) ConnInfo {
+	role := RoleSlave
+	if ci.Master {
+		role = RoleMaster
+	}
+	return ConnInfo{
+		Handle:          ci.Handle,
+		Role:            role,
+		Interval:        time.Duration(ci.Interval) * 1250 * time.Microsecond,
+		Latency:         int(ci.Latency),
+		Timeout:         time.Duration(ci.Timeout) * 10 * time.Millisecond,
+		OwnAddressType:  constants.AddressType(ci.OwnAddressType),
+		PeerAddressType: constants.AddressType(ci.PeerAddressType),
+		TxPHY:           PHY(ci.TxPHY),
+		RxPHY:           PHY(ci.RxPHY),
+		MaxTxOctets:     int(ci.MaxTxOctets),
+		MaxTxTime:       time.Duration(ci.MaxTxTime) * time.Microsecond,
+		MaxRxOctets:     int(ci.MaxRxOctets),
+		MaxRxTime:       time.Duration(ci.MaxRxTime) * time.Microsecond,
+	}
+}
+
+// connParamsRequested applies the connection parameters policy to an
+// update requested by a remote peripheral.
+func (d *device) connParamsRequested(pd *linux.PlatData, c linux.ConnParams) (linux.ConnParams, bool) {
+	if d.connParamsPolicy == nil {
+		return c, true
+	}
+	d.connsmu.Lock()
+	p, ok := d.peripherals[pd]
+	d.connsmu.Unlock()
+	if !ok {
+		return c, true
+	}
+	return d.connParamsPolicy(p, c)
+}
+
+// platData returns the platform specific data of the connection to c,
+// a Central or a Peripheral, or nil if it isn't connected.
+func (d *device) platData(c interface{}) *linux.PlatData {
+	d.connsmu.Lock()
+	defer d.connsmu.Unlock()
+	switch c := c.(type) {
+	case *central:
+		for pd, cc := range d.centrals {
+			if cc == c {
+				return pd
+			}
+		}
+	case *peripheral:
+		if pp, ok := d.peripherals[c.pd]; ok && pp == c {
+			return c.pd
+		}
+	}
+	return nil
+}
+
+// loadResolvingList offloads the address resolution of the bonded devices
+// to the controller, if it supports it.
+func (d *device) loadResolvingList() error {
+	if d.bonds == nil || !d.hci.SupportsAddressResolution() {
+		return nil
+	}
+	var rl []linux.ResolvingListEntry
+	for _, b := range d.bonds.Bonds() {
+		if !b.hasIRK() || len(b.Address) != 6 {
+			continue
+		}
+		e := linux.ResolvingListEntry{AddressType: b.AddressType, IRK: b.IRK}
+		copy(e.Address[:], b.Address)
+		rl = append(rl, e)
+	}
+	return d.hci.SetResolvingList(rl)
+}
+
+// Flush pending advertising settings to the device. d.advmu must be held.
 func (d *device) update() error {
+	if d.advOpts {
+		d.pendingAdvParam()
+		d.advOpts = false
+	}
 	if d.advParam != nil {
 		if err := d.hci.SendCmdWithAdvOff(d.advParam); err != nil {
 			return err
 		}
+		d.curAdvParam = *d.advParam
 		d.advParam = nil
 	}
+	// The controller takes the new data while advertising.
 	if d.scanResp != nil {
-		if err := d.hci.SendCmdWithAdvOff(d.scanResp); err != nil {
+		if err := d.hci.SetAdvertisingData(d.scanResp); err != nil {
 			return err
 		}
 		d.scanResp = nil
 	}
 	if d.advData != nil {
-		if err := d.hci.SendCmdWithAdvOff(d.advData); err != nil {
+		if err := d.hci.SetAdvertisingData(d.advData); err != nil {
 			return err
 		}
 		d.advData = nil
@@ -44,12 +44,23 @@ func onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
 	fmt.Println("  TX Power Level    =", a.TxPowerLevel)
 	fmt.Println("  Manufacturer Data =", a.ManufacturerData)
 	fmt.Println("  Service Data      =", a.ServiceData)
+	if a.Beacon != nil {
+		fmt.Printf("  Beacon            = %+v\n", a.Beacon)
+	}
+	if a.Manufacturer != nil {
+		fmt.Printf("  Manufacturer      = %+v\n", a.Manufacturer)
+	}
 	fmt.Println("")
 
 	p.Device().Connect(p)
 }
 
 func onPeriphConnected(p gatt.Peripheral, err error) {
+	if err != nil {
+		fmt.Printf("Failed to connect, err: %s\n", err)
+		close(done)
+		return
+	}
 	fmt.Println("Connected")
 	defer p.Device().CancelConnection(p)
 
@@ -139,7 +150,11 @@ func onPeriphConnected(p gatt.Peripheral, err error) {
 }
 
 func onPeriphDisconnected(p gatt.Peripheral, err error) {
-	fmt.Println("Disconnected")
+	if err != nil {
+		fmt.Printf("Disconnected, err: %s\n", err)
+	} else {
+		fmt.Println("Disconnected")
+	}
 	close(done)
 }
 
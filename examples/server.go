@@ -22,7 +22,7 @@ func main() {
 	// Register optional handlers.
 	d.Handle(
 		gatt.CentralConnected(func(c gatt.Central) { fmt.Println("Connect: ", c.ID()) }),
-		gatt.CentralDisconnected(func(c gatt.Central) { fmt.Println("Disconnect: ", c.ID()) }),
+		gatt.CentralDisconnected(func(c gatt.Central, err error) { fmt.Println("Disconnect: ", c.ID(), err) }),
 	)
 
 	// A mandatory handler for monitoring device state.
@@ -49,6 +49,19 @@ func bdaddr(d gatt.Device) {
 	log.Printf("BD Addr: %02X:%02X:%02X:%02X:%02X:%02X", b[6], b[5], b[4], b[3], b[2], b[1])
 }
 
+// nameAndServices returns the advertising packet of the name and services,
+// and the scan response packet of the name if it doesn't fit along.
+func nameAndServices(name string, uu []constants.UUID) (a, rsp *gatt.AdvPacket) {
+	a = &gatt.AdvPacket{}
+	a.AppendFlags(gatt.FlagGeneralDiscoverable | gatt.FlagLEOnly)
+	a.AppendUUIDFit(uu)
+	if a.Len()+len(name)+2 < gatt.MaxEIRPacketLength {
+		a.AppendName(name)
+		return a, nil
+	}
+	return a, (&gatt.AdvPacket{}).AppendName(name)
+}
+
 func main() {
 	flag.Parse()
 	d, err := gatt.NewDevice(
@@ -69,7 +82,7 @@ func main() {
 	// Register optional handlers.
 	d.Handle(
 		gatt.CentralConnected(func(c gatt.Central) { log.Println("Connect: ", c.ID()) }),
-		gatt.CentralDisconnected(func(c gatt.Central) { log.Println("Disconnect: ", c.ID()) }),
+		gatt.CentralDisconnected(func(c gatt.Central, err error) { log.Println("Disconnect: ", c.ID(), err) }),
 	)
 
 	// A mandatory handler for monitoring device state.
@@ -100,17 +113,30 @@ func main() {
 			}
 
 			// If id is non-zero, advertise name and services and iBeacon alternately.
-			go func() {
-				for {
-					// Advertise as a RedBear Labs iBeacon.
-					d.AdvertiseIBeacon(constants.MustParseUUID("5AFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"), 1, 2, -59)
-					time.Sleep(*id)
-
-					// Advertise name and services.
-					d.AdvertiseNameAndServices(*name, uuids)
-					time.Sleep(*ii)
-				}
-			}()
+			// Advertise as a RedBear Labs iBeacon.
+			ib, err := (&gatt.IBeacon{
+				UUID:          constants.MustParseUUID("5AFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"),
+				Major:         1,
+				Minor:         2,
+				MeasuredPower: -59,
+			}).AdvPacket()
+			if err != nil {
+				log.Printf("Failed to build the iBeacon, err: %s", err)
+				break
+			}
+			a, rsp := nameAndServices(*name, uuids)
+			s, err := gatt.NewAdvScheduler(d,
+				gatt.AdvEntry{Data: ib, Duration: *id},
+				// Advertise name and services.
+				gatt.AdvEntry{Data: a, ScanResponse: rsp, Duration: *ii},
+			)
+			if err != nil {
+				log.Printf("Failed to create the advertising scheduler, err: %s", err)
+				break
+			}
+			if err := s.Start(); err != nil {
+				log.Printf("Failed to advertise, err: %s", err)
+			}
 
 		default:
 		}
@@ -22,5 +22,14 @@ func NewGattService() *gatt.Service {
 				log.Printf("TODO: indicate client when the services are changed")
 			}()
 		})
+
+	// The server keeps the features enabled by each client.
+	c := s.AddCharacteristic(constants.AttrClientSupportedFeaturesUUID)
+	c.SetValue([]byte{0x00})
+	c.HandleWriteFunc(
+		func(r gatt.Request, data []byte) byte {
+			return gatt.StatusSuccess
+		})
+	s.AddCharacteristic(constants.AttrServerSupportedFeaturesUUID).SetValue([]byte{constants.GATTServerEATT})
 	return s
 }
@@ -0,0 +1,18 @@
+package gatt
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkError reports the error err of the test case name, unless it contains
+// want, or it is nil and want is empty.
+func checkError(t *testing.T, name string, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("%s: got error %v, want none", name, err)
+	case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+		t.Errorf("%s: got error %v, want %q", name, err, want)
+	}
+}
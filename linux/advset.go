@@ -0,0 +1,239 @@
+package linux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/linux/cmd"
+	"github.com/grutz/gatt/linux/evt"
+)
+
+// An advSet is an extended advertising set configured in the controller.
+type advSet struct {
+	ownAddrType uint8
+	connectable bool // the controller terminates the set once connected
+	enabled     bool // enabled by the application
+	running     bool // enabled in the controller
+	periodic    bool // the periodic advertising is enabled
+}
+
+// SupportsExtendedAdvertising reports whether the controller supports the
+// extended advertising sets.
+func (h *HCI) SupportsExtendedAdvertising() bool {
+	return h.leFeatures&leFeatureExtendedAdvertising != 0
+}
+
+// MaxAdvertisingDataLength returns the maximum length of the advertising
+// data, or scan response data, of an extended advertising set.
+func (h *HCI) MaxAdvertisingDataLength() int {
+	return h.maxAdvDataLen
+}
+
+// readAdvertisingSetLimits reads the limits of the extended advertising sets.
+func (h *HCI) readAdvertisingSetLimits() error {
+	rsp, err := h.c.Send(cmd.LEReadMaximumAdvertisingDataLength{})
+	if err != nil {
+		return err
+	}
+	if len(rsp) >= 3 && rsp[0] == 0x00 {
+		h.maxAdvDataLen = int(binary.LittleEndian.Uint16(rsp[1:]))
+	}
+	return nil
+}
+
+// SetAdvertisingSet configures the extended advertising set identified by
+// p.AdvertisingHandle, creating it if needed. addr is the random address of
+// the set, if it advertises with one. The data and the scan response data
+// are fragmented as needed. The set is stopped while it's configured, and
+// restarted if it's enabled.
+func (h *HCI) SetAdvertisingSet(p cmd.LESetExtendedAdvertisingParameters, addr *[6]byte, data, scanRsp []byte) error {
+	if !h.SupportsExtendedAdvertising() {
+		return ErrNotSupported
+	}
+	if len(data) > h.maxAdvDataLen || len(scanRsp) > h.maxAdvDataLen {
+		return fmt.Errorf("advertising data longer than %d bytes", h.maxAdvDataLen)
+	}
+	hdl := p.AdvertisingHandle
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	if err := h.useExtended(); err != nil {
+		return err
+	}
+	s, ok := h.advSets[hdl]
+	if !ok {
+		s = &advSet{}
+		h.advSets[hdl] = s
+	}
+	if s.running {
+		if err := h.enableAdvSet(hdl, false); err != nil {
+			return err
+		}
+		s.running = false
+	}
+	s.ownAddrType = p.OwnAddressType
+	s.connectable = p.AdvertisingEventProperties&cmd.AdvPropConnectable != 0
+	if err := h.c.SendAndCheckResp(p, []byte{0x00}); err != nil {
+		return err
+	}
+	if addr != nil {
+		if err := h.c.SendAndCheckResp(cmd.LESetAdvertisingSetRandomAddress{
+			AdvertisingHandle: hdl,
+			RandomAddress:     *addr,
+		}, []byte{0x00}); err != nil {
+			return err
+		}
+	}
+	err := sendAdvFragments(data, func(op uint8, b []byte) error {
+		return h.c.SendAndCheckResp(cmd.LESetExtendedAdvertisingData{
+			AdvertisingHandle:  hdl,
+			Operation:          op,
+			FragmentPreference: 0x01, // minimize the fragmentation
+			AdvertisingData:    b,
+		}, []byte{0x00})
+	})
+	if err != nil {
+		return err
+	}
+	if p.AdvertisingEventProperties&cmd.AdvPropScannable != 0 {
+		err = sendAdvFragments(scanRsp, func(op uint8, b []byte) error {
+			return h.c.SendAndCheckResp(cmd.LESetExtendedScanResponseData{
+				AdvertisingHandle:  hdl,
+				Operation:          op,
+				FragmentPreference: 0x01, // minimize the fragmentation
+				ScanResponseData:   b,
+			}, []byte{0x00})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return h.updateAdvSet(hdl, s)
+}
+
+// sendAdvFragments sends the advertising data b with f, in as many fragments
+// as needed. Empty data is sent as a single complete fragment.
+func sendAdvFragments(b []byte, f func(op uint8, b []byte) error) error {
+	first := true
+	for first || len(b) > 0 {
+		n := len(b)
+		if n > cmd.MaxAdvDataFragmentLength {
+			n = cmd.MaxAdvDataFragmentLength
+		}
+		var op uint8
+		switch {
+		case first && n == len(b):
+			op = cmd.AdvDataComplete
+		case first:
+			op = cmd.AdvDataFirstFragment
+		case n == len(b):
+			op = cmd.AdvDataLastFragment
+		default:
+			op = cmd.AdvDataIntermediateFragment
+		}
+		if err := f(op, b[:n]); err != nil {
+			return err
+		}
+		b, first = b[n:], false
+	}
+	return nil
+}
+
+// SetAdvertisingSetEnable enables or disables the extended advertising set
+// hdl. The connectable sets are only run while more connections can be
+// accepted; they are restarted once a connection is established or lost.
+func (h *HCI) SetAdvertisingSetEnable(hdl uint8, en bool) error {
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	s, ok := h.advSets[hdl]
+	if !ok {
+		return fmt.Errorf("unknown advertising set 0x%02X", hdl)
+	}
+	s.enabled = en
+	return h.updateAdvSet(hdl, s)
+}
+
+// RemoveAdvertisingSet stops the extended advertising set hdl, and removes
+// it from the controller.
+func (h *HCI) RemoveAdvertisingSet(hdl uint8) error {
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	s, ok := h.advSets[hdl]
+	if !ok {
+		return nil
+	}
+	if s.running {
+		if err := h.enableAdvSet(hdl, false); err != nil {
+			return err
+		}
+	}
+	delete(h.advSets, hdl)
+	return h.c.SendAndCheckResp(cmd.LERemoveAdvertisingSet{AdvertisingHandle: hdl}, []byte{0x00})
+}
+
+// updateAdvSet runs the set s if it's enabled and more connections can be
+// accepted, and stops it otherwise. h.advmu must be held.
+func (h *HCI) updateAdvSet(hdl uint8, s *advSet) error {
+	run := s.enabled && (!s.connectable || h.connected() < h.maxConn)
+	if run == s.running {
+		return nil
+	}
+	if err := h.enableAdvSet(hdl, run); err != nil {
+		return err
+	}
+	s.running = run
+	return nil
+}
+
+// resumeAdvertisingSets updates the sets after a connection is established
+// or lost. h.advmu must be held.
+func (h *HCI) resumeAdvertisingSets() {
+	for hdl, s := range h.advSets {
+		if err := h.updateAdvSet(hdl, s); err != nil {
+			log.Printf("advertising set 0x%02X: %v", hdl, err)
+		}
+	}
+}
+
+func (h *HCI) enableAdvSet(hdl uint8, en bool) error {
+	return h.c.SendAndCheckResp(cmd.LESetExtendedAdvertisingEnable{
+		Enable: btoi(en),
+		Sets:   []cmd.AdvertisingSetEnable{{AdvertisingHandle: hdl}},
+	}, []byte{0x00})
+}
+
+// handleAdvSetTerminated updates a set the controller stopped, either
+// because it got connected, or because its duration elapsed.
+func (h *HCI) handleAdvSetTerminated(b []byte) {
+	ep := &evt.LEAdvertisingSetTerminatedEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	h.advmu.Lock()
+	s, ok := h.advSets[ep.AdvertisingHandle]
+	if !ok {
+		h.advmu.Unlock()
+		return
+	}
+	s.running = false
+	if ep.Status != 0x00 {
+		log.Printf("advertising set 0x%02X terminated, %v", ep.AdvertisingHandle, constants.HCIStatus(ep.Status))
+		s.enabled = false
+		h.advmu.Unlock()
+		return
+	}
+	ownAddrType := s.ownAddrType
+	h.resumeAdvertisingSets()
+	h.advmu.Unlock()
+
+	// The connection was accepted with the address of the set.
+	h.connsmu.Lock()
+	c, found := h.conns[ep.ConnectionHandle]
+	h.connsmu.Unlock()
+	if found {
+		c.mu.Lock()
+		c.info.OwnAddressType = ownAddrType
+		c.mu.Unlock()
+	}
+}
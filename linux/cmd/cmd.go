@@ -110,7 +110,7 @@ func (c *Cmd) processCmdEvents() {
 				if uint16(p.op) == status.CommandOpcode {
 					found = true
 					c.sent = append(c.sent[:i], c.sent[i+1:]...)
-					close(p.done)
+					p.done <- []byte{status.Status}
 					break
 				}
 			}
@@ -338,6 +338,37 @@ const (
 	opLETestEnd                           = leCtl<<10 | 0x001f // LE Test End
 	opLERemoteConnectionParameterReply    = leCtl<<10 | 0x0020 // LE Remote Connection Parameter Request Reply
 	opLERemoteConnectionParameterNegReply = leCtl<<10 | 0x0021 // LE Remote Connection Parameter Request Negative Reply
+	opLESetDataLength                     = leCtl<<10 | 0x0022 // LE Set Data Length
+	opLEReadSuggestedDefaultDataLength    = leCtl<<10 | 0x0023 // LE Read Suggested Default Data Length
+	opLEWriteSuggestedDefaultDataLength   = leCtl<<10 | 0x0024 // LE Write Suggested Default Data Length
+	opLEAddDeviceToResolvingList          = leCtl<<10 | 0x0027 // LE Add Device To Resolving List
+	opLERemoveDeviceFromResolvingList     = leCtl<<10 | 0x0028 // LE Remove Device From Resolving List
+	opLEClearResolvingList                = leCtl<<10 | 0x0029 // LE Clear Resolving List
+	opLEReadResolvingListSize             = leCtl<<10 | 0x002a // LE Read Resolving List Size
+	opLESetAddressResolutionEnable        = leCtl<<10 | 0x002d // LE Set Address Resolution Enable
+	opLESetResolvablePrivateAddrTimeout   = leCtl<<10 | 0x002e // LE Set Resolvable Private Address Timeout
+	opLEReadMaximumDataLength             = leCtl<<10 | 0x002f // LE Read Maximum Data Length
+	opLEReadPHY                           = leCtl<<10 | 0x0030 // LE Read PHY
+	opLESetDefaultPHY                     = leCtl<<10 | 0x0031 // LE Set Default PHY
+	opLESetPHY                            = leCtl<<10 | 0x0032 // LE Set PHY
+	opLESetAdvertisingSetRandomAddress    = leCtl<<10 | 0x0035 // LE Set Advertising Set Random Address
+	opLESetExtendedAdvertisingParameters  = leCtl<<10 | 0x0036 // LE Set Extended Advertising Parameters
+	opLESetExtendedAdvertisingData        = leCtl<<10 | 0x0037 // LE Set Extended Advertising Data
+	opLESetExtendedScanResponseData       = leCtl<<10 | 0x0038 // LE Set Extended Scan Response Data
+	opLESetExtendedAdvertisingEnable      = leCtl<<10 | 0x0039 // LE Set Extended Advertising Enable
+	opLEReadMaximumAdvertisingDataLength  = leCtl<<10 | 0x003a // LE Read Maximum Advertising Data Length
+	opLEReadNumberOfSupportedAdvSets      = leCtl<<10 | 0x003b // LE Read Number of Supported Advertising Sets
+	opLERemoveAdvertisingSet              = leCtl<<10 | 0x003c // LE Remove Advertising Set
+	opLEClearAdvertisingSets              = leCtl<<10 | 0x003d // LE Clear Advertising Sets
+	opLESetPeriodicAdvertisingParameters  = leCtl<<10 | 0x003e // LE Set Periodic Advertising Parameters
+	opLESetPeriodicAdvertisingData        = leCtl<<10 | 0x003f // LE Set Periodic Advertising Data
+	opLESetPeriodicAdvertisingEnable      = leCtl<<10 | 0x0040 // LE Set Periodic Advertising Enable
+	opLESetExtendedScanParameters         = leCtl<<10 | 0x0041 // LE Set Extended Scan Parameters
+	opLESetExtendedScanEnable             = leCtl<<10 | 0x0042 // LE Set Extended Scan Enable
+	opLEExtendedCreateConn                = leCtl<<10 | 0x0043 // LE Extended Create Connection
+	opLEPeriodicAdvertisingCreateSync     = leCtl<<10 | 0x0044 // LE Periodic Advertising Create Sync
+	opLEPeriodicAdvertisingCreateSyncCncl = leCtl<<10 | 0x0045 // LE Periodic Advertising Create Sync Cancel
+	opLEPeriodicAdvertisingTerminateSync  = leCtl<<10 | 0x0046 // LE Periodic Advertising Terminate Sync
 )
 
 var o = util.Order
@@ -434,6 +465,21 @@ func (c WriteClassOfDevice) Marshal(b []byte) { copy(b, c.ClassOfDevice[:]) }
 
 type WriteClassOfDevRP struct{ status uint8 }
 
+// Read Buffer Size (0x0005)
+type ReadBufferSize struct{}
+
+func (c ReadBufferSize) Opcode() int      { return opReadBufferSize }
+func (c ReadBufferSize) Len() int         { return 0 }
+func (c ReadBufferSize) Marshal(b []byte) {}
+
+type ReadBufferSizeRP struct {
+	Status                           uint8
+	HCACLDataPacketLength            uint16
+	HCSynchronousDataPacketLength    uint8
+	HCTotalNumACLDataPackets         uint16
+	HCTotalNumSynchronousDataPackets uint16
+}
+
 // Write Host Buffer Size (0x0033)
 type HostBufferSize struct {
 	HostACLDataPacketLength            uint16
@@ -527,7 +573,7 @@ type LESetEventMaskRP struct{ Status uint8 }
 type LEReadBufferSize struct{}
 
 func (c LEReadBufferSize) Opcode() int      { return opLEReadBufferSize }
-func (c LEReadBufferSize) Len() int         { return 1 }
+func (c LEReadBufferSize) Len() int         { return 0 }
 func (c LEReadBufferSize) Marshal(b []byte) {}
 
 type LEReadBufferSizeRP struct {
@@ -557,6 +603,15 @@ func (c LESetRandomAddress) Marshal(b []byte) { o.PutMAC(b, c.RandomAddress) }
 
 type LESetRandomAddressRP struct{ Status uint8 }
 
+// The advertising types of the LE Set Advertising Parameters command.
+const (
+	AdvInd               = 0x00 // connectable and scannable undirected
+	AdvDirectIndHighDuty = 0x01 // connectable high duty cycle directed
+	AdvScanInd           = 0x02 // scannable undirected
+	AdvNonconnInd        = 0x03 // non-connectable undirected
+	AdvDirectIndLowDuty  = 0x04 // connectable low duty cycle directed
+)
+
 // LE Set Advertising Parameters (0x0006)
 type LESetAdvertisingParameters struct {
 	AdvertisingIntervalMin  uint16
@@ -1011,3 +1066,621 @@ type LERemoteConnectionParameterNegReplyRP struct {
 	Status           uint8
 	ConnectionHandle uint16
 }
+
+// LE Add Device To Resolving List (0x0027)
+// The IRKs are in the HCI (little-endian) byte order.
+type LEAddDeviceToResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+	PeerIRK                 [16]byte
+	LocalIRK                [16]byte
+}
+
+func (c LEAddDeviceToResolvingList) Opcode() int { return opLEAddDeviceToResolvingList }
+func (c LEAddDeviceToResolvingList) Len() int    { return 39 }
+func (c LEAddDeviceToResolvingList) Marshal(b []byte) {
+	b[0] = c.PeerIdentityAddressType
+	o.PutMAC(b[1:], c.PeerIdentityAddress)
+	copy(b[7:], c.PeerIRK[:])
+	copy(b[23:], c.LocalIRK[:])
+}
+
+type LEAddDeviceToResolvingListRP struct{ Status uint8 }
+
+// LE Remove Device From Resolving List (0x0028)
+type LERemoveDeviceFromResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+}
+
+func (c LERemoveDeviceFromResolvingList) Opcode() int { return opLERemoveDeviceFromResolvingList }
+func (c LERemoveDeviceFromResolvingList) Len() int    { return 7 }
+func (c LERemoveDeviceFromResolvingList) Marshal(b []byte) {
+	b[0] = c.PeerIdentityAddressType
+	o.PutMAC(b[1:], c.PeerIdentityAddress)
+}
+
+type LERemoveDeviceFromResolvingListRP struct{ Status uint8 }
+
+// LE Clear Resolving List (0x0029)
+type LEClearResolvingList struct{}
+
+func (c LEClearResolvingList) Opcode() int      { return opLEClearResolvingList }
+func (c LEClearResolvingList) Len() int         { return 0 }
+func (c LEClearResolvingList) Marshal(b []byte) {}
+
+type LEClearResolvingListRP struct{ Status uint8 }
+
+// LE Read Resolving List Size (0x002A)
+type LEReadResolvingListSize struct{}
+
+func (c LEReadResolvingListSize) Opcode() int      { return opLEReadResolvingListSize }
+func (c LEReadResolvingListSize) Len() int         { return 0 }
+func (c LEReadResolvingListSize) Marshal(b []byte) {}
+
+type LEReadResolvingListSizeRP struct {
+	Status            uint8
+	ResolvingListSize uint8
+}
+
+// LE Set Address Resolution Enable (0x002D)
+type LESetAddressResolutionEnable struct{ AddressResolutionEnable uint8 }
+
+func (c LESetAddressResolutionEnable) Opcode() int      { return opLESetAddressResolutionEnable }
+func (c LESetAddressResolutionEnable) Len() int         { return 1 }
+func (c LESetAddressResolutionEnable) Marshal(b []byte) { b[0] = c.AddressResolutionEnable }
+
+type LESetAddressResolutionEnableRP struct{ Status uint8 }
+
+// LE Set Resolvable Private Address Timeout (0x002E)
+type LESetResolvablePrivateAddressTimeout struct{ RPATimeout uint16 }
+
+func (c LESetResolvablePrivateAddressTimeout) Opcode() int {
+	return opLESetResolvablePrivateAddrTimeout
+}
+func (c LESetResolvablePrivateAddressTimeout) Len() int         { return 2 }
+func (c LESetResolvablePrivateAddressTimeout) Marshal(b []byte) { o.PutUint16(b, c.RPATimeout) }
+
+type LESetResolvablePrivateAddressTimeoutRP struct{ Status uint8 }
+
+// LE Set Data Length (0x0022)
+type LESetDataLength struct {
+	ConnectionHandle uint16
+	TxOctets         uint16
+	TxTime           uint16
+}
+
+func (c LESetDataLength) Opcode() int { return opLESetDataLength }
+func (c LESetDataLength) Len() int    { return 6 }
+func (c LESetDataLength) Marshal(b []byte) {
+	o.PutUint16(b[0:], c.ConnectionHandle)
+	o.PutUint16(b[2:], c.TxOctets)
+	o.PutUint16(b[4:], c.TxTime)
+}
+
+type LESetDataLengthRP struct {
+	Status           uint8
+	ConnectionHandle uint16
+}
+
+// LE Read Suggested Default Data Length (0x0023)
+type LEReadSuggestedDefaultDataLength struct{}
+
+func (c LEReadSuggestedDefaultDataLength) Opcode() int      { return opLEReadSuggestedDefaultDataLength }
+func (c LEReadSuggestedDefaultDataLength) Len() int         { return 0 }
+func (c LEReadSuggestedDefaultDataLength) Marshal(b []byte) {}
+
+type LEReadSuggestedDefaultDataLengthRP struct {
+	Status               uint8
+	SuggestedMaxTxOctets uint16
+	SuggestedMaxTxTime   uint16
+}
+
+// LE Write Suggested Default Data Length (0x0024)
+type LEWriteSuggestedDefaultDataLength struct {
+	SuggestedMaxTxOctets uint16
+	SuggestedMaxTxTime   uint16
+}
+
+func (c LEWriteSuggestedDefaultDataLength) Opcode() int { return opLEWriteSuggestedDefaultDataLength }
+func (c LEWriteSuggestedDefaultDataLength) Len() int    { return 4 }
+func (c LEWriteSuggestedDefaultDataLength) Marshal(b []byte) {
+	o.PutUint16(b[0:], c.SuggestedMaxTxOctets)
+	o.PutUint16(b[2:], c.SuggestedMaxTxTime)
+}
+
+type LEWriteSuggestedDefaultDataLengthRP struct{ Status uint8 }
+
+// LE Read Maximum Data Length (0x002F)
+type LEReadMaximumDataLength struct{}
+
+func (c LEReadMaximumDataLength) Opcode() int      { return opLEReadMaximumDataLength }
+func (c LEReadMaximumDataLength) Len() int         { return 0 }
+func (c LEReadMaximumDataLength) Marshal(b []byte) {}
+
+type LEReadMaximumDataLengthRP struct {
+	Status               uint8
+	SupportedMaxTxOctets uint16
+	SupportedMaxTxTime   uint16
+	SupportedMaxRxOctets uint16
+	SupportedMaxRxTime   uint16
+}
+
+// The PHY bits of the LE Set Default PHY and LE Set PHY commands.
+const (
+	PHY1MBit    = 0x01
+	PHY2MBit    = 0x02
+	PHYCodedBit = 0x04
+)
+
+// The AllPHYs bits of the LE Set Default PHY and LE Set PHY commands.
+const (
+	AllPHYsNoTxPreference = 0x01
+	AllPHYsNoRxPreference = 0x02
+)
+
+// The coding preferences of the LE Set PHY command, on the LE Coded PHY.
+const (
+	PHYOptionNoPreference = 0x0000
+	PHYOptionS2           = 0x0001 // 500 kb/s
+	PHYOptionS8           = 0x0002 // 125 kb/s
+)
+
+// LE Read PHY (0x0030)
+type LEReadPHY struct {
+	ConnectionHandle uint16
+}
+
+func (c LEReadPHY) Opcode() int      { return opLEReadPHY }
+func (c LEReadPHY) Len() int         { return 2 }
+func (c LEReadPHY) Marshal(b []byte) { o.PutUint16(b, c.ConnectionHandle) }
+
+type LEReadPHYRP struct {
+	Status           uint8
+	ConnectionHandle uint16
+	TxPHY            uint8
+	RxPHY            uint8
+}
+
+// LE Set Default PHY (0x0031)
+type LESetDefaultPHY struct {
+	AllPHYs uint8
+	TxPHYs  uint8
+	RxPHYs  uint8
+}
+
+func (c LESetDefaultPHY) Opcode() int { return opLESetDefaultPHY }
+func (c LESetDefaultPHY) Len() int    { return 3 }
+func (c LESetDefaultPHY) Marshal(b []byte) {
+	b[0], b[1], b[2] = c.AllPHYs, c.TxPHYs, c.RxPHYs
+}
+
+type LESetDefaultPHYRP struct {
+	Status uint8
+}
+
+// LE Set PHY (0x0032)
+type LESetPHY struct {
+	ConnectionHandle uint16
+	AllPHYs          uint8
+	TxPHYs           uint8
+	RxPHYs           uint8
+	PHYOptions       uint16
+}
+
+func (c LESetPHY) Opcode() int { return opLESetPHY }
+func (c LESetPHY) Len() int    { return 7 }
+func (c LESetPHY) Marshal(b []byte) {
+	o.PutUint16(b[0:], c.ConnectionHandle)
+	b[2], b[3], b[4] = c.AllPHYs, c.TxPHYs, c.RxPHYs
+	o.PutUint16(b[5:], c.PHYOptions)
+}
+
+// LE Set Advertising Set Random Address (0x0035)
+type LESetAdvertisingSetRandomAddress struct {
+	AdvertisingHandle uint8
+	RandomAddress     [6]byte
+}
+
+func (c LESetAdvertisingSetRandomAddress) Opcode() int { return opLESetAdvertisingSetRandomAddress }
+func (c LESetAdvertisingSetRandomAddress) Len() int    { return 7 }
+func (c LESetAdvertisingSetRandomAddress) Marshal(b []byte) {
+	b[0] = c.AdvertisingHandle
+	o.PutMAC(b[1:], c.RandomAddress)
+}
+
+type LESetAdvertisingSetRandomAddressRP struct{ Status uint8 }
+
+// Advertising Event Properties of LE Set Extended Advertising Parameters.
+const (
+	AdvPropConnectable    = 0x0001 // Connectable advertising
+	AdvPropScannable      = 0x0002 // Scannable advertising
+	AdvPropDirected       = 0x0004 // Directed advertising
+	AdvPropHighDutyCycle  = 0x0008 // High Duty Cycle Directed Connectable advertising
+	AdvPropLegacy         = 0x0010 // Use legacy advertising PDUs
+	AdvPropAnonymous      = 0x0020 // Omit advertiser's address from all PDUs
+	AdvPropIncludeTxPower = 0x0040 // Include TxPower in the extended header of at least one advertising PDU
+)
+
+// LE Set Extended Advertising Parameters (0x0036)
+// The advertising intervals are 24-bit values, in units of 0.625 ms.
+type LESetExtendedAdvertisingParameters struct {
+	AdvertisingHandle             uint8
+	AdvertisingEventProperties    uint16
+	PrimaryAdvertisingIntervalMin uint32
+	PrimaryAdvertisingIntervalMax uint32
+	PrimaryAdvertisingChannelMap  uint8
+	OwnAddressType                uint8
+	PeerAddressType               uint8
+	PeerAddress                   [6]byte
+	AdvertisingFilterPolicy       uint8
+	AdvertisingTxPower            int8 // 0x7F: no preference
+	PrimaryAdvertisingPHY         uint8
+	SecondaryAdvertisingMaxSkip   uint8
+	SecondaryAdvertisingPHY       uint8
+	AdvertisingSID                uint8
+	ScanRequestNotificationEnable uint8
+}
+
+func (c LESetExtendedAdvertisingParameters) Opcode() int {
+	return opLESetExtendedAdvertisingParameters
+}
+func (c LESetExtendedAdvertisingParameters) Len() int { return 25 }
+func (c LESetExtendedAdvertisingParameters) Marshal(b []byte) {
+	b[0] = c.AdvertisingHandle
+	o.PutUint16(b[1:], c.AdvertisingEventProperties)
+	putUint24(b[3:], c.PrimaryAdvertisingIntervalMin)
+	putUint24(b[6:], c.PrimaryAdvertisingIntervalMax)
+	b[9] = c.PrimaryAdvertisingChannelMap
+	b[10] = c.OwnAddressType
+	b[11] = c.PeerAddressType
+	o.PutMAC(b[12:], c.PeerAddress)
+	b[18] = c.AdvertisingFilterPolicy
+	b[19] = uint8(c.AdvertisingTxPower)
+	b[20] = c.PrimaryAdvertisingPHY
+	b[21] = c.SecondaryAdvertisingMaxSkip
+	b[22] = c.SecondaryAdvertisingPHY
+	b[23] = c.AdvertisingSID
+	b[24] = c.ScanRequestNotificationEnable
+}
+
+type LESetExtendedAdvertisingParametersRP struct {
+	Status          uint8
+	SelectedTxPower int8
+}
+
+// Operations of LE Set Extended Advertising Data and Scan Response Data.
+const (
+	AdvDataIntermediateFragment = 0x00
+	AdvDataFirstFragment        = 0x01
+	AdvDataLastFragment         = 0x02
+	AdvDataComplete             = 0x03
+	AdvDataUnchanged            = 0x04
+)
+
+// MaxAdvDataFragmentLength is the maximum length of the data carried by a
+// single LE Set Extended Advertising Data, or Scan Response Data, command.
+const MaxAdvDataFragmentLength = 251
+
+// LE Set Extended Advertising Data (0x0037)
+type LESetExtendedAdvertisingData struct {
+	AdvertisingHandle  uint8
+	Operation          uint8
+	FragmentPreference uint8
+	AdvertisingData    []byte
+}
+
+func (c LESetExtendedAdvertisingData) Opcode() int { return opLESetExtendedAdvertisingData }
+func (c LESetExtendedAdvertisingData) Len() int    { return 4 + len(c.AdvertisingData) }
+func (c LESetExtendedAdvertisingData) Marshal(b []byte) {
+	b[0] = c.AdvertisingHandle
+	b[1] = c.Operation
+	b[2] = c.FragmentPreference
+	b[3] = uint8(len(c.AdvertisingData))
+	copy(b[4:], c.AdvertisingData)
+}
+
+type LESetExtendedAdvertisingDataRP struct{ Status uint8 }
+
+// LE Set Extended Scan Response Data (0x0038)
+type LESetExtendedScanResponseData struct {
+	AdvertisingHandle  uint8
+	Operation          uint8
+	FragmentPreference uint8
+	ScanResponseData   []byte
+}
+
+func (c LESetExtendedScanResponseData) Opcode() int { return opLESetExtendedScanResponseData }
+func (c LESetExtendedScanResponseData) Len() int    { return 4 + len(c.ScanResponseData) }
+func (c LESetExtendedScanResponseData) Marshal(b []byte) {
+	b[0] = c.AdvertisingHandle
+	b[1] = c.Operation
+	b[2] = c.FragmentPreference
+	b[3] = uint8(len(c.ScanResponseData))
+	copy(b[4:], c.ScanResponseData)
+}
+
+type LESetExtendedScanResponseDataRP struct{ Status uint8 }
+
+// AdvertisingSetEnable is an entry of LE Set Extended Advertising Enable.
+type AdvertisingSetEnable struct {
+	AdvertisingHandle            uint8
+	Duration                     uint16 // N x 10 ms, 0: until disabled
+	MaxExtendedAdvertisingEvents uint8  // 0: no maximum
+}
+
+// LE Set Extended Advertising Enable (0x0039)
+type LESetExtendedAdvertisingEnable struct {
+	Enable uint8
+	Sets   []AdvertisingSetEnable // all the sets are disabled if empty and Enable is 0
+}
+
+func (c LESetExtendedAdvertisingEnable) Opcode() int { return opLESetExtendedAdvertisingEnable }
+func (c LESetExtendedAdvertisingEnable) Len() int    { return 2 + 4*len(c.Sets) }
+func (c LESetExtendedAdvertisingEnable) Marshal(b []byte) {
+	b[0] = c.Enable
+	b[1] = uint8(len(c.Sets))
+	for i, s := range c.Sets {
+		b[2+i*4] = s.AdvertisingHandle
+		o.PutUint16(b[3+i*4:], s.Duration)
+		b[5+i*4] = s.MaxExtendedAdvertisingEvents
+	}
+}
+
+type LESetExtendedAdvertisingEnableRP struct{ Status uint8 }
+
+// LE Read Maximum Advertising Data Length (0x003A)
+type LEReadMaximumAdvertisingDataLength struct{}
+
+func (c LEReadMaximumAdvertisingDataLength) Opcode() int {
+	return opLEReadMaximumAdvertisingDataLength
+}
+func (c LEReadMaximumAdvertisingDataLength) Len() int         { return 0 }
+func (c LEReadMaximumAdvertisingDataLength) Marshal(b []byte) {}
+
+type LEReadMaximumAdvertisingDataLengthRP struct {
+	Status                   uint8
+	MaxAdvertisingDataLength uint16
+}
+
+// LE Read Number of Supported Advertising Sets (0x003B)
+type LEReadNumberOfSupportedAdvertisingSets struct{}
+
+func (c LEReadNumberOfSupportedAdvertisingSets) Opcode() int {
+	return opLEReadNumberOfSupportedAdvSets
+}
+func (c LEReadNumberOfSupportedAdvertisingSets) Len() int         { return 0 }
+func (c LEReadNumberOfSupportedAdvertisingSets) Marshal(b []byte) {}
+
+type LEReadNumberOfSupportedAdvertisingSetsRP struct {
+	Status                      uint8
+	NumSupportedAdvertisingSets uint8
+}
+
+// LE Remove Advertising Set (0x003C)
+type LERemoveAdvertisingSet struct{ AdvertisingHandle uint8 }
+
+func (c LERemoveAdvertisingSet) Opcode() int      { return opLERemoveAdvertisingSet }
+func (c LERemoveAdvertisingSet) Len() int         { return 1 }
+func (c LERemoveAdvertisingSet) Marshal(b []byte) { b[0] = c.AdvertisingHandle }
+
+type LERemoveAdvertisingSetRP struct{ Status uint8 }
+
+// LE Clear Advertising Sets (0x003D)
+type LEClearAdvertisingSets struct{}
+
+func (c LEClearAdvertisingSets) Opcode() int      { return opLEClearAdvertisingSets }
+func (c LEClearAdvertisingSets) Len() int         { return 0 }
+func (c LEClearAdvertisingSets) Marshal(b []byte) {}
+
+type LEClearAdvertisingSetsRP struct{ Status uint8 }
+
+// Scanning PHYs of LE Set Extended Scan Parameters.
+const (
+	ScanPHY1M    = 0x01 // Scan advertisements on the LE 1M PHY
+	ScanPHYCoded = 0x04 // Scan advertisements on the LE Coded PHY
+)
+
+// The properties of the LE Set Periodic Advertising Parameters command.
+const PeriodicAdvPropIncludeTxPower = 1 << 6
+
+// LE Set Periodic Advertising Parameters (0x003E)
+type LESetPeriodicAdvertisingParameters struct {
+	AdvertisingHandle              uint8
+	PeriodicAdvertisingIntervalMin uint16 // N x 1.25 ms
+	PeriodicAdvertisingIntervalMax uint16 // N x 1.25 ms
+	PeriodicAdvertisingProperties  uint16
+}
+
+func (c LESetPeriodicAdvertisingParameters) Opcode() int { return opLESetPeriodicAdvertisingParameters }
+func (c LESetPeriodicAdvertisingParameters) Len() int    { return 7 }
+func (c LESetPeriodicAdvertisingParameters) Marshal(b []byte) {
+	b[0] = c.AdvertisingHandle
+	o.PutUint16(b[1:], c.PeriodicAdvertisingIntervalMin)
+	o.PutUint16(b[3:], c.PeriodicAdvertisingIntervalMax)
+	o.PutUint16(b[5:], c.PeriodicAdvertisingProperties)
+}
+
+type LESetPeriodicAdvertisingParametersRP struct{ Status uint8 }
+
+// LE Set Periodic Advertising Data (0x003F)
+type LESetPeriodicAdvertisingData struct {
+	AdvertisingHandle uint8
+	Operation         uint8
+	AdvertisingData   []byte // up to MaxAdvDataFragmentLength bytes
+}
+
+func (c LESetPeriodicAdvertisingData) Opcode() int { return opLESetPeriodicAdvertisingData }
+func (c LESetPeriodicAdvertisingData) Len() int    { return 3 + len(c.AdvertisingData) }
+func (c LESetPeriodicAdvertisingData) Marshal(b []byte) {
+	b[0] = c.AdvertisingHandle
+	b[1] = c.Operation
+	b[2] = uint8(len(c.AdvertisingData))
+	copy(b[3:], c.AdvertisingData)
+}
+
+type LESetPeriodicAdvertisingDataRP struct{ Status uint8 }
+
+// LE Set Periodic Advertising Enable (0x0040)
+type LESetPeriodicAdvertisingEnable struct {
+	Enable            uint8
+	AdvertisingHandle uint8
+}
+
+func (c LESetPeriodicAdvertisingEnable) Opcode() int { return opLESetPeriodicAdvertisingEnable }
+func (c LESetPeriodicAdvertisingEnable) Len() int    { return 2 }
+func (c LESetPeriodicAdvertisingEnable) Marshal(b []byte) {
+	b[0] = c.Enable
+	b[1] = c.AdvertisingHandle
+}
+
+type LESetPeriodicAdvertisingEnableRP struct{ Status uint8 }
+
+// ExtendedScanPHY are the scan parameters of a PHY of LE Set Extended Scan Parameters.
+type ExtendedScanPHY struct {
+	ScanType     LEScanType
+	ScanInterval uint16 // N x 0.625 ms
+	ScanWindow   uint16 // N x 0.625 ms
+}
+
+// LE Set Extended Scan Parameters (0x0041)
+// PHYs holds the parameters of each PHY set in ScanningPHYs, lowest bit first.
+type LESetExtendedScanParameters struct {
+	OwnAddressType       uint8
+	ScanningFilterPolicy uint8
+	ScanningPHYs         uint8
+	PHYs                 []ExtendedScanPHY
+}
+
+func (c LESetExtendedScanParameters) Opcode() int { return opLESetExtendedScanParameters }
+func (c LESetExtendedScanParameters) Len() int    { return 3 + 5*len(c.PHYs) }
+func (c LESetExtendedScanParameters) Marshal(b []byte) {
+	b[0] = c.OwnAddressType
+	b[1] = c.ScanningFilterPolicy
+	b[2] = c.ScanningPHYs
+	for i, p := range c.PHYs {
+		b[3+i*5] = uint8(p.ScanType)
+		o.PutUint16(b[4+i*5:], p.ScanInterval)
+		o.PutUint16(b[6+i*5:], p.ScanWindow)
+	}
+}
+
+type LESetExtendedScanParametersRP struct{ Status uint8 }
+
+// LE Set Extended Scan Enable (0x0042)
+type LESetExtendedScanEnable struct {
+	Enable           uint8
+	FilterDuplicates uint8
+	Duration         uint16 // N x 10 ms, 0: until disabled
+	Period           uint16 // N x 1.28 s, 0: scan continuously
+}
+
+func (c LESetExtendedScanEnable) Opcode() int { return opLESetExtendedScanEnable }
+func (c LESetExtendedScanEnable) Len() int    { return 6 }
+func (c LESetExtendedScanEnable) Marshal(b []byte) {
+	b[0] = c.Enable
+	b[1] = c.FilterDuplicates
+	o.PutUint16(b[2:], c.Duration)
+	o.PutUint16(b[4:], c.Period)
+}
+
+type LESetExtendedScanEnableRP struct{ Status uint8 }
+
+// ExtendedConnPHY holds the parameters of an initiating PHY.
+type ExtendedConnPHY struct {
+	ScanInterval       uint16
+	ScanWindow         uint16
+	ConnIntervalMin    uint16
+	ConnIntervalMax    uint16
+	ConnLatency        uint16
+	SupervisionTimeout uint16
+	MinimumCELength    uint16
+	MaximumCELength    uint16
+}
+
+// LE Extended Create Connection (0x0043)
+type LEExtendedCreateConn struct {
+	InitiatorFilterPolicy uint8
+	OwnAddressType        uint8
+	PeerAddressType       uint8
+	PeerAddress           [6]byte
+	InitiatingPHYs        uint8             // PHY1MBit, PHY2MBit and PHYCodedBit
+	PHYs                  []ExtendedConnPHY // one per bit of InitiatingPHYs, in that order
+}
+
+func (c LEExtendedCreateConn) Opcode() int { return opLEExtendedCreateConn }
+func (c LEExtendedCreateConn) Len() int    { return 10 + 16*len(c.PHYs) }
+func (c LEExtendedCreateConn) Marshal(b []byte) {
+	b[0] = c.InitiatorFilterPolicy
+	b[1] = c.OwnAddressType
+	b[2] = c.PeerAddressType
+	o.PutMAC(b[3:], c.PeerAddress)
+	b[9] = c.InitiatingPHYs
+	for i, p := range c.PHYs {
+		d := b[10+i*16:]
+		o.PutUint16(d[0:], p.ScanInterval)
+		o.PutUint16(d[2:], p.ScanWindow)
+		o.PutUint16(d[4:], p.ConnIntervalMin)
+		o.PutUint16(d[6:], p.ConnIntervalMax)
+		o.PutUint16(d[8:], p.ConnLatency)
+		o.PutUint16(d[10:], p.SupervisionTimeout)
+		o.PutUint16(d[12:], p.MinimumCELength)
+		o.PutUint16(d[14:], p.MaximumCELength)
+	}
+}
+
+// The options of the LE Periodic Advertising Create Sync command.
+const (
+	CreateSyncUsePeriodicAdvList = 0x01 // sync to the advertisers of the Periodic Advertiser List
+	CreateSyncReportingDisabled  = 0x02 // don't report the periodic advertising data
+)
+
+// LE Periodic Advertising Create Sync (0x0044)
+type LEPeriodicAdvertisingCreateSync struct {
+	Options               uint8
+	AdvertisingSID        uint8
+	AdvertiserAddressType uint8
+	AdvertiserAddress     [6]byte
+	Skip                  uint16 // periodic advertising events which can be skipped
+	SyncTimeout           uint16 // N x 10 ms
+	SyncCTEType           uint8
+}
+
+func (c LEPeriodicAdvertisingCreateSync) Opcode() int { return opLEPeriodicAdvertisingCreateSync }
+func (c LEPeriodicAdvertisingCreateSync) Len() int    { return 14 }
+func (c LEPeriodicAdvertisingCreateSync) Marshal(b []byte) {
+	b[0] = c.Options
+	b[1] = c.AdvertisingSID
+	b[2] = c.AdvertiserAddressType
+	o.PutMAC(b[3:], c.AdvertiserAddress)
+	o.PutUint16(b[9:], c.Skip)
+	o.PutUint16(b[11:], c.SyncTimeout)
+	b[13] = c.SyncCTEType
+}
+
+// LE Periodic Advertising Create Sync Cancel (0x0045)
+type LEPeriodicAdvertisingCreateSyncCancel struct{}
+
+func (c LEPeriodicAdvertisingCreateSyncCancel) Opcode() int {
+	return opLEPeriodicAdvertisingCreateSyncCncl
+}
+func (c LEPeriodicAdvertisingCreateSyncCancel) Len() int         { return 0 }
+func (c LEPeriodicAdvertisingCreateSyncCancel) Marshal(b []byte) {}
+
+type LEPeriodicAdvertisingCreateSyncCancelRP struct{ Status uint8 }
+
+// LE Periodic Advertising Terminate Sync (0x0046)
+type LEPeriodicAdvertisingTerminateSync struct {
+	SyncHandle uint16
+}
+
+func (c LEPeriodicAdvertisingTerminateSync) Opcode() int      { return opLEPeriodicAdvertisingTerminateSync }
+func (c LEPeriodicAdvertisingTerminateSync) Len() int         { return 2 }
+func (c LEPeriodicAdvertisingTerminateSync) Marshal(b []byte) { o.PutUint16(b, c.SyncHandle) }
+
+type LEPeriodicAdvertisingTerminateSyncRP struct{ Status uint8 }
+
+// putUint24 puts the 24-bit value v in little-endian order.
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = uint8(v), uint8(v>>8), uint8(v>>16)
+}
@@ -0,0 +1,664 @@
+package linux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Parameters of the local end of the LE Credit Based Connection channels.
+const (
+	cocMTU     = 2048 // Maximum SDU size we accept.
+	cocMPS     = 247  // Maximum K-frame payload size we accept.
+	cocCredits = 20   // K-frames the remote device may send before we grant more.
+
+	// Bytes received on a channel and not read yet, including those the remote
+	// device may send with the credits it holds, beyond which no more credits
+	// are granted. It holds an SDU being reassembled and a round of credits.
+	cocRxBuffer = cocMTU + cocCredits*cocMPS
+
+	cocMinMTU = 23 // Minimum MTU and MPS of a channel.
+	cocMaxMPS = 65533
+
+	sigTimeout = 30 * time.Second // Response timeout of the signaling requests (RTX).
+
+	psmEATT = 0x0027 // LE_PSM of the enhanced ATT bearers.
+)
+
+// A CoCError is the result of a refused LE Credit Based Connection request.
+type CoCError uint16
+
+var cocErrorName = map[CoCError]string{
+	0x0002: "LE_PSM not supported",
+	0x0004: "no resources available",
+	0x0005: "insufficient authentication",
+	0x0006: "insufficient authorization",
+	0x0007: "insufficient encryption key size",
+	0x0008: "insufficient encryption",
+	0x0009: "invalid Source CID",
+	0x000A: "Source CID already allocated",
+	0x000B: "unacceptable parameters",
+}
+
+func (e CoCError) Error() string {
+	if s, ok := cocErrorName[e]; ok {
+		return "l2cap: connection refused, " + s
+	}
+	return fmt.Sprintf("l2cap: connection refused, result 0x%04X", uint16(e))
+}
+
+// LE Credit Based Connection results
+const (
+	cocSuccess            CoCError = 0x0000
+	cocPSMNotSupported    CoCError = 0x0002
+	cocNoResources        CoCError = 0x0004
+	cocInvalidSourceCID   CoCError = 0x0009
+	cocSourceCIDAllocated CoCError = 0x000A
+	cocUnacceptableParams CoCError = 0x000B
+)
+
+var errCoCClosed = errors.New("l2cap: channel closed")
+
+// An L2CAPAddr is the address of an end of an L2CAP channel.
+type L2CAPAddr struct {
+	Addr net.HardwareAddr // Nil for the local device.
+	PSM  uint16
+}
+
+func (a *L2CAPAddr) Network() string { return "l2cap" }
+func (a *L2CAPAddr) String() string  { return fmt.Sprintf("%s/0x%02X", a.Addr, a.PSM) }
+
+// A CoC is an LE Credit Based Connection oriented Channel.
+// It implements net.Conn; each Write is sent as one or more SDUs.
+type CoC struct {
+	c    *conn
+	psm  uint16
+	scid uint16 // local CID
+	dcid uint16 // remote CID
+
+	txMTU uint16
+	txMPS uint16
+
+	mu         sync.Mutex
+	txCredits  int
+	rxCredits  int    // K-frames the remote device may still send
+	rxFree     int    // K-frames received, not granted back yet
+	rxBuffered int    // bytes received, not read by the application yet
+	rsdu       []byte // SDU being reassembled
+	rsduLen    int
+	rdeadline  time.Time
+	wdeadline  time.Time
+
+	creditc chan struct{} // signaled when the remote device grants credits
+	sdus    chan []byte   // the SDUs received
+	closed  chan struct{}
+	once    sync.Once
+
+	rmu  sync.Mutex // serializes the readers
+	rbuf []byte     // unread part of the current SDU
+
+	wmu sync.Mutex // serializes the writers, so the K-frames of SDUs don't interleave
+}
+
+func newCoC(c *conn, psm uint16) *CoC {
+	return &CoC{
+		c:         c,
+		psm:       psm,
+		rxCredits: cocCredits,
+		creditc:   make(chan struct{}, 1),
+		sdus:      make(chan []byte, cocCredits),
+		closed:    make(chan struct{}),
+	}
+}
+
+// MTU returns the maximum SDU size of the channel, the lesser of the
+// local and the remote MTUs.
+func (ch *CoC) MTU() int {
+	if ch.txMTU < cocMTU {
+		return int(ch.txMTU)
+	}
+	return cocMTU
+}
+
+// PlatData returns the remote device of the channel.
+func (ch *CoC) PlatData() *PlatData { return ch.c.pd }
+
+func (ch *CoC) LocalAddr() net.Addr { return &L2CAPAddr{PSM: ch.psm} }
+
+func (ch *CoC) RemoteAddr() net.Addr {
+	var a net.HardwareAddr
+	if ch.c.pd != nil {
+		a = net.HardwareAddr(append([]byte(nil), ch.c.pd.Address[:]...))
+	}
+	return &L2CAPAddr{Addr: a, PSM: ch.psm}
+}
+
+func (ch *CoC) SetDeadline(t time.Time) error {
+	ch.SetReadDeadline(t)
+	return ch.SetWriteDeadline(t)
+}
+
+func (ch *CoC) SetReadDeadline(t time.Time) error {
+	ch.mu.Lock()
+	ch.rdeadline = t
+	ch.mu.Unlock()
+	return nil
+}
+
+func (ch *CoC) SetWriteDeadline(t time.Time) error {
+	ch.mu.Lock()
+	ch.wdeadline = t
+	ch.mu.Unlock()
+	return nil
+}
+
+// timer returns a channel which fires at the deadline t, if any, and a func to stop it.
+func timer(t time.Time) (<-chan time.Time, func() bool) {
+	if t.IsZero() {
+		return nil, func() bool { return false }
+	}
+	tm := time.NewTimer(time.Until(t))
+	return tm.C, tm.Stop
+}
+
+func (ch *CoC) Read(b []byte) (int, error) {
+	ch.rmu.Lock()
+	defer ch.rmu.Unlock()
+	for len(ch.rbuf) == 0 {
+		select {
+		case s := <-ch.sdus:
+			ch.rbuf = s
+			continue
+		default:
+		}
+		ch.mu.Lock()
+		timeout, stop := timer(ch.rdeadline)
+		ch.mu.Unlock()
+		select {
+		case s := <-ch.sdus:
+			ch.rbuf = s
+		case <-ch.closed:
+			stop()
+			return 0, io.EOF
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		stop()
+	}
+	n := copy(b, ch.rbuf)
+	ch.rbuf = ch.rbuf[n:]
+	ch.mu.Lock()
+	ch.rxBuffered -= n
+	grant := ch.creditsToGrant()
+	ch.mu.Unlock()
+	ch.grantCredits(grant)
+	return n, nil
+}
+
+// creditsToGrant returns the credits of the K-frames received to give back
+// to the remote device, and counts them as granted. They are given back in
+// batches of half of the initial credits, or as soon as the remote device
+// runs out of credits, as long as the bytes and the SDUs it may then send
+// fit in the receive buffer and queue. It must be called with ch.mu held.
+func (ch *CoC) creditsToGrant() int {
+	grant := ch.rxFree
+	if max := (cocRxBuffer-ch.rxBuffered)/cocMPS - ch.rxCredits; grant > max {
+		grant = max
+	}
+	// Each K-frame may complete an SDU.
+	if max := cap(ch.sdus) - len(ch.sdus) - ch.rxCredits; grant > max {
+		grant = max
+	}
+	if grant <= 0 || (grant < cocCredits/2 && ch.rxCredits > 0) {
+		return 0
+	}
+	ch.rxFree -= grant
+	ch.rxCredits += grant
+	return grant
+}
+
+// grantCredits gives back n credits to the remote device.
+func (ch *CoC) grantCredits(n int) {
+	if n == 0 {
+		return
+	}
+	ch.c.writeSignal(sigFlowControlCredit, ch.c.nextIdentifier(), []byte{
+		uint8(ch.scid), uint8(ch.scid >> 8),
+		uint8(n), uint8(n >> 8),
+	})
+}
+
+func (ch *CoC) Write(b []byte) (int, error) {
+	ch.wmu.Lock()
+	defer ch.wmu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		s := b
+		if len(s) > int(ch.txMTU) {
+			s = s[:ch.txMTU]
+		}
+		if err := ch.writeSDU(s); err != nil {
+			return n, err
+		}
+		n += len(s)
+		b = b[len(s):]
+	}
+	return n, nil
+}
+
+// writeSDU segments an SDU into K-frames, and sends them as credits allow.
+// The data of the channels is bulk, but for the ATT PDUs of the enhanced ATT
+// bearers, classified as on the fixed ATT channel.
+func (ch *CoC) writeSDU(s []byte) error {
+	u := ch.psm == psmEATT && urgentATT(s)
+	f := append([]byte{uint8(len(s)), uint8(len(s) >> 8)}, s...) // SDU Length, and the SDU
+	for len(f) > 0 {
+		k := f
+		if len(k) > int(ch.txMPS) {
+			k = k[:ch.txMPS]
+		}
+		if err := ch.takeCredit(); err != nil {
+			return err
+		}
+		if _, err := ch.c.writeFrame(int(ch.dcid), k, u); err != nil {
+			return err
+		}
+		f = f[len(k):]
+	}
+	return nil
+}
+
+// takeCredit waits for a credit to send a K-frame.
+func (ch *CoC) takeCredit() error {
+	for {
+		ch.mu.Lock()
+		if ch.txCredits > 0 {
+			ch.txCredits--
+			ch.mu.Unlock()
+			return nil
+		}
+		timeout, stop := timer(ch.wdeadline)
+		ch.mu.Unlock()
+		select {
+		case <-ch.creditc:
+		case <-ch.closed:
+			stop()
+			return errCoCClosed
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		}
+		stop()
+	}
+}
+
+func (ch *CoC) addCredits(n int) {
+	ch.mu.Lock()
+	ch.txCredits += n
+	if ch.txCredits > 0xFFFF {
+		log.Printf("l2cap: channel 0x%04X credits overflow", ch.scid)
+		ch.txCredits = 0xFFFF
+	}
+	ch.mu.Unlock()
+	select {
+	case ch.creditc <- struct{}{}:
+	default:
+	}
+}
+
+// handleFrame reassembles the SDUs from the K-frames received on the
+// channel. The credit of each K-frame is given back once it is buffered.
+func (ch *CoC) handleFrame(b []byte) {
+	ch.mu.Lock()
+	grant, ok := ch.reassemble(b)
+	ch.mu.Unlock()
+	if !ok {
+		go ch.Close()
+		return
+	}
+	ch.grantCredits(grant)
+}
+
+// reassemble adds the K-frame b to the SDU being reassembled, and returns
+// the credits to give back. It reports false if the K-frame is invalid.
+// It must be called with ch.mu held.
+func (ch *CoC) reassemble(b []byte) (int, bool) {
+	if ch.rxCredits == 0 || len(b) > cocMPS {
+		log.Printf("l2cap: channel 0x%04X got a K-frame it has no credit for, or larger than MPS", ch.scid)
+		return 0, false
+	}
+	ch.rxCredits--
+	ch.rxFree++
+	if ch.rsdu == nil {
+		if len(b) < 2 {
+			log.Printf("l2cap: channel 0x%04X got a malformed K-frame", ch.scid)
+			return 0, false
+		}
+		ch.rsduLen = int(b[0]) | int(b[1])<<8
+		ch.rsdu = make([]byte, 0, ch.rsduLen)
+		b = b[2:]
+	}
+	if len(ch.rsdu)+len(b) > ch.rsduLen || ch.rsduLen > cocMTU {
+		log.Printf("l2cap: channel 0x%04X got an SDU larger than its length or MTU", ch.scid)
+		return 0, false
+	}
+	ch.rsdu = append(ch.rsdu, b...)
+	ch.rxBuffered += len(b)
+	if len(ch.rsdu) == ch.rsduLen {
+		// The SDUs queued never outnumber the credits granted, so this doesn't block.
+		ch.sdus <- ch.rsdu
+		ch.rsdu = nil
+	}
+	return ch.creditsToGrant(), true
+}
+
+// Close disconnects the channel.
+func (ch *CoC) Close() error {
+	if !ch.shutdown() {
+		return nil
+	}
+	id := ch.c.nextIdentifier()
+	rspc := ch.c.expect(id)
+	defer ch.c.unexpect(id)
+	d := []byte{uint8(ch.dcid), uint8(ch.dcid >> 8), uint8(ch.scid), uint8(ch.scid >> 8)}
+	if err := ch.c.writeSignal(sigDisconnectReq, id, d); err != nil {
+		return err
+	}
+	select {
+	case <-rspc:
+	case <-ch.c.done:
+	case <-time.After(sigTimeout):
+		return errors.New("l2cap: disconnection request timed out")
+	}
+	return nil
+}
+
+// shutdown releases the channel, and reports whether it was open.
+func (ch *CoC) shutdown() bool {
+	open := false
+	ch.once.Do(func() {
+		open = true
+		close(ch.closed)
+		ch.c.removeChan(ch.scid)
+	})
+	return open
+}
+
+// addChan allocates a local CID to the channel.
+func (c *conn) addChan(ch *CoC) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cid := uint16(0x0040); cid <= 0x007F; cid++ {
+		if _, ok := c.chans[cid]; !ok {
+			ch.scid = cid
+			c.chans[cid] = ch
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) removeChan(cid uint16) {
+	c.mu.Lock()
+	delete(c.chans, cid)
+	c.mu.Unlock()
+}
+
+func (c *conn) localChan(cid uint16) (*CoC, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.chans[cid]
+	return ch, ok
+}
+
+// remoteChan returns the channel connected to the remote CID.
+func (c *conn) remoteChan(cid uint16) (*CoC, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.chans {
+		if ch.dcid == cid {
+			return ch, true
+		}
+	}
+	return nil, false
+}
+
+// closeChans releases all the channels of a lost connection.
+func (c *conn) closeChans() {
+	c.mu.Lock()
+	chans := make([]*CoC, 0, len(c.chans))
+	for _, ch := range c.chans {
+		chans = append(chans, ch)
+	}
+	c.mu.Unlock()
+	for _, ch := range chans {
+		ch.shutdown()
+	}
+}
+
+// dialCoC opens a channel to the LE_PSM psm of the remote device.
+func (c *conn) dialCoC(ctx context.Context, psm uint16) (*CoC, error) {
+	ch := newCoC(c, psm)
+	if !c.addChan(ch) {
+		return nil, cocNoResources
+	}
+	id := c.nextIdentifier()
+	rspc := c.expect(id)
+	defer c.unexpect(id)
+	d := []byte{
+		uint8(psm), uint8(psm >> 8),
+		uint8(ch.scid), uint8(ch.scid >> 8),
+		uint8(cocMTU & 0xFF), uint8(cocMTU >> 8),
+		uint8(cocMPS), uint8(cocMPS >> 8),
+		uint8(cocCredits), uint8(cocCredits >> 8),
+	}
+	if err := c.writeSignal(sigLECreditBasedConnReq, id, d); err != nil {
+		c.removeChan(ch.scid)
+		return nil, err
+	}
+
+	var s sigPkt
+	select {
+	case s = <-rspc:
+	case <-ctx.Done():
+		c.removeChan(ch.scid)
+		return nil, ctx.Err()
+	case <-c.done:
+		c.removeChan(ch.scid)
+		return nil, io.ErrClosedPipe
+	case <-time.After(sigTimeout):
+		c.removeChan(ch.scid)
+		return nil, errors.New("l2cap: connection request timed out")
+	}
+	if s.code != sigLECreditBasedConnRsp || len(s.d) < 10 {
+		c.removeChan(ch.scid)
+		return nil, fmt.Errorf("l2cap: connection request rejected [% X]", s.d)
+	}
+	if r := CoCError(uint16(s.d[8]) | uint16(s.d[9])<<8); r != cocSuccess {
+		c.removeChan(ch.scid)
+		return nil, r
+	}
+	c.mu.Lock()
+	ch.dcid = uint16(s.d[0]) | uint16(s.d[1])<<8
+	ch.txMTU = uint16(s.d[2]) | uint16(s.d[3])<<8
+	ch.txMPS = uint16(s.d[4]) | uint16(s.d[5])<<8
+	c.mu.Unlock()
+	ch.addCredits(int(uint16(s.d[6]) | uint16(s.d[7])<<8))
+	if ch.txMTU < cocMinMTU || ch.txMPS < cocMinMTU || ch.txMPS > cocMaxMPS {
+		ch.Close()
+		return nil, cocUnacceptableParams
+	}
+	return ch, nil
+}
+
+// handleCoCReq answers an LE Credit Based Connection Request, and hands the
+// channel to the listener of the LE_PSM, if any.
+func (c *conn) handleCoCReq(id uint8, d []byte) error {
+	if len(d) < 10 {
+		return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+	}
+	psm := uint16(d[0]) | uint16(d[1])<<8
+	scid := uint16(d[2]) | uint16(d[3])<<8
+	mtu := uint16(d[4]) | uint16(d[5])<<8
+	mps := uint16(d[6]) | uint16(d[7])<<8
+	credits := uint16(d[8]) | uint16(d[9])<<8
+
+	ch := newCoC(c, psm)
+	l, found := c.hci.cocListener(psm)
+	_, allocated := c.remoteChan(scid)
+	r := cocSuccess
+	switch {
+	case !found:
+		r = cocPSMNotSupported
+	case scid < 0x0040 || scid > 0x007F:
+		r = cocInvalidSourceCID
+	case allocated:
+		r = cocSourceCIDAllocated
+	case mtu < cocMinMTU || mps < cocMinMTU || mps > cocMaxMPS:
+		r = cocUnacceptableParams
+	case !c.addChan(ch):
+		r = cocNoResources
+	}
+	if r == cocSuccess {
+		c.mu.Lock()
+		ch.dcid, ch.txMTU, ch.txMPS = scid, mtu, mps
+		c.mu.Unlock()
+		ch.addCredits(int(credits))
+	}
+
+	rsp := []byte{
+		uint8(ch.scid), uint8(ch.scid >> 8),
+		uint8(cocMTU & 0xFF), uint8(cocMTU >> 8),
+		uint8(cocMPS), uint8(cocMPS >> 8),
+		uint8(cocCredits), uint8(cocCredits >> 8),
+		uint8(r), uint8(r >> 8),
+	}
+	if r != cocSuccess {
+		rsp[0], rsp[1] = 0, 0
+	}
+	if err := c.writeSignal(sigLECreditBasedConnRsp, id, rsp); err != nil || r != cocSuccess {
+		return err
+	}
+	if !l.deliver(ch) {
+		ch.Close()
+	}
+	return nil
+}
+
+// handleDisconnectReq answers a Disconnection Request of the remote device.
+func (c *conn) handleDisconnectReq(id uint8, d []byte) error {
+	if len(d) < 4 {
+		return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+	}
+	dcid := uint16(d[0]) | uint16(d[1])<<8
+	scid := uint16(d[2]) | uint16(d[3])<<8
+	ch, ok := c.localChan(dcid)
+	if !ok || ch.dcid != scid {
+		return c.rejectSignal(id, sigRejectInvalidCID, d[:4])
+	}
+	ch.shutdown()
+	return c.writeSignal(sigDisconnectRsp, id, d[:4])
+}
+
+// handleFlowControlCredit adds the credits granted by the remote device.
+func (c *conn) handleFlowControlCredit(id uint8, d []byte) error {
+	if len(d) < 4 {
+		return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+	}
+	if ch, ok := c.remoteChan(uint16(d[0]) | uint16(d[1])<<8); ok {
+		ch.addCredits(int(uint16(d[2]) | uint16(d[3])<<8))
+	}
+	return nil
+}
+
+// A CoCListener accepts the LE Credit Based Connections to an LE_PSM.
+// It implements net.Listener.
+type CoCListener struct {
+	h       *HCI
+	psm     uint16
+	acceptc chan *CoC
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// ListenCoC listens for LE Credit Based Connections to the LE_PSM psm.
+func (h *HCI) ListenCoC(psm uint16) (*CoCListener, error) {
+	if psm == 0 || psm > 0x00FF {
+		return nil, fmt.Errorf("l2cap: invalid LE_PSM 0x%04X", psm)
+	}
+	h.cocmu.Lock()
+	defer h.cocmu.Unlock()
+	if _, ok := h.cocListeners[psm]; ok {
+		return nil, fmt.Errorf("l2cap: LE_PSM 0x%02X already in use", psm)
+	}
+	l := &CoCListener{
+		h:       h,
+		psm:     psm,
+		acceptc: make(chan *CoC, 8),
+		closed:  make(chan struct{}),
+	}
+	h.cocListeners[psm] = l
+	return l, nil
+}
+
+// DialCoC opens an LE Credit Based Connection to the LE_PSM psm of the
+// connected remote device pd.
+func (h *HCI) DialCoC(ctx context.Context, pd *PlatData, psm uint16) (*CoC, error) {
+	if psm == 0 || psm > 0x00FF {
+		return nil, fmt.Errorf("l2cap: invalid LE_PSM 0x%04X", psm)
+	}
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return nil, errors.New("l2cap: not connected")
+	}
+	return c.dialCoC(ctx, psm)
+}
+
+func (h *HCI) cocListener(psm uint16) (*CoCListener, bool) {
+	h.cocmu.Lock()
+	defer h.cocmu.Unlock()
+	l, ok := h.cocListeners[psm]
+	return l, ok
+}
+
+// deliver queues an incoming channel, and reports whether the listener took it.
+func (l *CoCListener) deliver(ch *CoC) bool {
+	select {
+	case <-l.closed:
+		return false
+	default:
+	}
+	select {
+	case l.acceptc <- ch:
+		return true
+	default:
+		log.Printf("l2cap: LE_PSM 0x%02X accept queue full", l.psm)
+		return false
+	}
+}
+
+func (l *CoCListener) Accept() (net.Conn, error) {
+	select {
+	case ch := <-l.acceptc:
+		return ch, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *CoCListener) Close() error {
+	l.once.Do(func() {
+		l.h.cocmu.Lock()
+		delete(l.h.cocListeners, l.psm)
+		l.h.cocmu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *CoCListener) Addr() net.Addr { return &L2CAPAddr{PSM: l.psm} }
@@ -0,0 +1,122 @@
+package linux
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// A creditRecorder takes the ACL packets of the local device, and counts
+// the credits it grants on the signaling channel.
+type creditRecorder struct {
+	credits int
+}
+
+func (r *creditRecorder) Write(b []byte) (int, error) {
+	// ACL header, L2CAP header, then the signaling command.
+	if len(b) >= 17 && b[7] == 0x05 && b[9] == sigFlowControlCredit {
+		r.credits += int(b[15]) | int(b[16])<<8
+	}
+	return len(b), nil
+}
+
+// take returns the credits granted since the last call.
+func (r *creditRecorder) take() int {
+	n := r.credits
+	r.credits = 0
+	return n
+}
+
+// newTestCoC returns a channel on a controller with bufs ACL buffers.
+func newTestCoC(w io.Writer, bufs int) (*CoC, func()) {
+	h := &HCI{bufSize: 251, tx: newACLScheduler(w, bufs)}
+	go h.tx.loop()
+	h.tx.add(0x0001)
+	c := &conn{
+		hci:     h,
+		attr:    0x0001,
+		pending: make(map[uint8]chan sigPkt),
+		chans:   make(map[uint16]*CoC),
+		done:    make(chan struct{}),
+	}
+	ch := newCoC(c, 0x0080)
+	ch.scid, ch.dcid = 0x0040, 0x0040
+	return ch, h.tx.close
+}
+
+func TestCoCSmallFrames(t *testing.T) {
+	r := &creditRecorder{}
+	ch, done := newTestCoC(r, 1000)
+	defer done()
+
+	const mps = 23
+	want := make([]byte, cocMTU)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	f := append([]byte{uint8(len(want)), uint8(len(want) >> 8)}, want...)
+	credits := cocCredits
+	for len(f) > 0 {
+		if credits == 0 {
+			if credits = r.take(); credits == 0 {
+				t.Fatalf("no credits granted, %d bytes of the SDU left", len(f))
+			}
+		}
+		k := f
+		if len(k) > mps {
+			k = k[:mps]
+		}
+		ch.handleFrame(k)
+		credits--
+		f = f[len(k):]
+	}
+	credits += r.take()
+	if n := ch.rxBuffered + credits*cocMPS; n > cocRxBuffer {
+		t.Errorf("got %d bytes buffered or in flight, want at most %d", n, cocRxBuffer)
+	}
+
+	ch.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, cocMTU)
+	if _, err := io.ReadFull(ch, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got SDU [% X], want [% X]", got, want)
+	}
+}
+
+func TestCoCBufferFull(t *testing.T) {
+	r := &creditRecorder{}
+	ch, done := newTestCoC(r, 1000)
+	defer done()
+
+	// The SDUs aren't read, so the credits must stop once the buffer is full.
+	sdu := append([]byte{0xF5, 0x00}, make([]byte, cocMPS-2)...)
+	credits := cocCredits
+	sent := 0
+	for credits > 0 {
+		ch.handleFrame(sdu)
+		credits--
+		sent++
+		credits += r.take()
+		if sent > cocRxBuffer/cocMPS+cocCredits {
+			t.Fatalf("got credits for %d SDUs not read", sent)
+		}
+	}
+	if ch.rxBuffered > cocRxBuffer {
+		t.Errorf("got %d bytes buffered, want at most %d", ch.rxBuffered, cocRxBuffer)
+	}
+
+	// Reading the SDUs gives the credits back.
+	ch.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, cocMTU)
+	for i := 0; i < sent; i++ {
+		if _, err := ch.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if credits = r.take(); credits == 0 {
+		t.Error("got no credits once the SDUs were read")
+	}
+}
@@ -0,0 +1,332 @@
+package linux
+
+import (
+	"errors"
+	"time"
+
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/linux/cmd"
+	"github.com/grutz/gatt/linux/evt"
+)
+
+var (
+	// ErrConnectCanceled is reported when an outgoing connection is canceled
+	// before it's established.
+	ErrConnectCanceled = errors.New("connection canceled")
+
+	// ErrConnectTimeout is reported when an outgoing connection isn't
+	// established in the time set with SetConnectTimeout.
+	ErrConnectTimeout = errors.New("connection timed out")
+
+	// ErrConnectBusy is returned when the white list can't be used to
+	// connect, as the controller is already creating a connection.
+	ErrConnectBusy = errors.New("a connection is already being created")
+)
+
+// SetConnectMultiple sets whether the outgoing connections queued are
+// created several at once, by adding their targets to the white list. The
+// targets are connected to in the order they show up, rather than the order
+// they are queued, and the entries added are removed once they are connected.
+func (h *HCI) SetConnectMultiple(en bool) {
+	h.wlmu.Lock()
+	h.connMulti = en
+	h.wlmu.Unlock()
+}
+
+// SetConnectTimeout sets the time each LE Create Connection is given to
+// establish a connection, before it's canceled and its targets are reported
+// as timed out. A timeout of 0, the default, waits indefinitely.
+func (h *HCI) SetConnectTimeout(t time.Duration) {
+	h.wlmu.Lock()
+	h.connTimeout = t
+	h.wlmu.Unlock()
+}
+
+// Connect queues an outgoing connection to pd. The controller creates a
+// single connection at a time, so the connections are initiated in turn, or
+// several at once with SetConnectMultiple. Once connected, pd is reported to
+// the AcceptSlaveHandler; otherwise to the ConnectFailedHandler.
+func (h *HCI) Connect(pd *PlatData) error {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	for _, t := range append(h.connTargets, h.connq...) {
+		if t == pd {
+			return nil
+		}
+	}
+	h.connq = append(h.connq, pd)
+	if h.connPending && h.connViaWL && !h.connCanceling {
+		// Restart the pending connection, with pd in the white list.
+		h.connErr = nil
+		h.connCanceling = true
+		h.c.Send(cmd.LECreateConnCancel{})
+	}
+	h.connectNext()
+	return nil
+}
+
+// cancelConnect cancels the outgoing connection to pd, and reports whether
+// it was queued or being created.
+func (h *HCI) cancelConnect(pd *PlatData) bool {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	if i := indexOf(h.connq, pd); i >= 0 {
+		h.connq = append(h.connq[:i], h.connq[i+1:]...)
+		go h.connectFailed(pd, ErrConnectCanceled)
+		return true
+	}
+	i := indexOf(h.connTargets, pd)
+	if i < 0 {
+		return false
+	}
+	h.connTargets = append(h.connTargets[:i], h.connTargets[i+1:]...)
+	go h.connectFailed(pd, ErrConnectCanceled)
+	// The other targets, if any, are requeued when the cancel completes.
+	h.connErr = nil
+	h.c.Send(cmd.LECreateConnCancel{})
+	return true
+}
+
+// connectNext creates the connections to the next targets queued, unless a
+// connection is already being created. h.wlmu must be held.
+func (h *HCI) connectNext() {
+	for !h.connPending && !h.wlConnect && len(h.connq) > 0 {
+		n, viaWL := 1, false
+		if h.connMulti {
+			if room := h.whiteListRoom(); room > 0 {
+				n, viaWL = room, true
+			}
+		}
+		if n > len(h.connq) {
+			n = len(h.connq)
+		}
+		var err error
+		if viaWL {
+			h.connTargets = append([]*PlatData(nil), h.connq[:n]...)
+			h.connq = h.connq[n:]
+			h.connViaWL = true
+			err = h.createConnWL()
+		} else {
+			h.connTargets = []*PlatData{h.connq[0]}
+			h.connq = h.connq[1:]
+			h.connViaWL = false
+			err = h.createConn(h.connTargets[0])
+		}
+		if err != nil {
+			for _, pd := range h.connTargets {
+				go h.connectFailed(pd, err)
+			}
+			h.connTargets = nil
+			h.removeConnWL()
+			continue
+		}
+		h.connPending = true
+		h.connCanceling = false
+		h.connErr = nil
+		h.connGen++
+		if h.connTimeout > 0 {
+			gen := h.connGen
+			h.connTimer = time.AfterFunc(h.connTimeout, func() { h.connectTimedOut(gen) })
+		}
+	}
+}
+
+// whiteListRoom returns the number of entries left in the white list.
+func (h *HCI) whiteListRoom() int {
+	n, err := h.WhiteListSize()
+	if err != nil {
+		return 0
+	}
+	return n - len(h.wl)
+}
+
+func (h *HCI) createConn(pd *PlatData) error {
+	t, a := h.peerAddress(pd)
+	return h.sendCreateConn(
+		cmd.LECreateConn{
+			LEScanInterval:        0x0004,   // N x 0.625ms
+			LEScanWindow:          0x0004,   // N x 0.625ms
+			InitiatorFilterPolicy: 0x00,     // white list not used
+			PeerAddressType:       uint8(t), // public or random, or their identity
+			PeerAddress:           a,        //
+			OwnAddressType:        0x00,     // public
+			ConnIntervalMin:       0x0006,   // N x 0.125ms
+			ConnIntervalMax:       0x0006,   // N x 0.125ms
+			ConnLatency:           0x0000,   //
+			SupervisionTimeout:    0x0048,   // N x 10ms
+			MinimumCELength:       0x0000,   // N x 0.625ms
+			MaximumCELength:       0x0000,   // N x 0.625ms
+		})
+}
+
+// sendCreateConn sends the LE Create Connection c, or its extended
+// equivalent once the extended commands are used, as the controller then
+// rejects the legacy one. The extended connection is initiated on the PHYs
+// scanned, or the LE 1M PHY if the extended scanning isn't used, with the
+// same parameters on each.
+func (h *HCI) sendCreateConn(c cmd.LECreateConn) error {
+	if !h.extScan && !h.ExtendedMode() {
+		return h.c.SendAndCheckResp(c, []byte{0x00})
+	}
+	phys := h.scanPHYs
+	if !h.extScan {
+		phys = cmd.PHY1MBit
+	}
+	ec := cmd.LEExtendedCreateConn{
+		InitiatorFilterPolicy: c.InitiatorFilterPolicy,
+		OwnAddressType:        c.OwnAddressType,
+		PeerAddressType:       c.PeerAddressType,
+		PeerAddress:           c.PeerAddress,
+		InitiatingPHYs:        phys,
+	}
+	for _, bit := range []uint8{cmd.PHY1MBit, cmd.PHY2MBit, cmd.PHYCodedBit} {
+		if phys&bit == 0 {
+			continue
+		}
+		ec.PHYs = append(ec.PHYs, cmd.ExtendedConnPHY{
+			ScanInterval:       c.LEScanInterval,
+			ScanWindow:         c.LEScanWindow,
+			ConnIntervalMin:    c.ConnIntervalMin,
+			ConnIntervalMax:    c.ConnIntervalMax,
+			ConnLatency:        c.ConnLatency,
+			SupervisionTimeout: c.SupervisionTimeout,
+			MinimumCELength:    c.MinimumCELength,
+			MaximumCELength:    c.MaximumCELength,
+		})
+	}
+	return h.c.SendAndCheckResp(ec, []byte{0x00})
+}
+
+// createConnWL adds the targets to the white list, and creates a connection
+// to whichever of them shows up first.
+func (h *HCI) createConnWL() error {
+	err := h.sendWithRadioOff(func() error {
+		for _, pd := range h.connTargets {
+			t, a := h.peerAddress(pd)
+			if _, ok := h.wl[a]; ok {
+				continue
+			}
+			t &= 0x01 // public or random, or their identity once resolved
+			if err := h.c.SendAndCheckResp(cmd.LEAddDeviceToWhiteList{AddressType: uint8(t), Address: a}, []byte{0x00}); err != nil {
+				return err
+			}
+			h.wl[a] = t
+			h.connWL = append(h.connWL, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return h.connectWhiteList()
+}
+
+// removeConnWL removes the white list entries added for targets which are
+// no longer queued.
+func (h *HCI) removeConnWL() {
+	var keep, drop []bdaddr
+	for _, a := range h.connWL {
+		queued := false
+		for _, pd := range h.connq {
+			if _, pa := h.peerAddress(pd); pa == a {
+				queued = true
+				break
+			}
+		}
+		if queued {
+			keep = append(keep, a)
+		} else {
+			drop = append(drop, a)
+		}
+	}
+	h.connWL = keep
+	if len(drop) == 0 {
+		return
+	}
+	h.sendWithRadioOff(func() error {
+		for _, a := range drop {
+			h.c.SendAndCheckResp(cmd.LERemoveDeviceFromWhiteList{AddressType: uint8(h.wl[a]), Address: a}, []byte{0x00})
+			delete(h.wl, a)
+		}
+		return nil
+	})
+}
+
+func (h *HCI) connectTimedOut(gen int) {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	if !h.connPending || h.connGen != gen {
+		return
+	}
+	h.connErr = ErrConnectTimeout
+	h.c.Send(cmd.LECreateConnCancel{})
+}
+
+// connectCompleted updates the outgoing connections when an LE Create
+// Connection completes, and creates the next ones. It returns the target
+// connected to, if any, and whether the white list was used to connect.
+func (h *HCI) connectCompleted(ep *evt.LEConnectionCompleteEP) (*PlatData, bool) {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	wl := h.wlConnect || (h.connPending && h.connViaWL)
+	h.wlConnect = false
+	if !h.connPending {
+		h.connectNext()
+		return nil, wl
+	}
+	if h.connTimer != nil {
+		h.connTimer.Stop()
+		h.connTimer = nil
+	}
+	h.connPending = false
+
+	var pd *PlatData
+	tgts := h.connTargets
+	h.connTargets = nil
+	switch {
+	case ep.Status == 0x00 && !h.connViaWL:
+		// A direct connection can't complete to anything but its target.
+		if len(tgts) > 0 {
+			pd = tgts[0]
+		}
+		tgts = nil
+	case ep.Status == 0x00:
+		for i, t := range tgts {
+			if t.Address == ep.PeerAddress || (t.Resolved && t.IdentityAddress == ep.PeerAddress) {
+				pd = t
+				tgts = append(tgts[:i:i], tgts[i+1:]...)
+				break
+			}
+		}
+	case ep.Status == 0x02 && h.connErr == nil:
+		// Canceled to cancel some of the targets, or to change the white list.
+	default:
+		err := h.connErr
+		if ep.Status != 0x02 {
+			err = constants.HCIStatus(ep.Status)
+		}
+		for _, t := range tgts {
+			go h.connectFailed(t, err)
+		}
+		tgts = nil
+	}
+	h.connq = append(tgts, h.connq...)
+	h.removeConnWL()
+	h.connectNext()
+	return pd, wl
+}
+
+func (h *HCI) connectFailed(pd *PlatData, err error) {
+	if h.ConnectFailedHandler != nil {
+		h.ConnectFailedHandler(pd, err)
+	}
+}
+
+func indexOf(pds []*PlatData, pd *PlatData) int {
+	for i, t := range pds {
+		if t == pd {
+			return i
+		}
+	}
+	return -1
+}
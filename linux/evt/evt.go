@@ -130,12 +130,20 @@ const (
 type LEEventCode int
 
 const (
-	LEConnectionComplete               LEEventCode = 0x01 // LE Connection Complete
-	LEAdvertisingReport                            = 0x02 // LE Advertising Report
-	LEConnectionUpdateComplete                     = 0x03 // LE Connection Update Complete
-	LEReadRemoteUsedFeaturesComplete               = 0x04 // LE Read Remote Used Features Complete
-	LELTKRequest                                   = 0x05 // LE LTK Request
-	LERemoteConnectionParameterRequest             = 0x06 // LE Remote Connection Parameter Request
+	LEConnectionComplete                 LEEventCode = 0x01 // LE Connection Complete
+	LEAdvertisingReport                              = 0x02 // LE Advertising Report
+	LEConnectionUpdateComplete                       = 0x03 // LE Connection Update Complete
+	LEReadRemoteUsedFeaturesComplete                 = 0x04 // LE Read Remote Used Features Complete
+	LELTKRequest                                     = 0x05 // LE LTK Request
+	LERemoteConnectionParameterRequest               = 0x06 // LE Remote Connection Parameter Request
+	LEDataLengthChange                               = 0x07 // LE Data Length Change
+	LEPHYUpdateComplete                              = 0x0C // LE PHY Update Complete
+	LEExtendedAdvertisingReport                      = 0x0D // LE Extended Advertising Report
+	LEPeriodicAdvertisingSyncEstablished             = 0x0E // LE Periodic Advertising Sync Established
+	LEPeriodicAdvertisingReport                      = 0x0F // LE Periodic Advertising Report
+	LEPeriodicAdvertisingSyncLost                    = 0x10 // LE Periodic Advertising Sync Lost
+	LEAdvertisingSetTerminated                       = 0x12 // LE Advertising Set Terminated
+	LEScanRequestReceived                            = 0x13 // LE Scan Request Received
 )
 
 type EventHeader struct {
@@ -200,6 +208,25 @@ func (e *DisconnectionCompleteEP) Unmarshal(b []byte) error {
 	return binary.Read(buf, binary.LittleEndian, &e.Reason)
 }
 
+type EncryptionChangeEP struct {
+	Status            uint8
+	ConnectionHandle  uint16
+	EncryptionEnabled uint8
+}
+
+func (e *EncryptionChangeEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
+
+type EncryptionKeyRefreshCompleteEP struct {
+	Status           uint8
+	ConnectionHandle uint16
+}
+
+func (e *EncryptionKeyRefreshCompleteEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
+
 type CommandCompleteEP struct {
 	NumHCICommandPackets uint8
 	CommandOPCode        uint16
@@ -353,6 +380,80 @@ func (e *LEAdvertisingReportEP) Unmarshal(b []byte) error {
 	return nil
 }
 
+// Event Type bits of LE Extended Advertising Report.
+const (
+	ExtAdvConnectable  = 0x0001 // Connectable advertising
+	ExtAdvScannable    = 0x0002 // Scannable advertising
+	ExtAdvDirected     = 0x0004 // Directed advertising
+	ExtAdvScanResponse = 0x0008 // Scan response
+	ExtAdvLegacy       = 0x0010 // Legacy advertising PDUs used
+	ExtAdvDataStatus   = 0x0060 // Data status, one of the ExtAdvData* values
+)
+
+// Data status of LE Extended Advertising Report.
+const (
+	ExtAdvDataComplete   = 0x0000 // Complete
+	ExtAdvDataIncomplete = 0x0020 // Incomplete, more data to come
+	ExtAdvDataTruncated  = 0x0040 // Incomplete, data truncated, no more to come
+)
+
+// An ExtendedAdvertisingReport is a report of LE Extended Advertising Report.
+type ExtendedAdvertisingReport struct {
+	EventType                   uint16
+	AddressType                 constants.AddressType
+	Address                     [6]byte
+	PrimaryPHY                  uint8
+	SecondaryPHY                uint8 // 0x00: no packets on the secondary advertising channel
+	AdvertisingSID              uint8 // 0xFF: no ADI field in the PDU
+	TxPower                     int8  // 127: not available
+	RSSI                        int8  // 127: not available
+	PeriodicAdvertisingInterval uint16
+	DirectAddressType           uint8
+	DirectAddress               [6]byte
+	Data                        []byte
+}
+
+type LEExtendedAdvertisingReportEP struct {
+	SubeventCode uint8
+	NumReports   uint8
+	Reports      []ExtendedAdvertisingReport
+}
+
+func (e *LEExtendedAdvertisingReportEP) Unmarshal(b []byte) error {
+	if len(b) < 2 {
+		return errors.New("expected at least 2 bytes")
+	}
+	e.SubeventCode = o.Uint8(b)
+	e.NumReports = o.Uint8(b[1:])
+	b = b[2:]
+	e.Reports = make([]ExtendedAdvertisingReport, e.NumReports)
+	for i := range e.Reports {
+		if len(b) < 24 {
+			return fmt.Errorf("expected at least 24 more bytes, got %d", len(b))
+		}
+		r := &e.Reports[i]
+		r.EventType = o.Uint16(b[0:])
+		r.AddressType = constants.AddressType(o.Uint8(b[2:]))
+		r.Address = o.MAC(b[3:])
+		r.PrimaryPHY = o.Uint8(b[9:])
+		r.SecondaryPHY = o.Uint8(b[10:])
+		r.AdvertisingSID = o.Uint8(b[11:])
+		r.TxPower = o.Int8(b[12:])
+		r.RSSI = o.Int8(b[13:])
+		r.PeriodicAdvertisingInterval = o.Uint16(b[14:])
+		r.DirectAddressType = o.Uint8(b[16:])
+		r.DirectAddress = o.MAC(b[17:])
+		n := int(o.Uint8(b[23:]))
+		b = b[24:]
+		if len(b) < n {
+			return fmt.Errorf("expected %d more bytes, got %d", n, len(b))
+		}
+		r.Data = append([]byte(nil), b[:n]...)
+		b = b[n:]
+	}
+	return nil
+}
+
 type LEConnectionUpdateCompleteEP struct {
 	SubeventCode       uint8
 	Status             uint8
@@ -400,3 +501,112 @@ type LERemoteConnectionParameterRequestEP struct {
 func (e *LERemoteConnectionParameterRequestEP) Unmarshal(b []byte) error {
 	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
 }
+
+type LEDataLengthChangeEP struct {
+	SubeventCode     uint8
+	ConnectionHandle uint16
+	MaxTxOctets      uint16
+	MaxTxTime        uint16
+	MaxRxOctets      uint16
+	MaxRxTime        uint16
+}
+
+func (e *LEDataLengthChangeEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
+
+type LEPHYUpdateCompleteEP struct {
+	SubeventCode     uint8
+	Status           uint8
+	ConnectionHandle uint16
+	TxPHY            uint8
+	RxPHY            uint8
+}
+
+func (e *LEPHYUpdateCompleteEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
+
+type LEPeriodicAdvertisingSyncEstablishedEP struct {
+	SubeventCode                uint8
+	Status                      uint8
+	SyncHandle                  uint16
+	AdvertisingSID              uint8
+	AdvertiserAddressType       uint8
+	AdvertiserAddress           [6]byte
+	AdvertiserPHY               uint8
+	PeriodicAdvertisingInterval uint16 // N x 1.25 ms
+	AdvertiserClockAccuracy     uint8
+}
+
+func (e *LEPeriodicAdvertisingSyncEstablishedEP) Unmarshal(b []byte) error {
+	if len(b) < 16 {
+		return fmt.Errorf("expected at least 16 bytes, got %d", len(b))
+	}
+	e.SubeventCode = o.Uint8(b[0:])
+	e.Status = o.Uint8(b[1:])
+	e.SyncHandle = o.Uint16(b[2:])
+	e.AdvertisingSID = o.Uint8(b[4:])
+	e.AdvertiserAddressType = o.Uint8(b[5:])
+	e.AdvertiserAddress = o.MAC(b[6:])
+	e.AdvertiserPHY = o.Uint8(b[12:])
+	e.PeriodicAdvertisingInterval = o.Uint16(b[13:])
+	e.AdvertiserClockAccuracy = o.Uint8(b[15:])
+	return nil
+}
+
+// The data status of the periodic advertising reports.
+const (
+	PeriodicAdvDataComplete   = 0x00 // Complete
+	PeriodicAdvDataIncomplete = 0x01 // Incomplete, more data to come
+	PeriodicAdvDataTruncated  = 0x02 // Incomplete, data truncated, no more to come
+)
+
+type LEPeriodicAdvertisingReportEP struct {
+	SubeventCode uint8
+	SyncHandle   uint16
+	TxPower      int8 // 127 if not available
+	RSSI         int8 // 127 if not available
+	CTEType      uint8
+	DataStatus   uint8
+	Data         []byte
+}
+
+func (e *LEPeriodicAdvertisingReportEP) Unmarshal(b []byte) error {
+	if len(b) < 8 {
+		return fmt.Errorf("expected at least 8 bytes, got %d", len(b))
+	}
+	e.SubeventCode = o.Uint8(b[0:])
+	e.SyncHandle = o.Uint16(b[1:])
+	e.TxPower = o.Int8(b[3:])
+	e.RSSI = o.Int8(b[4:])
+	e.CTEType = o.Uint8(b[5:])
+	e.DataStatus = o.Uint8(b[6:])
+	n := int(o.Uint8(b[7:]))
+	if len(b) < 8+n {
+		return fmt.Errorf("expected %d bytes of data, got %d", n, len(b)-8)
+	}
+	e.Data = append([]byte(nil), b[8:8+n]...)
+	return nil
+}
+
+type LEPeriodicAdvertisingSyncLostEP struct {
+	SubeventCode uint8
+	SyncHandle   uint16
+}
+
+func (e *LEPeriodicAdvertisingSyncLostEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
+
+type LEAdvertisingSetTerminatedEP struct {
+	SubeventCode                          uint8
+	Status                                uint8
+	AdvertisingHandle                     uint8
+	ConnectionHandle                      uint16
+	NumCompletedExtendedAdvertisingEvents uint8
+}
+
+func (e *LEAdvertisingSetTerminatedEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
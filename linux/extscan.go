@@ -0,0 +1,145 @@
+package linux
+
+import (
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/linux/cmd"
+	"github.com/grutz/gatt/linux/evt"
+)
+
+// An extAdvKey identifies the advertisements of an advertiser, whose data
+// is reassembled from several reports.
+type extAdvKey struct {
+	addr bdaddr
+	sid  uint8
+	rsp  bool // scan response
+}
+
+// SetExtendedScanParameters sets the parameters of the extended scanning,
+// and uses the extended scanning commands from then on, see ExtendedMode. The advertisements
+// are then reported with the extended advertising fields of PlatData set,
+// and the connections are initiated on the PHYs scanned.
+func (h *HCI) SetExtendedScanParameters(p cmd.LESetExtendedScanParameters) error {
+	if !h.SupportsExtendedAdvertising() {
+		return ErrNotSupported
+	}
+	if p.ScanningPHYs&cmd.ScanPHYCoded != 0 && !h.SupportsCodedPHY() {
+		return ErrNotSupported
+	}
+	h.advmu.Lock()
+	err := h.useExtended()
+	h.advmu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := h.c.SendAndCheckResp(p, []byte{0x00}); err != nil {
+		return err
+	}
+	h.extScan = true
+	h.scanPHYs = p.ScanningPHYs
+	return nil
+}
+
+func (h *HCI) setExtendedScanEnable(en bool, dup bool) error {
+	h.plistmu.Lock()
+	h.extAdv = map[extAdvKey]*PlatData{}
+	h.plistmu.Unlock()
+	return h.c.SendAndCheckResp(
+		cmd.LESetExtendedScanEnable{
+			Enable:           btoi(en),
+			FilterDuplicates: btoi(!dup),
+		}, []byte{0x00})
+}
+
+// isExtAdvReport reports whether the event packet b is an LE Extended
+// Advertising Report.
+func isExtAdvReport(b []byte) bool {
+	return len(b) >= 3 && b[0] == evt.LEMeta && int(b[1]) == len(b)-2 && b[2] == evt.LEExtendedAdvertisingReport
+}
+
+// handleExtAdvertisement reassembles the data of the extended advertising
+// reports, and reports the complete advertisements. It must be called in
+// the order the events are received, as the data of an advertisement might
+// span several of them.
+func (h *HCI) handleExtAdvertisement(b []byte) {
+	// If no one is interested, don't bother.
+	if h.AdvertisementHandler == nil {
+		return
+	}
+	ep := &evt.LEExtendedAdvertisingReportEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	for _, r := range ep.Reports {
+		if pd := h.reassembleExtAdv(r); pd != nil {
+			go h.AdvertisementHandler(pd)
+		}
+	}
+}
+
+// reassembleExtAdv adds the report r to the advertisement it belongs to, and
+// returns the advertisement once its data is complete, or truncated.
+func (h *HCI) reassembleExtAdv(r evt.ExtendedAdvertisingReport) *PlatData {
+	h.plistmu.Lock()
+	defer h.plistmu.Unlock()
+	addr := bdaddr(r.Address)
+	et := r.EventType
+	k := extAdvKey{addr: addr, sid: r.AdvertisingSID, rsp: et&evt.ExtAdvScanResponse != 0}
+
+	pd, ok := h.extAdv[k]
+	if !ok {
+		pd = &PlatData{
+			AddressType:      r.AddressType,
+			Address:          r.Address,
+			Extended:         true,
+			PrimaryPHY:       r.PrimaryPHY,
+			SecondaryPHY:     r.SecondaryPHY,
+			SID:              r.AdvertisingSID,
+			TxPower:          r.TxPower,
+			PeriodicInterval: r.PeriodicAdvertisingInterval,
+		}
+		if h.extAdv == nil {
+			h.extAdv = map[extAdvKey]*PlatData{}
+		}
+		h.extAdv[k] = pd
+	}
+	pd.Data = append(pd.Data, r.Data...)
+	pd.RSSI = r.RSSI
+	switch et & evt.ExtAdvDataStatus {
+	case evt.ExtAdvDataIncomplete:
+		return nil
+	case evt.ExtAdvDataTruncated:
+		pd.Truncated = true
+	}
+	delete(h.extAdv, k)
+
+	if k.rsp {
+		// Report the advertisement it answers, with the scan response appended.
+		// The advertisement stored has already been reported, so it's left
+		// as is: a copy is reported instead.
+		adv, ok := h.plist[addr]
+		if !ok {
+			return nil
+		}
+		c := *adv
+		c.Data = append(append(make([]byte, 0, len(adv.Data)+len(pd.Data)), adv.Data...), pd.Data...)
+		c.RSSI = pd.RSSI
+		c.Truncated = adv.Truncated || pd.Truncated
+		return &c
+	}
+
+	pd.Connectable = et&evt.ExtAdvConnectable != 0
+	pd.Scannable = et&evt.ExtAdvScannable != 0
+	switch {
+	case pd.Connectable && et&evt.ExtAdvDirected != 0:
+		pd.EventType = constants.AdvDirectInd
+	case pd.Connectable:
+		pd.EventType = constants.AdvInd
+	case pd.Scannable:
+		pd.EventType = constants.AdvScanInd
+	default:
+		pd.EventType = constants.AdvNonconnInd
+	}
+	pd.resolvedByController()
+	h.plist[addr] = pd
+	return pd
+}
@@ -1,10 +1,13 @@
 package linux
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/grutz/gatt/constants"
 	"github.com/grutz/gatt/linux/cmd"
@@ -18,6 +21,35 @@ type HCI struct {
 	AcceptSlaveHandler   func(pd *PlatData)
 	AdvertisementHandler func(pd *PlatData)
 
+	// ConnectFailedHandler is called when an outgoing connection requested
+	// with Connect fails, times out, or is canceled.
+	ConnectFailedHandler func(pd *PlatData, err error)
+
+	// EncryptionChangeHandler is called when the encryption of a connection
+	// is turned on or off, or its key is refreshed.
+	EncryptionChangeHandler func(pd *PlatData, encrypted bool, err error)
+
+	// LTKRequestHandler is called when a master requests the Long Term Key
+	// identified by rand and ediv to encrypt a connection. It returns the key,
+	// most significant octet first, or false if it doesn't have one.
+	LTKRequestHandler func(pd *PlatData, rand uint64, ediv uint16) ([16]byte, bool)
+
+	// ConnParamsRequestHandler is called when a remote device requests to
+	// update the parameters of a connection with valid values, either with
+	// an L2CAP Connection Parameter Update Request or with the Connection
+	// Parameters Request procedure of the link layer. It returns the
+	// parameters to apply, possibly modified, or false to reject the update.
+	// All valid requests are accepted as is if it is not set.
+	ConnParamsRequestHandler func(pd *PlatData, p ConnParams) (ConnParams, bool)
+
+	// ConnInfoChangeHandler is called when the parameters of a connection
+	// are updated, or its data length changes.
+	ConnInfoChangeHandler func(pd *PlatData, ci ConnInfo)
+
+	// AdvertisingTimeoutHandler is called when the high duty cycle directed
+	// advertising ends without a connection.
+	AdvertisingTimeoutHandler func()
+
 	d io.ReadWriteCloser
 	c *cmd.Cmd
 	e *evt.Evt
@@ -25,8 +57,8 @@ type HCI struct {
 	plist   map[bdaddr]*PlatData
 	plistmu *sync.Mutex
 
-	bufCnt  chan struct{}
-	bufSize int
+	tx      *aclScheduler
+	bufSize int // maximum length of the ACL data packets the controller accepts
 
 	pool     *util.BytePool
 	loopDone chan bool
@@ -35,8 +67,49 @@ type HCI struct {
 	connsmu *sync.Mutex
 	conns   map[uint16]*conn
 
-	adv   bool
-	advmu *sync.Mutex
+	adv            bool
+	advOwnAddrType uint8             // own address type of the advertising parameters
+	advNonConn     bool              // the advertising parameters aren't connectable
+	advSets        map[uint8]*advSet // extended advertising sets, by handle
+	maxAdvDataLen  int               // maximum length of the data of an advertising set
+	extended       bool              // the extended advertising or scanning commands are used
+	advmu          *sync.Mutex
+
+	scan     bool
+	scanDup  bool
+	extScan  bool                    // the extended scanning commands are used
+	scanPHYs uint8                   // PHYs of the extended scanning, and of the connections initiated
+	extAdv   map[extAdvKey]*PlatData // extended advertisements being reassembled, guarded by plistmu
+
+	syncs        map[uint16]*PeriodicSync // periodic advertising syncs, by handle
+	syncc        chan syncResult          // receives the outcome of the pending LE Periodic Advertising Create Sync
+	syncmu       *sync.Mutex
+	createSyncmu *sync.Mutex // serializes the LE Periodic Advertising Create Sync
+
+	rl   map[bdaddr]bool // identity addresses in the resolving list of the controller
+	rlmu *sync.Mutex
+
+	wl        map[bdaddr]constants.AddressType
+	wlmu      *sync.Mutex
+	wlConnect bool // a connection to the white listed devices is being initiated
+
+	// The outgoing connections are guarded by wlmu, as they might use the white list.
+	connq         []*PlatData   // targets waiting to be connected, in order
+	connTargets   []*PlatData   // targets of the LE Create Connection pending
+	connPending   bool          // an LE Create Connection is pending
+	connCanceling bool          // the pending LE Create Connection is being canceled
+	connViaWL     bool          // the pending LE Create Connection uses the white list
+	connWL        []bdaddr      // white list entries added for the targets
+	connErr       error         // reported to the targets left if the pending connection is canceled
+	connGen       int           // generation of the pending LE Create Connection, for its timer
+	connTimer     *time.Timer   // cancels the pending LE Create Connection on timeout
+	connMulti     bool          // connect to several targets at once, through the white list
+	connTimeout   time.Duration // timeout of each LE Create Connection, if not 0
+
+	leFeatures uint64
+
+	cocmu        *sync.Mutex
+	cocListeners map[uint16]*CoCListener
 }
 
 type bdaddr [6]byte
@@ -51,9 +124,66 @@ type PlatData struct {
 	Scannable   bool
 	RSSI        int8
 
+	// Resolved is set if Address is a resolvable private address that has
+	// been resolved, either by the controller or by the host, to the
+	// identity address IdentityAddress.
+	Resolved            bool
+	IdentityAddressType constants.AddressType
+	IdentityAddress     [6]byte
+
+	// The following are only reported by the extended scanning.
+	Extended         bool   // reported by an LE Extended Advertising Report
+	PrimaryPHY       uint8  // 0x01: LE 1M, 0x03: LE Coded
+	SecondaryPHY     uint8  // 0x00: none, 0x01: LE 1M, 0x02: LE 2M, 0x03: LE Coded
+	SID              uint8  // advertising set identifier, 0xFF: none
+	TxPower          int8   // 127: not available
+	PeriodicInterval uint16 // interval of the periodic advertising, N x 1.25 ms, 0: none
+	Truncated        bool   // the data was truncated by the controller
+
 	Conn io.ReadWriteCloser
 }
 
+// ResolvingListEntry is a peer identity that the controller resolves
+// private addresses for.
+type ResolvingListEntry struct {
+	AddressType constants.AddressType // public or random (static) identity address
+	Address     [6]byte
+	IRK         [16]byte // most significant octet first
+}
+
+// ErrNotSupported is returned when the controller lacks a feature.
+var ErrNotSupported = errors.New("not supported by controller")
+
+// ErrExtendedMode is returned by the legacy advertising commands once the
+// extended advertising or scanning commands are used, as the controller
+// then disallows the legacy ones until it is reset.
+var ErrExtendedMode = errors.New("legacy advertising unavailable once the extended commands are used")
+
+// ErrLegacyMode is returned when switching to the extended advertising or
+// scanning commands while the legacy advertising or scanning is enabled.
+var ErrLegacyMode = errors.New("extended commands unavailable while the legacy advertising or scanning is enabled")
+
+// LE supported features (Vol 6, Part B, 4.6)
+const (
+	leFeatureDataLengthExtension = 1 << 5
+	leFeatureLLPrivacy           = 1 << 6
+	leFeature2MPHY               = 1 << 8
+	leFeatureCodedPHY            = 1 << 11
+	leFeatureExtendedAdvertising = 1 << 12
+	leFeaturePeriodicAdvertising = 1 << 13
+)
+
+// resolvedByController fills in the identity address of pd if the
+// controller reported a resolved identity address instead of a private one.
+func (pd *PlatData) resolvedByController() {
+	switch pd.AddressType {
+	case constants.AddressTypePublicIdentity, constants.AddressTypeRandomStatic:
+		pd.Resolved = true
+		pd.IdentityAddressType = pd.AddressType - constants.AddressTypePublicIdentity
+		pd.IdentityAddress = pd.Address
+	}
+}
+
 func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
 	d, err := newDevice(devID, chk)
 	if err != nil {
@@ -70,7 +200,7 @@ func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
 		plist:   make(map[bdaddr]*PlatData),
 		plistmu: &sync.Mutex{},
 
-		bufCnt:  make(chan struct{}, 15-1),
+		tx:      newACLScheduler(d, 15-1),
 		bufSize: 27,
 
 		pool:     util.NewBytePool(4096, 16),
@@ -80,16 +210,33 @@ func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
 		connsmu: &sync.Mutex{},
 		conns:   map[uint16]*conn{},
 
-		advmu: &sync.Mutex{},
+		advmu:   &sync.Mutex{},
+		advSets: map[uint8]*advSet{},
+
+		syncs:        map[uint16]*PeriodicSync{},
+		syncmu:       &sync.Mutex{},
+		createSyncmu: &sync.Mutex{},
+
+		rl:   map[bdaddr]bool{},
+		rlmu: &sync.Mutex{},
+
+		wl:   map[bdaddr]constants.AddressType{},
+		wlmu: &sync.Mutex{},
+
+		cocmu:        &sync.Mutex{},
+		cocListeners: map[uint16]*CoCListener{},
 	}
 
 	e.HandleEvent(evt.LEMeta, evt.HandlerFunc(h.handleLEMeta))
 	e.HandleEvent(evt.DisconnectionComplete, evt.HandlerFunc(h.handleDisconnectionComplete))
 	e.HandleEvent(evt.NumberOfCompletedPkts, evt.HandlerFunc(h.handleNumberOfCompletedPkts))
+	e.HandleEvent(evt.EncryptionChange, evt.HandlerFunc(h.handleEncryptionChange))
+	e.HandleEvent(evt.EncryptionKeyRefreshComplete, evt.HandlerFunc(h.handleEncryptionKeyRefreshComplete))
 	e.HandleEvent(evt.CommandComplete, evt.HandlerFunc(c.HandleComplete))
 	e.HandleEvent(evt.CommandStatus, evt.HandlerFunc(c.HandleStatus))
 
 	go h.mainLoop()
+	go h.tx.loop()
 	h.resetDevice()
 	return h, nil
 }
@@ -99,6 +246,7 @@ func (h *HCI) Close() error {
 	h.pool.Close()
 	<-h.loopDone
 	log.Printf("mainLoop exited")
+	h.tx.close()
 	for _, c := range h.conns {
 		log.Printf("closing connection %v", c)
 		c.Close()
@@ -109,6 +257,13 @@ func (h *HCI) Close() error {
 
 func (h *HCI) SetAdvertiseEnable(en bool) error {
 	h.advmu.Lock()
+	if h.extended {
+		h.advmu.Unlock()
+		if en {
+			return ErrExtendedMode
+		}
+		return nil
+	}
 	h.adv = en
 	h.advmu.Unlock()
 	return h.setAdvertiseEnable(en)
@@ -117,7 +272,11 @@ func (h *HCI) SetAdvertiseEnable(en bool) error {
 func (h *HCI) setAdvertiseEnable(en bool) error {
 	h.advmu.Lock()
 	defer h.advmu.Unlock()
-	if en && h.adv && (len(h.conns) == h.maxConn) {
+	if h.extended {
+		// The legacy advertising is off.
+		return nil
+	}
+	if en && h.adv && !h.advNonConn && h.connected() >= h.maxConn {
 		return nil
 	}
 	return h.c.SendAndCheckResp(
@@ -126,9 +285,93 @@ func (h *HCI) setAdvertiseEnable(en bool) error {
 		}, []byte{0x00})
 }
 
+// connected returns the number of connections established.
+func (h *HCI) connected() int {
+	h.connsmu.Lock()
+	defer h.connsmu.Unlock()
+	return len(h.conns)
+}
+
+// resumeAdvertising re-enables advertising after a connection is established
+// or lost, if the application advertises and more connections can be
+// accepted. The controller stops advertising once connected as a slave.
+// The connectable advertising sets are restarted, or stopped, likewise.
+// The non-connectable advertising goes on regardless.
+func (h *HCI) resumeAdvertising() {
+	h.advmu.Lock()
+	adv := h.adv && !h.advNonConn
+	h.resumeAdvertisingSets()
+	h.advmu.Unlock()
+	if adv {
+		h.setAdvertiseEnable(true)
+	}
+}
+
+// AdvertisingPaused reports whether the advertising is enabled, but paused
+// until a connection is lost, as no more connections can be accepted.
+func (h *HCI) AdvertisingPaused() bool {
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	return h.adv && !h.advNonConn && h.connected() >= h.maxConn
+}
+
+// SetAdvertisingData sends the LE Set Advertising Data, or LE Set Scan
+// Response Data, command c. Unlike the advertising parameters, the data can
+// be changed while advertising; the controller uses it from the next
+// advertising event.
+func (h *HCI) SetAdvertisingData(c cmd.CmdParam) error {
+	if h.ExtendedMode() {
+		return ErrExtendedMode
+	}
+	return h.c.SendAndCheckResp(c, []byte{0x00})
+}
+
+// ExtendedMode reports whether the extended advertising or scanning
+// commands are used. The scanning and the connections then use the
+// extended commands, and the legacy advertising is unavailable.
+func (h *HCI) ExtendedMode() bool {
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	return h.extended
+}
+
+// CanUseExtended reports whether the extended advertising and scanning
+// commands are used, or can be, as the controller supports them and the
+// legacy advertising and scanning are disabled.
+func (h *HCI) CanUseExtended() bool {
+	if !h.SupportsExtendedAdvertising() {
+		return false
+	}
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	return h.extended || !(h.adv || (h.scan && !h.extScan))
+}
+
+// useExtended switches to the extended advertising and scanning commands,
+// unless the legacy advertising or scanning is enabled. h.advmu must be held.
+func (h *HCI) useExtended() error {
+	if h.extended {
+		return nil
+	}
+	if h.adv || (h.scan && !h.extScan) {
+		return ErrLegacyMode
+	}
+	h.extended = true
+	return nil
+}
+
 func (h *HCI) SendCmdWithAdvOff(c cmd.CmdParam) error {
+	if _, ok := c.(*cmd.LESetAdvertisingParameters); ok && h.ExtendedMode() {
+		return ErrExtendedMode
+	}
 	h.setAdvertiseEnable(false)
 	err := h.c.SendAndCheckResp(c, nil)
+	if p, ok := c.(*cmd.LESetAdvertisingParameters); ok && err == nil {
+		h.advmu.Lock()
+		h.advOwnAddrType = p.OwnAddressType
+		h.advNonConn = p.AdvertisingType == cmd.AdvScanInd || p.AdvertisingType == cmd.AdvNonconnInd
+		h.advmu.Unlock()
+	}
 	if h.adv {
 		h.setAdvertiseEnable(true)
 	}
@@ -136,6 +379,14 @@ func (h *HCI) SendCmdWithAdvOff(c cmd.CmdParam) error {
 }
 
 func (h *HCI) SetScanEnable(en bool, dup bool) error {
+	h.scan, h.scanDup = en, dup
+	return h.setScanEnable(en, dup)
+}
+
+func (h *HCI) setScanEnable(en bool, dup bool) error {
+	if h.extScan {
+		return h.setExtendedScanEnable(en, dup)
+	}
 	return h.c.SendAndCheckResp(
 		cmd.LESetScanEnable{
 			LEScanEnable:     btoi(en),
@@ -143,32 +394,250 @@ func (h *HCI) SetScanEnable(en bool, dup bool) error {
 		}, []byte{0x00})
 }
 
-func (h *HCI) Connect(pd *PlatData) error {
-	h.c.Send(
+// sendWithRadioOff runs f with advertising and scanning disabled, which is
+// required by the controller for changing the resolving and white lists.
+// Advertising and scanning are restored afterwards.
+func (h *HCI) sendWithRadioOff(f func() error) error {
+	h.setAdvertiseEnable(false)
+	if h.scan {
+		h.setScanEnable(false, h.scanDup)
+	}
+	err := f()
+	if h.scan {
+		h.setScanEnable(true, h.scanDup)
+	}
+	if h.adv {
+		h.setAdvertiseEnable(true)
+	}
+	return err
+}
+
+// SupportsAddressResolution reports whether the controller can resolve
+// private addresses itself (LL Privacy).
+func (h *HCI) SupportsAddressResolution() bool {
+	return h.leFeatures&leFeatureLLPrivacy != 0
+}
+
+// SetResolvingList replaces the resolving list of the controller with rl,
+// and enables address resolution if rl is not empty. Entries that don't fit
+// in the controller's resolving list are left to the host to resolve.
+func (h *HCI) SetResolvingList(rl []ResolvingListEntry) error {
+	if !h.SupportsAddressResolution() {
+		return ErrNotSupported
+	}
+	return h.sendWithRadioOff(func() error {
+		if err := h.c.SendAndCheckResp(cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}, []byte{0x00}); err != nil {
+			return err
+		}
+		if err := h.c.SendAndCheckResp(cmd.LEClearResolvingList{}, []byte{0x00}); err != nil {
+			return err
+		}
+		h.rlmu.Lock()
+		h.rl = map[bdaddr]bool{}
+		h.rlmu.Unlock()
+		if len(rl) == 0 {
+			return nil
+		}
+		rsp, err := h.c.Send(cmd.LEReadResolvingListSize{})
+		if err != nil {
+			return err
+		}
+		if len(rsp) < 2 || rsp[0] != 0x00 {
+			return fmt.Errorf("read resolving list size unexpected resp: %v", rsp)
+		}
+		if n := int(rsp[1]); len(rl) > n {
+			log.Printf("resolving list holds %d entries, %d left to the host", n, len(rl)-n)
+			rl = rl[:n]
+		}
+		for _, e := range rl {
+			c := cmd.LEAddDeviceToResolvingList{
+				PeerIdentityAddressType: uint8(e.AddressType),
+				PeerIdentityAddress:     e.Address,
+			}
+			for i := range e.IRK {
+				c.PeerIRK[i] = e.IRK[len(e.IRK)-1-i]
+			}
+			if err := h.c.SendAndCheckResp(c, []byte{0x00}); err != nil {
+				return err
+			}
+			h.rlmu.Lock()
+			h.rl[bdaddr(e.Address)] = true
+			h.rlmu.Unlock()
+		}
+		return h.c.SendAndCheckResp(cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 1}, []byte{0x00})
+	})
+}
+
+// peerAddress returns the address to initiate a connection to pd with. Once
+// the identity of pd is in the resolving list, it is its identity address,
+// as the controller then resolves the private address pd currently uses,
+// which may have changed since it was scanned.
+func (h *HCI) peerAddress(pd *PlatData) (constants.AddressType, bdaddr) {
+	if !pd.Resolved {
+		return pd.AddressType, bdaddr(pd.Address)
+	}
+	h.rlmu.Lock()
+	loaded := h.rl[bdaddr(pd.IdentityAddress)]
+	h.rlmu.Unlock()
+	if !loaded {
+		return pd.AddressType, bdaddr(pd.Address)
+	}
+	return constants.AddressTypePublicIdentity + pd.IdentityAddressType, bdaddr(pd.IdentityAddress)
+}
+
+// ConnectWhiteList initiates a connection to any of the devices in the white
+// list. The initiator stays active until one of them connects, or it is
+// canceled with CancelConnectWhiteList.
+func (h *HCI) ConnectWhiteList() error {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	if h.connPending {
+		return ErrConnectBusy
+	}
+	h.wlConnect = true
+	return h.connectWhiteList()
+}
+
+func (h *HCI) connectWhiteList() error {
+	return h.sendCreateConn(
 		cmd.LECreateConn{
-			LEScanInterval:        0x0004,                // N x 0.625ms
-			LEScanWindow:          0x0004,                // N x 0.625ms
-			InitiatorFilterPolicy: 0x00,                  // white list not used
-			PeerAddressType:       uint8(pd.AddressType), // public or random
-			PeerAddress:           pd.Address,            //
-			OwnAddressType:        0x00,                  // public
-			ConnIntervalMin:       0x0006,                // N x 0.125ms
-			ConnIntervalMax:       0x0006,                // N x 0.125ms
-			ConnLatency:           0x0000,                //
-			SupervisionTimeout:    0x0048,                // N x 10ms
-			MinimumCELength:       0x0000,                // N x 0.625ms
-			MaximumCELength:       0x0000,                // N x 0.625ms
+			LEScanInterval:        0x0004, // N x 0.625ms
+			LEScanWindow:          0x0004, // N x 0.625ms
+			InitiatorFilterPolicy: 0x01,   // white list used
+			OwnAddressType:        0x00,   // public
+			ConnIntervalMin:       0x0006, // N x 0.125ms
+			ConnIntervalMax:       0x0006, // N x 0.125ms
+			ConnLatency:           0x0000, //
+			SupervisionTimeout:    0x0048, // N x 10ms
+			MinimumCELength:       0x0000, // N x 0.625ms
+			MaximumCELength:       0x0000, // N x 0.625ms
 		})
-	return nil
+}
+
+// CancelConnectWhiteList cancels a pending ConnectWhiteList.
+func (h *HCI) CancelConnectWhiteList() error {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	if !h.wlConnect {
+		return nil
+	}
+	h.wlConnect = false
+	err := h.c.SendAndCheckResp(cmd.LECreateConnCancel{}, []byte{0x00})
+	h.connectNext()
+	return err
+}
+
+// WhiteList returns the devices currently in the white list.
+func (h *HCI) WhiteList() []PlatData {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	var l []PlatData
+	for a, t := range h.wl {
+		l = append(l, PlatData{AddressType: t, Address: a})
+	}
+	return l
+}
+
+// WhiteListSize returns the total number of entries the controller's white
+// list can hold.
+func (h *HCI) WhiteListSize() (int, error) {
+	rsp, err := h.c.Send(cmd.LEReadWhiteListSize{})
+	if err != nil {
+		return 0, err
+	}
+	if len(rsp) < 2 || rsp[0] != 0x00 {
+		return 0, fmt.Errorf("read white list size unexpected resp: %v", rsp)
+	}
+	return int(rsp[1]), nil
+}
+
+// AddToWhiteList adds a device to the white list.
+func (h *HCI) AddToWhiteList(t constants.AddressType, a [6]byte) error {
+	return h.updateWhiteList(func() error {
+		err := h.c.SendAndCheckResp(cmd.LEAddDeviceToWhiteList{AddressType: uint8(t), Address: a}, []byte{0x00})
+		if err == nil {
+			h.wl[a] = t
+		}
+		return err
+	})
+}
+
+// RemoveFromWhiteList removes a device from the white list.
+func (h *HCI) RemoveFromWhiteList(t constants.AddressType, a [6]byte) error {
+	return h.updateWhiteList(func() error {
+		err := h.c.SendAndCheckResp(cmd.LERemoveDeviceFromWhiteList{AddressType: uint8(t), Address: a}, []byte{0x00})
+		if err == nil {
+			delete(h.wl, a)
+		}
+		return err
+	})
+}
+
+// ClearWhiteList removes all the devices from the white list.
+func (h *HCI) ClearWhiteList() error {
+	return h.updateWhiteList(func() error {
+		err := h.c.SendAndCheckResp(cmd.LEClearWhiteList{}, []byte{0x00})
+		if err == nil {
+			h.wl = map[bdaddr]constants.AddressType{}
+		}
+		return err
+	})
+}
+
+// updateWhiteList runs f with advertising, scanning and white list initiating
+// suspended, as the controller doesn't allow changing the white list while
+// it's in use. They are resumed afterwards.
+func (h *HCI) updateWhiteList(f func() error) error {
+	h.wlmu.Lock()
+	defer h.wlmu.Unlock()
+	return h.sendWithRadioOff(func() error {
+		if h.wlConnect {
+			h.c.SendAndCheckResp(cmd.LECreateConnCancel{}, []byte{0x00})
+		}
+		if h.connPending && h.connViaWL {
+			// The targets are requeued when the cancel completes.
+			h.connErr = nil
+			h.c.SendAndCheckResp(cmd.LECreateConnCancel{}, []byte{0x00})
+		}
+		err := f()
+		if h.wlConnect {
+			h.connectWhiteList()
+		}
+		return err
+	})
 }
 
 func (h *HCI) CancelConnection(pd *PlatData) error {
+	if pd != nil && h.cancelConnect(pd) {
+		return nil
+	}
 	if pd != nil && pd.Conn != nil {
 		return pd.Conn.Close()
 	}
 	return nil
 }
 
+// ConnInfo returns the current state of the connection to pd, if any.
+func (h *HCI) ConnInfo(pd *PlatData) (ConnInfo, bool) {
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return ConnInfo{}, false
+	}
+	return c.connInfo(), true
+}
+
+// DisconnectReason returns the reason the connection to pd was lost, once it
+// is: a constants.HCIStatus, or nil if the connection was closed locally.
+func (h *HCI) DisconnectReason(pd *PlatData) error {
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
 func (h *HCI) SendRawCommand(c cmd.CmdParam) ([]byte, error) {
 	return h.c.Send(c)
 }
@@ -225,6 +694,16 @@ func (h *HCI) handlePacket(buf []byte, n int) {
 	case typSCODataPkt:
 		err = fmt.Errorf("SCO packet not supported")
 	case typEventPkt:
+		if isExtAdvReport(b) {
+			// Handled in order, as the data of an advertisement might span
+			// several reports.
+			h.handleExtAdvertisement(b[2:])
+			break
+		}
+		if isPeriodicAdvEvent(b) {
+			h.handlePeriodicAdvEvent(b[2:])
+			break
+		}
 		handled = false
 		go func() {
 			err := h.e.Dispatch(b)
@@ -250,7 +729,7 @@ func (h *HCI) resetDevice() error {
 	seq := []cmd.CmdParam{
 		cmd.Reset{},
 		cmd.SetEventMask{EventMask: 0x3dbff807fffbffff},
-		cmd.LESetEventMask{LEEventMask: 0x000000000000001F},
+		cmd.LESetEventMask{LEEventMask: 0x000000000002F87F},
 		cmd.WriteSimplePairingMode{SimplePairingMode: 1},
 		cmd.WriteLEHostSupported{LESupportedHost: 1, SimultaneousLEHost: 0},
 		cmd.WriteInquiryMode{InquiryMode: 2},
@@ -271,9 +750,201 @@ func (h *HCI) resetDevice() error {
 			return err
 		}
 	}
+	rsp, err := h.c.Send(cmd.LEReadLocalSupportedFeatures{})
+	if err != nil {
+		return err
+	}
+	if len(rsp) >= 9 && rsp[0] == 0x00 {
+		h.leFeatures = binary.LittleEndian.Uint64(rsp[1:])
+	}
+	if err := h.readBufferSize(); err != nil {
+		return err
+	}
+	if h.SupportsDataLengthExtension() {
+		// Let the controller use the longest packets it supports on new
+		// connections, unless told otherwise.
+		rsp, err := h.c.Send(cmd.LEReadMaximumDataLength{})
+		if err != nil {
+			return err
+		}
+		if len(rsp) >= 5 && rsp[0] == 0x00 {
+			h.SetDefaultDataLength(binary.LittleEndian.Uint16(rsp[1:]), binary.LittleEndian.Uint16(rsp[3:]))
+		}
+	}
+	if h.SupportsExtendedAdvertising() {
+		if err := h.readAdvertisingSetLimits(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBufferSize sizes the fragmentation and the flow control of the ACL
+// data from the buffers of the controller. The LE traffic shares the
+// buffers of the BR/EDR traffic if the controller has no dedicated LE ones.
+func (h *HCI) readBufferSize() error {
+	rsp, err := h.c.Send(cmd.LEReadBufferSize{})
+	if err != nil {
+		return err
+	}
+	if len(rsp) < 4 || rsp[0] != 0x00 {
+		return fmt.Errorf("LE read buffer size failed, [ % X ]", rsp)
+	}
+	size := int(binary.LittleEndian.Uint16(rsp[1:]))
+	cnt := int(rsp[3])
+	if size == 0 || cnt == 0 {
+		if rsp, err = h.c.Send(cmd.ReadBufferSize{}); err != nil {
+			return err
+		}
+		if len(rsp) < 8 || rsp[0] != 0x00 {
+			return fmt.Errorf("read buffer size failed, [ % X ]", rsp)
+		}
+		size = int(binary.LittleEndian.Uint16(rsp[1:]))
+		cnt = int(binary.LittleEndian.Uint16(rsp[4:]))
+	}
+	if size == 0 || cnt == 0 {
+		return fmt.Errorf("controller reported no ACL data buffers")
+	}
+	h.bufSize = size
+	h.tx.setBuffers(cnt)
+	return nil
+}
+
+// SupportsDataLengthExtension reports whether the controller can send and
+// receive LE data packets longer than 27 octets.
+func (h *HCI) SupportsDataLengthExtension() bool {
+	return h.leFeatures&leFeatureDataLengthExtension != 0
+}
+
+// SetDefaultDataLength sets the maximum number of payload octets, and the
+// maximum time in microseconds, the controller should use to transmit a
+// single LE data packet on new connections.
+func (h *HCI) SetDefaultDataLength(txOctets, txTime uint16) error {
+	if !h.SupportsDataLengthExtension() {
+		return ErrNotSupported
+	}
+	return h.c.SendAndCheckResp(cmd.LEWriteSuggestedDefaultDataLength{
+		SuggestedMaxTxOctets: txOctets,
+		SuggestedMaxTxTime:   txTime,
+	}, []byte{0x00})
+}
+
+// SetDataLength asks the controller to use LE data packets of up to
+// txOctets payload octets, and txTime microseconds, on the connection to pd.
+// The lengths actually used are negotiated with the remote device.
+func (h *HCI) SetDataLength(pd *PlatData, txOctets, txTime uint16) error {
+	if !h.SupportsDataLengthExtension() {
+		return ErrNotSupported
+	}
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return errors.New("not connected")
+	}
+	rsp, err := h.c.Send(cmd.LESetDataLength{
+		ConnectionHandle: c.attr,
+		TxOctets:         txOctets,
+		TxTime:           txTime,
+	})
+	if err != nil {
+		return err
+	}
+	if len(rsp) == 0 || rsp[0] != 0x00 {
+		return fmt.Errorf("LE set data length failed, [ % X ]", rsp)
+	}
 	return nil
 }
 
+func (h *HCI) handleDataLengthChange(b []byte) {
+	ep := &evt.LEDataLengthChangeEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	h.connsmu.Lock()
+	c, found := h.conns[ep.ConnectionHandle]
+	h.connsmu.Unlock()
+	if !found {
+		log.Printf("data length change: connection 0x%04X probably expired", ep.ConnectionHandle)
+		return
+	}
+	c.mu.Lock()
+	c.info.MaxTxOctets, c.info.MaxTxTime = ep.MaxTxOctets, ep.MaxTxTime
+	c.info.MaxRxOctets, c.info.MaxRxTime = ep.MaxRxOctets, ep.MaxRxTime
+	c.mu.Unlock()
+	h.connInfoChanged(c)
+}
+
+func (h *HCI) handleConnUpdateComplete(b []byte) {
+	ep := &evt.LEConnectionUpdateCompleteEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	if ep.Status != 0x00 {
+		log.Printf("connection update: 0x%04X failed, %v", ep.ConnectionHandle, constants.HCIStatus(ep.Status))
+		return
+	}
+	h.connsmu.Lock()
+	c, found := h.conns[ep.ConnectionHandle]
+	h.connsmu.Unlock()
+	if !found {
+		log.Printf("connection update: connection 0x%04X probably expired", ep.ConnectionHandle)
+		return
+	}
+	c.mu.Lock()
+	c.info.Interval = ep.ConnInterval
+	c.info.Latency = ep.ConnLatency
+	c.info.Timeout = ep.SupervisionTimeout
+	c.mu.Unlock()
+	h.connInfoChanged(c)
+}
+
+// handleRemoteConnParamsRequest answers the Connection Parameters Request
+// procedure initiated by the remote device.
+func (h *HCI) handleRemoteConnParamsRequest(b []byte) {
+	ep := &evt.LERemoteConnectionParameterRequestEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	hh := ep.ConnectionHandle
+	h.connsmu.Lock()
+	c, found := h.conns[hh]
+	h.connsmu.Unlock()
+	if !found {
+		log.Printf("connection parameters request: connection 0x%04X probably expired", hh)
+		return
+	}
+	p, accept := c.connParamsRequested(ConnParams{
+		IntervalMin: ep.IntervalMin,
+		IntervalMax: ep.IntervalMax,
+		Latency:     ep.Latency,
+		Timeout:     ep.Timeout,
+	})
+	var err error
+	if accept {
+		err = h.c.SendAndCheckResp(cmd.LERemoteConnectionParameterReply{
+			ConnectionHandle: hh,
+			IntervalMin:      p.IntervalMin,
+			IntervalMax:      p.IntervalMax,
+			Latency:          p.Latency,
+			Timeout:          p.Timeout,
+		}, []byte{0x00})
+	} else {
+		err = h.c.SendAndCheckResp(cmd.LERemoteConnectionParameterNegReply{
+			ConnectionHandle: hh,
+			Reason:           uint8(constants.HCIStatusUnacceptableConnParams),
+		}, []byte{0x00})
+	}
+	if err != nil {
+		log.Printf("connection parameters request: 0x%04X, %v", hh, err)
+	}
+}
+
+// connInfoChanged reports the state of c to the ConnInfoChangeHandler.
+func (h *HCI) connInfoChanged(c *conn) {
+	if h.ConnInfoChangeHandler != nil && c.pd != nil {
+		h.ConnInfoChangeHandler(c.pd, c.connInfo())
+	}
+}
+
 func (h *HCI) handleAdvertisement(b []byte) {
 	// If no one is interested, don't bother.
 	if h.AdvertisementHandler == nil {
@@ -309,6 +980,7 @@ func (h *HCI) handleAdvertisement(b []byte) {
 			Scannable:   scannable,
 			RSSI:        ep.RSSI[i],
 		}
+		pd.resolvedByController()
 		h.plistmu.Lock()
 		h.plist[addr] = pd
 		h.plistmu.Unlock()
@@ -322,9 +994,7 @@ func (h *HCI) handleNumberOfCompletedPkts(b []byte) error {
 		return err
 	}
 	for _, r := range ep.Packets {
-		for i := 0; i < int(r.NumOfCompletedPkts); i++ {
-			<-h.bufCnt
-		}
+		h.tx.completed(r.ConnectionHandle, int(r.NumOfCompletedPkts))
 	}
 	return nil
 }
@@ -340,36 +1010,89 @@ func (h *HCI) handleConnection(b []byte) {
 	if err := ep.Unmarshal(b); err != nil {
 		return // FIXME
 	}
+	if ep.Status == uint8(constants.HCIStatusAdvertisingTimeout) {
+		// The high duty cycle directed advertising ended, no outgoing
+		// connection failed.
+		h.advmu.Lock()
+		h.adv = false
+		h.advmu.Unlock()
+		if h.AdvertisingTimeoutHandler != nil {
+			h.AdvertisingTimeoutHandler()
+		}
+		return
+	}
+	if ep.Status != 0x00 {
+		log.Printf("HCI: connection failed, %v", constants.HCIStatus(ep.Status))
+		h.connectCompleted(ep)
+		return
+	}
 	hh := ep.ConnectionHandle
-	c := newConn(h, hh)
+	c := newConn(h, hh, ep.Role == 0x00)
+	c.info.Interval = ep.ConnInterval
+	c.info.Latency = ep.ConnLatency
+	c.info.Timeout = ep.SupervisionTimeout
+	c.info.PeerAddressType = ep.PeerAddressType
+	if !c.master {
+		h.advmu.Lock()
+		c.info.OwnAddressType = h.advOwnAddrType
+		h.advmu.Unlock()
+	}
+	// The peer data is attached before the connection is published, as the
+	// events of the connection, such as LTK requests, may follow at once.
+	pd := h.peerData(ep)
+	if pd != nil {
+		pd.Conn = c
+		c.pd = pd
+	}
+	h.tx.add(hh)
 	h.connsmu.Lock()
 	h.conns[hh] = c
 	h.connsmu.Unlock()
-	h.setAdvertiseEnable(true)
+	h.resumeAdvertising()
+	h.readPHY(c)
 
-	// FIXME: sloppiness. This call should be called by the package user once we
-	// flesh out the support of l2cap signaling packets (CID:0x0001,0x0005)
-	if ep.ConnLatency != 0 || ep.ConnInterval > 0x18 {
+	// FIXME: sloppiness. This call should be called by the package user.
+	// Only the slave may request the master to update the parameters.
+	if !c.master && (ep.ConnLatency != 0 || ep.ConnInterval > 0x18) {
 		c.updateConnection()
 	}
 
-	// master connection
+	switch {
+	case ep.Role == 0x01: // master connection
+		h.AcceptMasterHandler(pd)
+	case pd == nil:
+		log.Printf("HCI: can't find data for %v", ep.PeerAddress)
+	default:
+		h.AcceptSlaveHandler(pd)
+	}
+}
+
+// peerData returns the data of the peer of the connection completed by ep,
+// or nil if it can't be found.
+func (h *HCI) peerData(ep *evt.LEConnectionCompleteEP) *PlatData {
 	if ep.Role == 0x01 {
 		pd := &PlatData{
-			Address: ep.PeerAddress,
-			Conn:    c,
+			AddressType: constants.AddressType(ep.PeerAddressType),
+			Address:     ep.PeerAddress,
 		}
-		h.AcceptMasterHandler(pd)
-		return
+		pd.resolvedByController()
+		return pd
 	}
-	h.plistmu.Lock()
-	if pd := h.plist[ep.PeerAddress]; pd != nil {
+	pd, wlConnect := h.connectCompleted(ep)
+	if pd == nil {
+		h.plistmu.Lock()
+		pd = h.plist[ep.PeerAddress]
 		h.plistmu.Unlock()
-		pd.Conn = c
-		h.AcceptSlaveHandler(pd)
-	} else {
-		log.Printf("HCI: can't find data for %v", ep.PeerAddress)
 	}
+	if pd == nil && wlConnect {
+		// Connected to a white listed device, which might have never been scanned.
+		pd = &PlatData{
+			AddressType: constants.AddressType(ep.PeerAddressType),
+			Address:     ep.PeerAddress,
+		}
+		pd.resolvedByController()
+	}
+	return pd
 }
 
 func (h *HCI) handleDisconnectionComplete(b []byte) error {
@@ -379,16 +1102,19 @@ func (h *HCI) handleDisconnectionComplete(b []byte) error {
 	}
 	hh := ep.ConnectionHandle
 	h.connsmu.Lock()
-	defer h.connsmu.Unlock()
 	c, found := h.conns[hh]
 	if !found {
+		h.connsmu.Unlock()
 		// should not happen, just be cautious for now.
 		log.Printf("l2conn: disconnecting a disconnected 0x%04X connection", hh)
 		return nil
 	}
 	delete(h.conns, hh)
+	h.tx.remove(hh)
+	c.disconnected(ep.Reason)
 	close(c.aclc)
-	h.setAdvertiseEnable(true)
+	h.connsmu.Unlock()
+	h.resumeAdvertising()
 	return nil
 }
 
@@ -400,15 +1126,70 @@ func (h *HCI) handleLTKRequest(b []byte) {
 	}
 	hh := ep.ConnectionHandle
 	h.connsmu.Lock()
-	defer h.connsmu.Unlock()
-	_, found := h.conns[hh]
+	c, found := h.conns[hh]
+	h.connsmu.Unlock()
 	if !found {
 		// should not happen, just be cautious for now.
 		log.Printf("ltkrequest: error, connection 0x%04X probably expired", hh)
 		return
 	}
+	if h.LTKRequestHandler != nil && c.pd != nil {
+		if ltk, ok := h.LTKRequestHandler(c.pd, ep.RandomNumber, ep.EncryptionDiversifier); ok {
+			r := cmd.LELTKReply{ConnectionHandle: hh}
+			for i := range ltk {
+				r.LongTermKey[i] = ltk[len(ltk)-1-i]
+			}
+			h.c.Send(r)
+			return
+		}
+	}
 	h.c.Send(cmd.LELTKNegReply{ConnectionHandle: hh})
-	// TODO: implement proper key management
+}
+
+func (h *HCI) handleEncryptionChange(b []byte) error {
+	ep := &evt.EncryptionChangeEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return err
+	}
+	var err error
+	if ep.Status != 0x00 {
+		err = fmt.Errorf("encryption change failed, status 0x%02X", ep.Status)
+	}
+	h.encryptionChanged(ep.ConnectionHandle, ep.EncryptionEnabled != 0, err)
+	return nil
+}
+
+func (h *HCI) handleEncryptionKeyRefreshComplete(b []byte) error {
+	ep := &evt.EncryptionKeyRefreshCompleteEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return err
+	}
+	var err error
+	if ep.Status != 0x00 {
+		err = fmt.Errorf("encryption key refresh failed, status 0x%02X", ep.Status)
+	}
+	h.encryptionChanged(ep.ConnectionHandle, true, err)
+	return nil
+}
+
+// encryptionChanged updates the encryption state of a connection, and
+// reports it to the EncryptionChangeHandler. The state is left unchanged
+// if err is not nil.
+func (h *HCI) encryptionChanged(hh uint16, encrypted bool, err error) {
+	h.connsmu.Lock()
+	c, found := h.conns[hh]
+	h.connsmu.Unlock()
+	if !found {
+		log.Printf("encryption change: connection 0x%04X probably expired", hh)
+		return
+	}
+	if err == nil {
+		c.setEncrypted(encrypted)
+	}
+	encrypted = c.Encrypted()
+	if h.EncryptionChangeHandler != nil && c.pd != nil {
+		h.EncryptionChangeHandler(c.pd, encrypted, err)
+	}
 }
 
 func (h *HCI) handleLEMeta(b []byte) error {
@@ -423,13 +1204,20 @@ func (h *HCI) handleLEMeta(b []byte) error {
 	case evt.LEConnectionComplete:
 		go h.handleConnection(b)
 	case evt.LEConnectionUpdateComplete:
-		// anything to do here?
+		go h.handleConnUpdateComplete(b)
 	case evt.LEAdvertisingReport:
 		go h.handleAdvertisement(b)
 	// case evt.LEReadRemoteUsedFeaturesComplete:
 	case evt.LELTKRequest:
 		go h.handleLTKRequest(b)
-	// case evt.LERemoteConnectionParameterRequest:
+	case evt.LERemoteConnectionParameterRequest:
+		go h.handleRemoteConnParamsRequest(b)
+	case evt.LEDataLengthChange:
+		go h.handleDataLengthChange(b)
+	case evt.LEPHYUpdateComplete:
+		go h.handlePHYUpdateComplete(b)
+	case evt.LEAdvertisingSetTerminated:
+		go h.handleAdvSetTerminated(b)
 	default:
 		return fmt.Errorf("Unhandled LE event: 0x%02x, [ % X ]", code, b)
 	}
@@ -452,3 +1240,236 @@ func (h *HCI) handleL2CAP(b []byte) error {
 	c.aclc <- a
 	return nil
 }
+
+// errLinkClosed is returned when data is written to a lost connection.
+var errLinkClosed = errors.New("connection closed")
+
+// An aclPDU is an L2CAP PDU waiting to be sent, fragmented into ACL data packets.
+type aclPDU struct {
+	frags [][]byte
+	done  chan error
+}
+
+// finish reports the outcome of sending p, unless it's already been reported.
+func (p *aclPDU) finish(err error) {
+	select {
+	case p.done <- err:
+	default:
+	}
+}
+
+// An aclQueue holds the PDUs waiting to be sent on a connection.
+type aclQueue struct {
+	hh       uint16
+	cur      *aclPDU   // the PDU being sent, whose fragments can't be interleaved with others
+	high     []*aclPDU // signaling, and ATT PDUs other than notifications
+	low      []*aclPDU // notifications, and the data of connection oriented channels
+	inflight int       // packets sent, and not yet completed by the controller
+}
+
+func (q *aclQueue) empty() bool {
+	return q.cur == nil && len(q.high) == 0 && len(q.low) == 0
+}
+
+// An aclScheduler shares the ACL data buffers of the controller between the
+// connections. It sends a single packet of each connection in turn, and the
+// urgent PDUs of a connection before its bulk ones, so that a connection
+// streaming notifications doesn't starve the responses on the others. The
+// buffers are accounted per connection, and given back when the controller
+// completes the packets, or when the connection is lost.
+type aclScheduler struct {
+	w io.Writer
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	free   int                  // buffers of the controller available
+	queues map[uint16]*aclQueue // by connection handle
+	ring   []uint16             // handles of the connections, in round-robin order
+	next   int                  // index in ring of the next connection to send for
+	closed bool
+}
+
+func newACLScheduler(w io.Writer, bufs int) *aclScheduler {
+	s := &aclScheduler{
+		w:      w,
+		free:   bufs,
+		queues: map[uint16]*aclQueue{},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// setBuffers sets the number of ACL data packets the controller can buffer.
+// It must be called while no packets are in flight.
+func (s *aclScheduler) setBuffers(n int) {
+	s.mu.Lock()
+	s.free = n
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// add starts scheduling the packets of the connection hh.
+func (s *aclScheduler) add(hh uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.queues[hh]; ok {
+		return
+	}
+	s.queues[hh] = &aclQueue{hh: hh}
+	s.ring = append(s.ring, hh)
+}
+
+// remove stops scheduling the packets of the lost connection hh. Its PDUs
+// still queued are dropped, and its packets in flight are considered flushed
+// by the controller.
+func (s *aclScheduler) remove(hh uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[hh]
+	if !ok {
+		return
+	}
+	delete(s.queues, hh)
+	for i, h := range s.ring {
+		if h == hh {
+			s.ring = append(s.ring[:i], s.ring[i+1:]...)
+			if s.next > i {
+				s.next--
+			}
+			break
+		}
+	}
+	q.fail(errLinkClosed)
+	s.free += q.inflight
+	s.cond.Signal()
+}
+
+// completed gives back the buffers of n packets of hh the controller has completed.
+func (s *aclScheduler) completed(hh uint16, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[hh]
+	if !ok {
+		return
+	}
+	if n > q.inflight {
+		n = q.inflight
+	}
+	q.inflight -= n
+	s.free += n
+	s.cond.Signal()
+}
+
+// send queues the fragments of a PDU for the connection hh, and waits until
+// they are all written to the controller.
+func (s *aclScheduler) send(hh uint16, frags [][]byte, urgent bool) error {
+	p := &aclPDU{frags: frags, done: make(chan error, 1)}
+	s.mu.Lock()
+	q, ok := s.queues[hh]
+	if !ok || s.closed {
+		s.mu.Unlock()
+		return errLinkClosed
+	}
+	if urgent {
+		q.high = append(q.high, p)
+	} else {
+		q.low = append(q.low, p)
+	}
+	s.mu.Unlock()
+	s.cond.Signal()
+	return <-p.done
+}
+
+// close stops the scheduler, and drops all the PDUs queued.
+func (s *aclScheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, q := range s.queues {
+		q.fail(errLinkClosed)
+	}
+	s.cond.Signal()
+}
+
+func (q *aclQueue) fail(err error) {
+	if q.cur != nil {
+		q.cur.finish(err)
+	}
+	for _, p := range q.high {
+		p.finish(err)
+	}
+	for _, p := range q.low {
+		p.finish(err)
+	}
+	q.cur, q.high, q.low = nil, nil, nil
+}
+
+// pick returns the connection to send the next packet for, in round-robin
+// order, or nil if none has anything to send.
+func (s *aclScheduler) pick() *aclQueue {
+	for i := 0; i < len(s.ring); i++ {
+		j := (s.next + i) % len(s.ring)
+		q := s.queues[s.ring[j]]
+		if q.empty() {
+			continue
+		}
+		if q.cur == nil {
+			if len(q.high) > 0 {
+				q.cur, q.high = q.high[0], q.high[1:]
+			} else {
+				q.cur, q.low = q.low[0], q.low[1:]
+			}
+		}
+		s.next = (j + 1) % len(s.ring)
+		return q
+	}
+	return nil
+}
+
+func (s *aclScheduler) loop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		var q *aclQueue
+		for !s.closed {
+			if s.free > 0 {
+				if q = s.pick(); q != nil {
+					break
+				}
+			}
+			s.cond.Wait()
+		}
+		if s.closed {
+			return
+		}
+		p := q.cur
+		f := p.frags[0]
+		p.frags = p.frags[1:]
+		if len(p.frags) == 0 {
+			q.cur = nil
+		}
+		s.free--
+		q.inflight++
+
+		s.mu.Unlock()
+		_, err := s.w.Write(f)
+		s.mu.Lock()
+
+		if err != nil {
+			// The controller didn't take the packet; give its buffer back,
+			// unless the connection has been removed meanwhile.
+			if s.queues[q.hh] == q {
+				q.inflight--
+				s.free++
+			}
+			if q.cur == p {
+				q.cur = nil
+			}
+			p.finish(err)
+			continue
+		}
+		if len(p.frags) == 0 {
+			p.finish(nil)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package linux
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// An aclRecorder takes the ACL packets of the tests, made of a single tag byte.
+type aclRecorder struct {
+	mu   sync.Mutex
+	tags []byte
+}
+
+func (r *aclRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	r.tags = append(r.tags, b[0])
+	r.mu.Unlock()
+	return len(b), nil
+}
+
+func (r *aclRecorder) sent() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return string(r.tags)
+}
+
+// queue sends a PDU made of a packet per tag, and returns the channel its
+// outcome is reported to, once the PDU is queued.
+func queue(t *testing.T, s *aclScheduler, hh uint16, tags string, urgent bool) <-chan error {
+	s.mu.Lock()
+	q := s.queues[hh]
+	n := len(q.high) + len(q.low)
+	s.mu.Unlock()
+
+	frags := make([][]byte, len(tags))
+	for i := range tags {
+		frags[i] = []byte{tags[i]}
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.send(hh, frags, urgent) }()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		m := len(q.high) + len(q.low)
+		s.mu.Unlock()
+		if m > n {
+			return errc
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("PDU %q not queued", tags)
+		}
+	}
+}
+
+func wait(t *testing.T, errc <-chan error) error {
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("PDU not sent")
+		return nil
+	}
+}
+
+func TestACLSchedulerUrgent(t *testing.T) {
+	r := &aclRecorder{}
+	s := newACLScheduler(r, 10)
+	defer s.close()
+	s.add(1)
+	bulk := queue(t, s, 1, "ab", false)
+	urgent := queue(t, s, 1, "U", true)
+	go s.loop()
+	wait(t, bulk)
+	wait(t, urgent)
+	if got, want := r.sent(), "Uab"; got != want {
+		t.Errorf("got packets %q, want %q", got, want)
+	}
+}
+
+func TestACLSchedulerEATT(t *testing.T) {
+	r := &aclRecorder{}
+	ch, done := newTestCoC(r, 1)
+	defer done()
+	ch.psm = psmEATT
+	ch.txMTU, ch.txMPS, ch.txCredits = 23, 23, 1
+	s := ch.c.hci.tx
+
+	// The only buffer is taken, and notifications are queued behind it.
+	if err := s.send(ch.c.attr, [][]byte{{'a'}}, false); err != nil {
+		t.Fatal(err)
+	}
+	ntf := queue(t, s, ch.c.attr, "nn", false)
+
+	// The ACL packets of the K-frames all start with the packet type, 0x02.
+	rsp := make(chan error, 1)
+	go func() {
+		_, err := ch.Write([]byte{0x0B, 0x01, 0x02}) // Read Response
+		rsp <- err
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		n := len(s.queues[ch.c.attr].high)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("response not queued")
+		}
+	}
+
+	// The controller completes the packets one at a time.
+	for _, want := range []string{"a\x02", "a\x02n", "a\x02nn"} {
+		s.completed(ch.c.attr, 1)
+		for deadline := time.Now().Add(time.Second); r.sent() != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("got packets %q, want %q", r.sent(), want)
+			}
+		}
+	}
+	if err := wait(t, rsp); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, ntf)
+}
+
+func TestACLSchedulerRoundRobin(t *testing.T) {
+	r := &aclRecorder{}
+	s := newACLScheduler(r, 10)
+	defer s.close()
+	s.add(1)
+	s.add(2)
+	s.add(3)
+	errcs := []<-chan error{
+		queue(t, s, 1, "abc", false),
+		queue(t, s, 2, "x", false),
+		queue(t, s, 2, "y", true),
+		queue(t, s, 3, "12", false),
+	}
+	go s.loop()
+	for _, errc := range errcs {
+		wait(t, errc)
+	}
+	// The fragments of a PDU aren't interleaved with the other PDUs of its
+	// connection, only with those of the other connections.
+	if got, want := r.sent(), "ay1bx2c"; got != want {
+		t.Errorf("got packets %q, want %q", got, want)
+	}
+}
+
+func TestACLSchedulerBuffers(t *testing.T) {
+	r := &aclRecorder{}
+	s := newACLScheduler(r, 2)
+	defer s.close()
+	s.add(1)
+	s.add(2)
+	go s.loop()
+
+	if err := s.send(1, [][]byte{{'a'}, {'b'}}, false); err != nil {
+		t.Fatal(err)
+	}
+	blocked := queue(t, s, 2, "xy", false)
+	if got, want := r.sent(), "ab"; got != want {
+		t.Fatalf("got packets %q with no buffers left, want %q", got, want)
+	}
+
+	// The controller completes a packet of the connection 1.
+	s.completed(1, 1)
+	for deadline := time.Now().Add(time.Second); r.sent() != "abx"; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got packets %q after a completed packet, want %q", r.sent(), "abx")
+		}
+	}
+
+	// Losing the connection 1 gives back the buffer of its last packet.
+	s.remove(1)
+	if err := wait(t, blocked); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.sent(), "abxy"; got != want {
+		t.Errorf("got packets %q, want %q", got, want)
+	}
+	if err := s.send(1, [][]byte{{'z'}}, false); err != errLinkClosed {
+		t.Errorf("got error %v sending on a removed connection, want %v", err, errLinkClosed)
+	}
+}
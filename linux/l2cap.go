@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 
+	"github.com/grutz/gatt/constants"
 	"github.com/grutz/gatt/linux/cmd"
 )
 
@@ -38,54 +40,203 @@ type conn struct {
 	attr  uint16
 	aclc  chan *aclData
 	datac chan []byte
+
+	pd     *PlatData // the remote device
+	master bool      // true if the local device is the master of the connection
+
+	mu        sync.Mutex
+	encrypted bool
+	info      ConnInfo              // the current parameters of the connection
+	sigID     uint8                 // identifier of the last signaling request sent
+	pending   map[uint8]chan sigPkt // signaling requests waiting for a response, by identifier
+	chans     map[uint16]*CoC       // connection oriented channels, by local CID
+	phyc      []chan error          // SetPHY calls waiting for the PHY update
+	done      chan struct{}         // closed when the connection is lost
+	reason    error                 // why the connection was lost, if it wasn't closed locally
+}
+
+// ConnInfo is the current state of a connection.
+type ConnInfo struct {
+	Handle          uint16 // Connection handle.
+	Master          bool   // True if the local device is the master of the connection.
+	Interval        uint16 // Connection interval, in units of 1.25 ms.
+	Latency         uint16 // Slave latency, in number of connection events.
+	Timeout         uint16 // Supervision timeout, in units of 10 ms.
+	OwnAddressType  uint8  // 0x00: public, 0x01: random
+	PeerAddressType uint8  // As reported by the LE Connection Complete event.
+	TxPHY           uint8  // 0x01: LE 1M, 0x02: LE 2M, 0x03: LE Coded
+	RxPHY           uint8  // 0x01: LE 1M, 0x02: LE 2M, 0x03: LE Coded
+	MaxTxOctets     uint16 // Maximum payload of the LE data packets sent.
+	MaxTxTime       uint16 // Maximum time to send an LE data packet, in µs.
+	MaxRxOctets     uint16 // Maximum payload of the LE data packets received.
+	MaxRxTime       uint16 // Maximum time to receive an LE data packet, in µs.
+}
+
+// A sigPkt is a signaling command received on the LE signaling channel.
+type sigPkt struct {
+	code uint8
+	d    []byte
 }
 
-func newConn(hci *HCI, hh uint16) *conn {
+func newConn(hci *HCI, hh uint16, master bool) *conn {
 	c := &conn{
-		hci:   hci,
-		attr:  hh,
-		aclc:  make(chan *aclData),
-		datac: make(chan []byte, 32),
+		hci:    hci,
+		attr:   hh,
+		master: master,
+		aclc:   make(chan *aclData),
+		datac:  make(chan []byte, 32),
+
+		pending: make(map[uint8]chan sigPkt),
+		chans:   make(map[uint16]*CoC),
+		done:    make(chan struct{}),
+
+		info: ConnInfo{
+			Handle:      hh,
+			Master:      master,
+			TxPHY:       0x01,
+			RxPHY:       0x01,
+			MaxTxOctets: 27,
+			MaxTxTime:   328,
+			MaxRxOctets: 27,
+			MaxRxTime:   328,
+		},
 	}
 	go c.loop()
 	return c
 }
 
 func (c *conn) loop() {
-	defer close(c.datac)
+	defer func() {
+		close(c.done)
+		c.closeChans()
+		close(c.datac)
+	}()
 	for a := range c.aclc {
 		if len(a.b) < 4 {
 			log.Printf("l2conn: short/corrupt packet, %v [% X]", a, a.b)
 			return
 		}
 		cid := uint16(a.b[2]) | (uint16(a.b[3]) << 8)
-		if cid == 5 {
-			c.handleSignal(a)
-			continue
-		}
-		b := make([]byte, 512)
 		tlen := int(uint16(a.b[0]) | uint16(a.b[1])<<8)
-		d := a.b[4:] // skip l2cap header
-		copy(b, d)
-		n := len(d)
+		b := make([]byte, 0, tlen)
+		b = append(b, a.b[4:]...) // skip l2cap header
 
 		// Keep receiving and reassemble continued l2cap segments
-		for n != tlen {
+		for len(b) < tlen {
 			a, ok := <-c.aclc
 			if !ok || (a.flags&0x1) == 0 {
 				return
 			}
-			n += copy(b[n:], a.b)
+			b = append(b, a.b...)
+		}
+
+		switch {
+		case cid == 0x0004:
+			c.datac <- b
+		case cid == 0x0005:
+			// Handled aside, so a request waiting for the controller doesn't
+			// hold back the incoming packets.
+			go func() {
+				if err := c.handleSignal(b); err != nil {
+					log.Printf("l2conn: %s", err)
+				}
+			}()
+		case cid >= 0x0040 && cid <= 0x007F:
+			if ch, ok := c.localChan(cid); ok {
+				ch.handleFrame(b)
+			}
+		default:
+			log.Printf("l2conn: ignore packet on cid 0x%04X", cid)
+		}
+	}
+}
+
+// expect registers a signaling request waiting for a response.
+func (c *conn) expect(id uint8) chan sigPkt {
+	ch := make(chan sigPkt, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *conn) unexpect(id uint8) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// respond hands a response to the request waiting for it, if any.
+func (c *conn) respond(id uint8, s sigPkt) bool {
+	c.mu.Lock()
+	ch, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if ok {
+		ch <- s
+	}
+	return ok
+}
+
+// unexpectPHY removes ch from the SetPHY calls waiting for the PHY update.
+func (c *conn) unexpectPHY(ch chan error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.phyc {
+		if w == ch {
+			c.phyc = append(c.phyc[:i], c.phyc[i+1:]...)
+			return
 		}
-		c.datac <- b[:n]
 	}
 }
 
+// Encrypted reports whether the link is currently encrypted.
+func (c *conn) Encrypted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.encrypted
+}
+
+// connInfo returns the current state of the connection.
+func (c *conn) connInfo() ConnInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// disconnected records the reason the connection was lost.
+func (c *conn) disconnected(reason uint8) {
+	var err error
+	if s := constants.HCIStatus(reason); s != constants.HCIStatusLocalHostTerminated {
+		err = s
+	}
+	c.mu.Lock()
+	c.reason = err
+	c.mu.Unlock()
+}
+
+func (c *conn) setEncrypted(en bool) {
+	c.mu.Lock()
+	c.encrypted = en
+	c.mu.Unlock()
+}
+
+// nextIdentifier returns the identifier of a new signaling request.
+func (c *conn) nextIdentifier() uint8 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sigID++
+	if c.sigID == 0 {
+		c.sigID = 1 // 0x00 is an invalid identifier
+	}
+	return c.sigID
+}
+
 func (c *conn) updateConnection() (int, error) {
 	b := []byte{
-		0x12,       // Code (Connection Param Update)
-		0x02,       // ID
-		0x08, 0x00, // DataLength
+		0x12,               // Code (Connection Param Update)
+		c.nextIdentifier(), // ID
+		0x08, 0x00,         // DataLength
 		0x08, 0x00, // IntervalMin
 		0x18, 0x00, // IntervalMax
 		0x00, 0x00, // SlaveLatency
@@ -94,46 +245,68 @@ func (c *conn) updateConnection() (int, error) {
 }
 
 // write writes the l2cap payload to the controller.
+func (c *conn) write(cid int, b []byte) (int, error) {
+	return c.writeFrame(cid, b, urgent(cid, b))
+}
+
+// writeFrame writes the l2cap payload to the controller.
 // It first prepend the l2cap header (4-bytes), and diassemble the payload
 // if it is larger than the HCI LE buffer size that the conntroller can support.
-func (c *conn) write(cid int, b []byte) (int, error) {
+// The fragments are then sent by the scheduler of the controller buffers,
+// before the bulk data if the payload is urgent.
+func (c *conn) writeFrame(cid int, b []byte, urgent bool) (int, error) {
 	flag := uint8(0) // ACL data continuation flag
 	tlen := len(b)   // Total length of the l2cap payload
 
 	logger.Info("l2cap", "W", fmt.Sprintf("[% X]", b))
 	w := append(
 		[]byte{
-			0,    // packet type
-			0, 0, // attr
-			0, 0, // dlen
 			uint8(tlen), uint8(tlen >> 8), // l2cap header
 			uint8(cid), uint8(cid >> 8), // l2cap header
 		}, b...)
 
-	n := 4 + tlen // l2cap header + l2cap payload
-	for n > 0 {
-		dlen := n
+	var frags [][]byte
+	for len(w) > 0 {
+		dlen := len(w)
 		if dlen > c.hci.bufSize {
 			dlen = c.hci.bufSize
 		}
-		w[0] = 0x02 // packetTypeACL
-		w[1] = uint8(c.attr)
-		w[2] = uint8(c.attr>>8) | flag
-		w[3] = uint8(dlen)
-		w[4] = uint8(dlen >> 8)
-
-		// make sure we don't send more buffers than the controller can handdle
-		c.hci.bufCnt <- struct{}{}
-
-		c.hci.d.Write(w[:5+dlen])
+		f := append([]byte{
+			0x02, // packetTypeACL
+			uint8(c.attr), uint8(c.attr>>8) | flag,
+			uint8(dlen), uint8(dlen >> 8),
+		}, w[:dlen]...)
+		frags = append(frags, f)
 		w = w[dlen:] // advance the pointer to the next segment, if any.
 		flag = 0x10  // the rest of iterations attr continued segments, if any.
-		n -= dlen
 	}
 
+	if err := c.hci.tx.send(c.attr, frags, urgent); err != nil {
+		return 0, err
+	}
 	return len(b), nil
 }
 
+// urgent reports whether the l2cap payload b for the fixed channel cid should
+// be sent before the bulk data queued on the connection. Everything but the
+// notifications is urgent. The connection oriented channels classify their
+// SDUs themselves.
+func urgent(cid int, b []byte) bool {
+	switch cid {
+	case 0x05:
+		return true
+	case 0x04:
+		return urgentATT(b)
+	}
+	return false
+}
+
+// urgentATT reports whether the ATT PDU b is urgent; all are but the
+// notifications, which are bulk data.
+func urgentATT(b []byte) bool {
+	return len(b) > 0 && b[0] != constants.AttOpHandleNotify && b[0] != constants.AttOpMultiHandleNotify
+}
+
 func (c *conn) Read(b []byte) (int, error) {
 	d, ok := <-c.datac
 	if !ok {
@@ -192,8 +365,175 @@ func (c *conn) Close() error {
 // 0x14 LE Credit Based Connection request		0x0005
 // 0x15 LE Credit Based Connection response		0x0005
 // 0x16 LE Flow Control Credit					0x0005
-func (c *conn) handleSignal(a *aclData) error {
-	log.Printf("ignore l2cap signal:[ % X ]", a.b)
-	// FIXME: handle LE signaling channel (CID: 5)
+func (c *conn) handleSignal(b []byte) error {
+	if len(b) < 4 {
+		return fmt.Errorf("l2conn: short signaling packet [% X]", b)
+	}
+	code, id := b[0], b[1]
+	dlen := int(b[2]) | int(b[3])<<8
+	if len(b) > sigMTU {
+		return c.rejectSignal(id, sigRejectMTUExceeded, []byte{uint8(sigMTU), uint8(sigMTU >> 8)})
+	}
+	if len(b) < 4+dlen {
+		return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+	}
+	d := b[4 : 4+dlen]
+
+	switch code {
+	case sigCommandReject:
+		if !c.respond(id, sigPkt{code, d}) {
+			log.Printf("l2conn: signaling command 0x%02X rejected [% X]", id, d)
+		}
+	case sigDisconnectReq:
+		return c.handleDisconnectReq(id, d)
+	case sigDisconnectRsp, sigLECreditBasedConnRsp:
+		c.respond(id, sigPkt{code, d})
+	case sigConnParamUpdateReq:
+		return c.handleConnParamUpdateReq(id, d)
+	case sigConnParamUpdateRsp:
+		if len(d) < 2 {
+			return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+		}
+		if r := uint16(d[0]) | uint16(d[1])<<8; r != 0x0000 {
+			log.Printf("l2conn: connection parameters update rejected by master")
+		}
+	case sigLECreditBasedConnReq:
+		return c.handleCoCReq(id, d)
+	case sigFlowControlCredit:
+		return c.handleFlowControlCredit(id, d)
+	default:
+		return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+	}
 	return nil
 }
+
+// LE signaling codes
+const (
+	sigCommandReject        = 0x01
+	sigDisconnectReq        = 0x06
+	sigDisconnectRsp        = 0x07
+	sigConnParamUpdateReq   = 0x12
+	sigConnParamUpdateRsp   = 0x13
+	sigLECreditBasedConnReq = 0x14
+	sigLECreditBasedConnRsp = 0x15
+	sigFlowControlCredit    = 0x16
+)
+
+// sigMTU is the largest signaling command accepted on the LE signaling
+// channel (MTUsig).
+const sigMTU = 23
+
+// Command Reject reasons. The commands truncated, or too short for their
+// code, aren't understood; only those larger than sigMTU exceed the MTU.
+const (
+	sigRejectNotUnderstood = 0x0000 // Command not understood
+	sigRejectMTUExceeded   = 0x0001 // Signaling MTU exceeded, followed by the MTU
+	sigRejectInvalidCID    = 0x0002 // Invalid CID in request
+)
+
+// writeSignal sends a signaling command over the LE signaling channel.
+func (c *conn) writeSignal(code, id uint8, d []byte) error {
+	b := append([]byte{code, id, uint8(len(d)), uint8(len(d) >> 8)}, d...)
+	_, err := c.write(0x05, b)
+	return err
+}
+
+func (c *conn) rejectSignal(id uint8, reason uint16, d []byte) error {
+	return c.writeSignal(sigCommandReject, id, append([]byte{uint8(reason), uint8(reason >> 8)}, d...))
+}
+
+// ConnParams are the parameters of a connection.
+type ConnParams struct {
+	IntervalMin uint16 // Minimum connection interval, in units of 1.25 ms.
+	IntervalMax uint16 // Maximum connection interval, in units of 1.25 ms.
+	Latency     uint16 // Slave latency, in number of connection events.
+	Timeout     uint16 // Supervision timeout, in units of 10 ms.
+}
+
+// Valid reports whether the parameters are in the ranges allowed by the spec.
+func (p ConnParams) Valid() bool {
+	return p.IntervalMin >= 0x0006 && p.IntervalMax <= 0x0C80 && p.IntervalMin <= p.IntervalMax &&
+		p.Latency <= 0x01F3 && p.Timeout >= 0x000A && p.Timeout <= 0x0C80 &&
+		uint32(p.Timeout)*4 > (1+uint32(p.Latency))*uint32(p.IntervalMax)
+}
+
+// ConnParamsBounds are the bounds of the connection parameters accepted from
+// a remote device. A zero field sets no bound.
+type ConnParamsBounds struct {
+	IntervalMin uint16 // Minimum connection interval, in units of 1.25 ms.
+	IntervalMax uint16 // Maximum connection interval, in units of 1.25 ms.
+	LatencyMax  uint16 // Maximum slave latency, in number of connection events.
+	TimeoutMin  uint16 // Minimum supervision timeout, in units of 10 ms.
+	TimeoutMax  uint16 // Maximum supervision timeout, in units of 10 ms.
+}
+
+// Apply narrows the parameters p to the bounds. It returns false if the
+// interval range requested doesn't overlap the bounds, or if the narrowed
+// parameters aren't valid.
+func (b ConnParamsBounds) Apply(p ConnParams) (ConnParams, bool) {
+	if p.IntervalMin < b.IntervalMin {
+		p.IntervalMin = b.IntervalMin
+	}
+	if b.IntervalMax != 0 && p.IntervalMax > b.IntervalMax {
+		p.IntervalMax = b.IntervalMax
+	}
+	if b.LatencyMax != 0 && p.Latency > b.LatencyMax {
+		p.Latency = b.LatencyMax
+	}
+	if p.Timeout < b.TimeoutMin {
+		p.Timeout = b.TimeoutMin
+	}
+	if b.TimeoutMax != 0 && p.Timeout > b.TimeoutMax {
+		p.Timeout = b.TimeoutMax
+	}
+	return p, p.Valid()
+}
+
+// connParamsRequested applies the ConnParamsRequestHandler to the parameters
+// requested by the remote device. It returns the parameters to apply, and
+// false if the request is rejected.
+func (c *conn) connParamsRequested(p ConnParams) (ConnParams, bool) {
+	if !p.Valid() {
+		return p, false
+	}
+	if f := c.hci.ConnParamsRequestHandler; f != nil && c.pd != nil {
+		var ok bool
+		if p, ok = f(c.pd, p); !ok || !p.Valid() {
+			return p, false
+		}
+	}
+	return p, true
+}
+
+// handleConnParamUpdateReq answers a Connection Parameter Update Request
+// from the slave, and applies the parameters if they are accepted.
+func (c *conn) handleConnParamUpdateReq(id uint8, d []byte) error {
+	if !c.master {
+		return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+	}
+	if len(d) < 8 {
+		return c.rejectSignal(id, sigRejectNotUnderstood, nil)
+	}
+	p := ConnParams{
+		IntervalMin: uint16(d[0]) | uint16(d[1])<<8,
+		IntervalMax: uint16(d[2]) | uint16(d[3])<<8,
+		Latency:     uint16(d[4]) | uint16(d[5])<<8,
+		Timeout:     uint16(d[6]) | uint16(d[7])<<8,
+	}
+	p, accept := c.connParamsRequested(p)
+	result := uint8(0x01) // rejected
+	if accept {
+		result = 0x00
+	}
+	if err := c.writeSignal(sigConnParamUpdateRsp, id, []byte{result, 0x00}); err != nil || !accept {
+		return err
+	}
+	_, err := c.hci.c.Send(cmd.LEConnUpdate{
+		ConnectionHandle:   c.attr,
+		ConnIntervalMin:    p.IntervalMin,
+		ConnIntervalMax:    p.IntervalMax,
+		ConnLatency:        p.Latency,
+		SupervisionTimeout: p.Timeout,
+	})
+	return err
+}
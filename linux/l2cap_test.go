@@ -0,0 +1,57 @@
+package linux
+
+import "testing"
+
+func TestConnParamsBoundsApply(t *testing.T) {
+	req := ConnParams{IntervalMin: 0x0010, IntervalMax: 0x0020, Latency: 4, Timeout: 0x0100}
+	tests := []struct {
+		name string
+		b    ConnParamsBounds
+		want ConnParams
+		ok   bool
+	}{
+		{
+			name: "no bounds",
+			want: req,
+			ok:   true,
+		},
+		{
+			name: "narrowed interval",
+			b:    ConnParamsBounds{IntervalMin: 0x0018, IntervalMax: 0x0018},
+			want: ConnParams{IntervalMin: 0x0018, IntervalMax: 0x0018, Latency: 4, Timeout: 0x0100},
+			ok:   true,
+		},
+		{
+			name: "interval out of the bounds",
+			b:    ConnParamsBounds{IntervalMin: 0x0028},
+			ok:   false,
+		},
+		{
+			name: "latency and timeout capped",
+			b:    ConnParamsBounds{LatencyMax: 2, TimeoutMax: 0x0080},
+			want: ConnParams{IntervalMin: 0x0010, IntervalMax: 0x0020, Latency: 2, Timeout: 0x0080},
+			ok:   true,
+		},
+		{
+			name: "timeout raised",
+			b:    ConnParamsBounds{TimeoutMin: 0x0200},
+			want: ConnParams{IntervalMin: 0x0010, IntervalMax: 0x0020, Latency: 4, Timeout: 0x0200},
+			ok:   true,
+		},
+		{
+			name: "timeout too short for the latency",
+			b:    ConnParamsBounds{TimeoutMax: 0x0014},
+			ok:   false,
+		},
+	}
+	for _, tt := range tests {
+		got, ok := tt.b.Apply(req)
+		if ok != tt.ok {
+			t.Errorf("%s: got ok %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package linux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/linux/cmd"
+	"github.com/grutz/gatt/linux/evt"
+)
+
+// ErrSyncLost is the reason of the periodic advertising syncs lost.
+var ErrSyncLost = errors.New("periodic advertising sync lost")
+
+// syncReportsLen is the number of reports buffered for each sync.
+const syncReportsLen = 16
+
+// A PeriodicReport is the data of an event of a periodic advertising train.
+type PeriodicReport struct {
+	TxPower   int8 // 127 if not available
+	RSSI      int8 // 127 if not available
+	Data      []byte
+	Truncated bool // the data was truncated by the controller
+}
+
+// A PeriodicSync is a synchronization to the periodic advertising train of
+// an extended advertising set.
+type PeriodicSync struct {
+	Handle      uint16
+	SID         uint8
+	AddressType constants.AddressType
+	Address     [6]byte
+	PHY         uint8
+	Interval    uint16 // N x 1.25 ms
+
+	h       *HCI
+	reports chan PeriodicReport // guarded by h.syncmu, closed once the sync ends
+	data    []byte              // data of the report being reassembled
+	err     error               // why the sync ended
+}
+
+// Reports returns the channel the reports of the sync are delivered on. The
+// reports are dropped while the channel is full. It's closed once the sync
+// is lost or closed.
+func (s *PeriodicSync) Reports() <-chan PeriodicReport { return s.reports }
+
+// Err returns why the sync ended, once the reports channel is closed:
+// ErrSyncLost, or nil if the sync was closed with Close.
+func (s *PeriodicSync) Err() error { return s.err }
+
+// Close terminates the sync.
+func (s *PeriodicSync) Close() error {
+	if !s.h.endSync(s.Handle, nil) {
+		return nil
+	}
+	return s.h.c.SendAndCheckResp(cmd.LEPeriodicAdvertisingTerminateSync{SyncHandle: s.Handle}, []byte{0x00})
+}
+
+// A syncResult is the outcome of a pending LE Periodic Advertising Create Sync.
+type syncResult struct {
+	s   *PeriodicSync
+	err error
+}
+
+// SupportsPeriodicAdvertising reports whether the controller supports the
+// periodic advertising, and the synchronization to it.
+func (h *HCI) SupportsPeriodicAdvertising() bool {
+	return h.leFeatures&leFeaturePeriodicAdvertising != 0
+}
+
+// SetPeriodicAdvertising configures the periodic advertising of the extended
+// advertising set p.AdvertisingHandle, and enables it. The set must be
+// neither connectable nor scannable. The data is fragmented as needed. The
+// periodic advertising runs while the set is enabled.
+func (h *HCI) SetPeriodicAdvertising(p cmd.LESetPeriodicAdvertisingParameters, data []byte) error {
+	if !h.SupportsPeriodicAdvertising() {
+		return ErrNotSupported
+	}
+	if len(data) > h.maxAdvDataLen {
+		return fmt.Errorf("periodic advertising data longer than %d bytes", h.maxAdvDataLen)
+	}
+	hdl := p.AdvertisingHandle
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	s, ok := h.advSets[hdl]
+	if !ok {
+		return fmt.Errorf("unknown advertising set 0x%02X", hdl)
+	}
+	if s.periodic {
+		if err := h.enablePeriodicAdv(hdl, false); err != nil {
+			return err
+		}
+		s.periodic = false
+	}
+	if err := h.c.SendAndCheckResp(p, []byte{0x00}); err != nil {
+		return err
+	}
+	err := sendAdvFragments(data, func(op uint8, b []byte) error {
+		return h.c.SendAndCheckResp(cmd.LESetPeriodicAdvertisingData{
+			AdvertisingHandle: hdl,
+			Operation:         op,
+			AdvertisingData:   b,
+		}, []byte{0x00})
+	})
+	if err != nil {
+		return err
+	}
+	if err := h.enablePeriodicAdv(hdl, true); err != nil {
+		return err
+	}
+	s.periodic = true
+	return nil
+}
+
+// StopPeriodicAdvertising disables the periodic advertising of the extended
+// advertising set hdl.
+func (h *HCI) StopPeriodicAdvertising(hdl uint8) error {
+	h.advmu.Lock()
+	defer h.advmu.Unlock()
+	s, ok := h.advSets[hdl]
+	if !ok || !s.periodic {
+		return nil
+	}
+	if err := h.enablePeriodicAdv(hdl, false); err != nil {
+		return err
+	}
+	s.periodic = false
+	return nil
+}
+
+func (h *HCI) enablePeriodicAdv(hdl uint8, en bool) error {
+	return h.c.SendAndCheckResp(cmd.LESetPeriodicAdvertisingEnable{
+		Enable:            btoi(en),
+		AdvertisingHandle: hdl,
+	}, []byte{0x00})
+}
+
+// CreateSync synchronizes to the periodic advertising train described by p,
+// which must be found by the extended scanning, so the scanning must be
+// enabled until the sync is established. The syncs are created one at a
+// time. The creation is canceled if ctx is done first.
+func (h *HCI) CreateSync(ctx context.Context, p cmd.LEPeriodicAdvertisingCreateSync) (*PeriodicSync, error) {
+	if !h.SupportsPeriodicAdvertising() {
+		return nil, ErrNotSupported
+	}
+	h.createSyncmu.Lock()
+	defer h.createSyncmu.Unlock()
+
+	resc := make(chan syncResult, 1)
+	h.syncmu.Lock()
+	h.syncc = resc
+	h.syncmu.Unlock()
+	defer func() {
+		h.syncmu.Lock()
+		h.syncc = nil
+		h.syncmu.Unlock()
+	}()
+
+	rsp, err := h.c.Send(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) == 0 || rsp[0] != 0x00 {
+		if len(rsp) == 0 {
+			return nil, errors.New("LE periodic advertising create sync failed")
+		}
+		return nil, constants.HCIStatus(rsp[0])
+	}
+	select {
+	case r := <-resc:
+		return r.s, r.err
+	case <-ctx.Done():
+	}
+	h.c.Send(cmd.LEPeriodicAdvertisingCreateSyncCancel{})
+	// The controller reports the creation as canceled, unless the sync was
+	// established meanwhile.
+	select {
+	case r := <-resc:
+		if r.err == nil {
+			r.s.Close()
+		}
+	case <-time.After(time.Second):
+	}
+	return nil, ctx.Err()
+}
+
+// endSync unregisters the sync hdl, records why it ended, and closes its
+// reports channel. It reports whether the sync was registered.
+func (h *HCI) endSync(hdl uint16, err error) bool {
+	h.syncmu.Lock()
+	defer h.syncmu.Unlock()
+	s, ok := h.syncs[hdl]
+	if !ok {
+		return false
+	}
+	delete(h.syncs, hdl)
+	s.err = err
+	close(s.reports)
+	return true
+}
+
+// isPeriodicAdvEvent reports whether the event packet b is one of the LE
+// events of the periodic advertising syncs.
+func isPeriodicAdvEvent(b []byte) bool {
+	if len(b) < 3 || b[0] != evt.LEMeta || int(b[1]) != len(b)-2 {
+		return false
+	}
+	switch b[2] {
+	case evt.LEPeriodicAdvertisingSyncEstablished, evt.LEPeriodicAdvertisingReport, evt.LEPeriodicAdvertisingSyncLost:
+		return true
+	}
+	return false
+}
+
+// handlePeriodicAdvEvent handles the LE events of the periodic advertising
+// syncs. It must be called in the order the events are received, so the
+// reports follow the establishment of their sync, and the data of a report
+// might span several events. It must not wait for the controller.
+func (h *HCI) handlePeriodicAdvEvent(b []byte) {
+	switch b[0] {
+	case evt.LEPeriodicAdvertisingSyncEstablished:
+		h.handleSyncEstablished(b)
+	case evt.LEPeriodicAdvertisingReport:
+		h.handlePeriodicReport(b)
+	case evt.LEPeriodicAdvertisingSyncLost:
+		ep := &evt.LEPeriodicAdvertisingSyncLostEP{}
+		if err := ep.Unmarshal(b); err != nil {
+			return
+		}
+		h.endSync(ep.SyncHandle, ErrSyncLost)
+	}
+}
+
+func (h *HCI) handleSyncEstablished(b []byte) {
+	ep := &evt.LEPeriodicAdvertisingSyncEstablishedEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	var r syncResult
+	if ep.Status != 0x00 {
+		r.err = constants.HCIStatus(ep.Status)
+	} else {
+		r.s = &PeriodicSync{
+			Handle:      ep.SyncHandle,
+			SID:         ep.AdvertisingSID,
+			AddressType: constants.AddressType(ep.AdvertiserAddressType),
+			Address:     ep.AdvertiserAddress,
+			PHY:         ep.AdvertiserPHY,
+			Interval:    ep.PeriodicAdvertisingInterval,
+			h:           h,
+			reports:     make(chan PeriodicReport, syncReportsLen),
+		}
+	}
+	h.syncmu.Lock()
+	if r.s != nil {
+		h.syncs[r.s.Handle] = r.s
+	}
+	resc := h.syncc
+	h.syncc = nil
+	h.syncmu.Unlock()
+
+	if resc != nil {
+		resc <- r
+		return
+	}
+	if r.s != nil {
+		log.Printf("periodic advertising sync 0x%04X not requested", r.s.Handle)
+		go r.s.Close()
+	}
+}
+
+// handlePeriodicReport reassembles the data of the periodic advertising
+// reports, and delivers the complete reports to their sync.
+func (h *HCI) handlePeriodicReport(b []byte) {
+	ep := &evt.LEPeriodicAdvertisingReportEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	h.syncmu.Lock()
+	defer h.syncmu.Unlock()
+	s, ok := h.syncs[ep.SyncHandle]
+	if !ok {
+		return
+	}
+	s.data = append(s.data, ep.Data...)
+	if ep.DataStatus == evt.PeriodicAdvDataIncomplete {
+		return
+	}
+	r := PeriodicReport{
+		TxPower:   ep.TxPower,
+		RSSI:      ep.RSSI,
+		Data:      s.data,
+		Truncated: ep.DataStatus == evt.PeriodicAdvDataTruncated,
+	}
+	s.data = nil
+	select {
+	case s.reports <- r:
+	default:
+	}
+}
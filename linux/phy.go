@@ -0,0 +1,163 @@
+package linux
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/linux/cmd"
+	"github.com/grutz/gatt/linux/evt"
+)
+
+// phyTimeout bounds the wait for the PHY update procedure, which completes
+// within a few connection events unless the remote device doesn't answer.
+const phyTimeout = 10 * time.Second
+
+// SupportsPHY2M reports whether the controller supports the LE 2M PHY.
+func (h *HCI) SupportsPHY2M() bool {
+	return h.leFeatures&leFeature2MPHY != 0
+}
+
+// SupportsCodedPHY reports whether the controller supports the LE Coded PHY.
+func (h *HCI) SupportsCodedPHY() bool {
+	return h.leFeatures&leFeatureCodedPHY != 0
+}
+
+// supportsPHYs reports whether the controller supports all the PHYs set in
+// phys, as cmd.PHY1MBit, cmd.PHY2MBit and cmd.PHYCodedBit.
+func (h *HCI) supportsPHYs(phys uint8) bool {
+	switch {
+	case phys&cmd.PHY2MBit != 0 && !h.SupportsPHY2M():
+		return false
+	case phys&cmd.PHYCodedBit != 0 && !h.SupportsCodedPHY():
+		return false
+	}
+	return true
+}
+
+// SetDefaultPHY sets the PHYs the controller prefers to transmit and receive
+// on, in the new connections. txPHYs and rxPHYs are sets of cmd.PHY1MBit,
+// cmd.PHY2MBit and cmd.PHYCodedBit; 0 means no preference.
+func (h *HCI) SetDefaultPHY(txPHYs, rxPHYs uint8) error {
+	if !h.SupportsPHY2M() && !h.SupportsCodedPHY() || !h.supportsPHYs(txPHYs|rxPHYs) {
+		return ErrNotSupported
+	}
+	return h.c.SendAndCheckResp(cmd.LESetDefaultPHY{
+		AllPHYs: allPHYs(txPHYs, rxPHYs),
+		TxPHYs:  txPHYs,
+		RxPHYs:  rxPHYs,
+	}, []byte{0x00})
+}
+
+// SetPHY asks the controller to transmit and receive on the given PHYs on
+// the connection to pd, and waits for the PHY update procedure to complete.
+// txPHYs and rxPHYs are sets of cmd.PHY1MBit, cmd.PHY2MBit and
+// cmd.PHYCodedBit; 0 means no preference. opts is the coding preferred on
+// the LE Coded PHY. The PHYs actually used are negotiated with the remote
+// device, and reported by ConnInfo.
+func (h *HCI) SetPHY(pd *PlatData, txPHYs, rxPHYs uint8, opts uint16) error {
+	if !h.SupportsPHY2M() && !h.SupportsCodedPHY() || !h.supportsPHYs(txPHYs|rxPHYs) {
+		return ErrNotSupported
+	}
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return errors.New("not connected")
+	}
+	ch := make(chan error, 1)
+	c.mu.Lock()
+	c.phyc = append(c.phyc, ch)
+	c.mu.Unlock()
+	defer c.unexpectPHY(ch)
+
+	rsp, err := h.c.Send(cmd.LESetPHY{
+		ConnectionHandle: c.attr,
+		AllPHYs:          allPHYs(txPHYs, rxPHYs),
+		TxPHYs:           txPHYs,
+		RxPHYs:           rxPHYs,
+		PHYOptions:       opts,
+	})
+	if err != nil {
+		return err
+	}
+	if len(rsp) == 0 || rsp[0] != 0x00 {
+		if len(rsp) == 0 {
+			return errors.New("LE set PHY failed")
+		}
+		return constants.HCIStatus(rsp[0])
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-c.done:
+		return errLinkClosed
+	case <-time.After(phyTimeout):
+		return errors.New("PHY update timed out")
+	}
+}
+
+// allPHYs returns the AllPHYs bits telling the controller which of txPHYs
+// and rxPHYs express no preference.
+func allPHYs(txPHYs, rxPHYs uint8) uint8 {
+	var all uint8
+	if txPHYs == 0 {
+		all |= cmd.AllPHYsNoTxPreference
+	}
+	if rxPHYs == 0 {
+		all |= cmd.AllPHYsNoRxPreference
+	}
+	return all
+}
+
+// readPHY reads the PHYs of the new connection c, which might not be the
+// LE 1M PHY if it was established on the LE Coded PHY, or if the controller
+// already updated it.
+func (h *HCI) readPHY(c *conn) {
+	if !h.SupportsPHY2M() && !h.SupportsCodedPHY() {
+		return
+	}
+	rsp, err := h.c.Send(cmd.LEReadPHY{ConnectionHandle: c.attr})
+	if err != nil || len(rsp) < 5 || rsp[0] != 0x00 {
+		return
+	}
+	c.mu.Lock()
+	c.info.TxPHY, c.info.RxPHY = rsp[3], rsp[4]
+	c.mu.Unlock()
+}
+
+func (h *HCI) handlePHYUpdateComplete(b []byte) {
+	ep := &evt.LEPHYUpdateCompleteEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	h.connsmu.Lock()
+	c, found := h.conns[ep.ConnectionHandle]
+	h.connsmu.Unlock()
+	if !found {
+		log.Printf("PHY update: connection 0x%04X probably expired", ep.ConnectionHandle)
+		return
+	}
+	var err error
+	changed := false
+	c.mu.Lock()
+	if ep.Status != 0x00 {
+		err = constants.HCIStatus(ep.Status)
+	} else if c.info.TxPHY != ep.TxPHY || c.info.RxPHY != ep.RxPHY {
+		c.info.TxPHY, c.info.RxPHY = ep.TxPHY, ep.RxPHY
+		changed = true
+	}
+	waiting := c.phyc
+	c.phyc = nil
+	c.mu.Unlock()
+
+	for _, ch := range waiting {
+		ch <- err
+	}
+	if err != nil {
+		log.Printf("PHY update: 0x%04X failed, %v", ep.ConnectionHandle, err)
+		return
+	}
+	if changed {
+		h.connInfoChanged(c)
+	}
+}
@@ -0,0 +1,314 @@
+package gatt
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/grutz/gatt/constants"
+)
+
+// A DataDecoder decodes the manufacturer specific data, or service data, of
+// an advertisement, without the company identifier or service UUID. It
+// returns nil if it doesn't understand the data.
+type DataDecoder func(b []byte) interface{}
+
+// Company identifiers of the built-in decoders
+const (
+	companyMicrosoft = 0x0006
+	companyTI        = 0x000D
+	companyNordic    = 0x0059
+)
+
+var (
+	decodersmu  sync.RWMutex
+	mfgDecoders = map[uint16]DataDecoder{
+		companyApple:     decodeAppleData,
+		companyMicrosoft: decodeSwiftPair,
+		companyTI:        decodeTISensorTag,
+		companyNordic:    decodeNordicBeacon,
+	}
+	svcDataDecoders = map[string]DataDecoder{
+		fastPairUUID.String(): decodeFastPair,
+	}
+)
+
+// RegisterManufacturerDecoder registers f as the decoder of the manufacturer
+// specific data of the company id, replacing the previous one, if any. A nil
+// f unregisters it. The decoded data is reported as Advertisement.Manufacturer.
+func RegisterManufacturerDecoder(id uint16, f DataDecoder) {
+	decodersmu.Lock()
+	defer decodersmu.Unlock()
+	if f == nil {
+		delete(mfgDecoders, id)
+		return
+	}
+	mfgDecoders[id] = f
+}
+
+// RegisterServiceDataDecoder registers f as the decoder of the data of the
+// service u, replacing the previous one, if any. A nil f unregisters it. The
+// decoded data is reported as ServiceData.Decoded.
+func RegisterServiceDataDecoder(u constants.UUID, f DataDecoder) {
+	decodersmu.Lock()
+	defer decodersmu.Unlock()
+	if f == nil {
+		delete(svcDataDecoders, u.String())
+		return
+	}
+	svcDataDecoders[u.String()] = f
+}
+
+// decodeManufacturerData decodes the manufacturer specific data md, if its
+// company has a decoder.
+func decodeManufacturerData(md []byte) interface{} {
+	if len(md) < 2 {
+		return nil
+	}
+	decodersmu.RLock()
+	f, ok := mfgDecoders[binary.LittleEndian.Uint16(md)]
+	decodersmu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return f(md[2:])
+}
+
+// decodeServiceData decodes the data of sd, if its service has a decoder.
+func decodeServiceData(sd ServiceData) interface{} {
+	decodersmu.RLock()
+	f, ok := svcDataDecoders[sd.UUID.String()]
+	decodersmu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return f(sd.Data)
+}
+
+// Apple Continuity message types
+const (
+	AppleIBeacon      = 0x02
+	AppleAirDrop      = 0x05
+	AppleAirPods      = 0x07
+	AppleAirPlay      = 0x09
+	AppleHandoff      = 0x0C
+	AppleHotspot      = 0x0E
+	AppleNearbyAction = 0x0F
+	AppleNearbyInfo   = 0x10
+	AppleFindMy       = 0x12
+)
+
+// An AppleMessage is a message of the manufacturer specific data of Apple.
+type AppleMessage struct {
+	Type uint8
+	Data []byte
+}
+
+// AppleData is the manufacturer specific data of Apple: an iBeacon, or the
+// messages of the Continuity protocol. The messages understood are decoded
+// as well.
+type AppleData struct {
+	Messages []AppleMessage
+
+	IBeacon      *IBeacon
+	Handoff      *AppleHandoffData
+	NearbyInfo   *AppleNearbyInfoData
+	NearbyAction *AppleNearbyActionData
+}
+
+// AppleHandoffData is a Continuity Handoff message, advertising the activity
+// of the user to their other devices.
+type AppleHandoffData struct {
+	Clipboard bool   // the clipboard has data to share
+	Sequence  uint16 // the IV of the encrypted payload
+	AuthTag   uint8
+	Payload   []byte // encrypted
+}
+
+// AppleNearbyInfoData is a Continuity Nearby Info message, advertising the
+// state of the device.
+type AppleNearbyInfoData struct {
+	StatusFlags uint8 // 4 bits
+	ActionCode  uint8 // 4 bits, the activity level of the user
+	DataFlags   uint8
+	AuthTag     []byte
+}
+
+// AppleNearbyActionData is a Continuity Nearby Action message, asking the
+// nearby devices for an action, e.g. setting up a device.
+type AppleNearbyActionData struct {
+	Flags uint8
+	Type  uint8
+	Data  []byte // the authentication tag and parameters of the action
+}
+
+// decodeAppleData decodes the messages of the manufacturer specific data of
+// Apple. The messages truncated are dropped.
+func decodeAppleData(b []byte) interface{} {
+	a := &AppleData{}
+	for len(b) >= 2 && len(b) >= 2+int(b[1]) {
+		raw := b[:2+int(b[1])]
+		m := AppleMessage{Type: raw[0], Data: raw[2:]}
+		a.Messages = append(a.Messages, m)
+		b = b[len(raw):]
+
+		d := m.Data
+		switch {
+		case m.Type == AppleIBeacon:
+			a.IBeacon, _ = decodeIBeaconPayload(raw)
+		case m.Type == AppleHandoff && len(d) >= 4:
+			a.Handoff = &AppleHandoffData{
+				Clipboard: d[0]&0x08 != 0,
+				Sequence:  binary.LittleEndian.Uint16(d[1:]),
+				AuthTag:   d[3],
+				Payload:   d[4:],
+			}
+		case m.Type == AppleNearbyInfo && len(d) >= 2:
+			a.NearbyInfo = &AppleNearbyInfoData{
+				StatusFlags: d[0] >> 4,
+				ActionCode:  d[0] & 0x0F,
+				DataFlags:   d[1],
+				AuthTag:     d[2:],
+			}
+		case m.Type == AppleNearbyAction && len(d) >= 2:
+			a.NearbyAction = &AppleNearbyActionData{Flags: d[0], Type: d[1], Data: d[2:]}
+		}
+	}
+	if len(a.Messages) == 0 {
+		return nil
+	}
+	return a
+}
+
+// Microsoft Swift Pair sub-scenarios
+const (
+	SwiftPairLE         = 0x00 // pairing over LE only
+	SwiftPairBREDR      = 0x01 // pairing over BR/EDR, advertised over LE
+	SwiftPairLEAndBREDR = 0x02 // pairing over LE and BR/EDR with Secure Connections
+	swiftPairScenario   = 0x03 // the Microsoft Beacon ID of Swift Pair
+)
+
+// SwiftPairData is the manufacturer specific data of Microsoft Swift Pair,
+// which offers Windows to pair with the device.
+type SwiftPairData struct {
+	SubScenario   uint8
+	BREDRAddress  net.HardwareAddr // the BR/EDR address, for SwiftPairBREDR
+	ClassOfDevice uint32           // the BR/EDR class of device, 0 for SwiftPairLE
+	DisplayName   string
+}
+
+// decodeSwiftPair decodes the Microsoft Beacon of Swift Pair.
+func decodeSwiftPair(b []byte) interface{} {
+	if len(b) < 3 || b[0] != swiftPairScenario {
+		return nil
+	}
+	s := &SwiftPairData{SubScenario: b[1]}
+	b = b[3:] // the RSSI byte is reserved
+	switch s.SubScenario {
+	case SwiftPairLE:
+	case SwiftPairBREDR:
+		if len(b) < 9 {
+			return nil
+		}
+		s.BREDRAddress = net.HardwareAddr{b[5], b[4], b[3], b[2], b[1], b[0]}
+		s.ClassOfDevice = uint32(b[6]) | uint32(b[7])<<8 | uint32(b[8])<<16
+		b = b[9:]
+	case SwiftPairLEAndBREDR:
+		if len(b) < 3 {
+			return nil
+		}
+		s.ClassOfDevice = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		b = b[3:]
+	default:
+		return nil
+	}
+	s.DisplayName = zeroTruncate(b)
+	return s
+}
+
+// fastPairUUID is the service UUID of the Google Fast Pair advertisements.
+var fastPairUUID = constants.UUID16(0xFE2C)
+
+// FastPairData is the service data of Google Fast Pair. The discoverable
+// devices advertise their model ID; the others advertise the filter of the
+// account keys they are paired with.
+type FastPairData struct {
+	Discoverable     bool
+	ModelID          uint32 // 24 bits, if Discoverable
+	AccountKeyFilter []byte // if not Discoverable
+	ShowUI           bool   // the seekers should notify the user of the device
+	Salt             []byte
+}
+
+// Fast Pair field types
+const (
+	fastPairShowUIFilter = 0x00
+	fastPairSalt         = 0x01
+	fastPairHideUIFilter = 0x02
+)
+
+// decodeFastPair decodes the service data of Google Fast Pair.
+func decodeFastPair(b []byte) interface{} {
+	if len(b) == 3 {
+		return &FastPairData{
+			Discoverable: true,
+			ModelID:      uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]),
+		}
+	}
+	if len(b) < 1 || b[0] != 0x00 {
+		// Unknown version and flags.
+		return nil
+	}
+	f := &FastPairData{}
+	for b = b[1:]; len(b) > 0; {
+		n, t := int(b[0]>>4), b[0]&0x0F
+		if len(b) < 1+n {
+			return nil
+		}
+		d := b[1 : 1+n]
+		b = b[1+n:]
+		switch t {
+		case fastPairShowUIFilter, fastPairHideUIFilter:
+			f.AccountKeyFilter = d
+			f.ShowUI = t == fastPairShowUIFilter && n > 0
+		case fastPairSalt:
+			f.Salt = d
+		}
+	}
+	return f
+}
+
+// TISensorTagData is the manufacturer specific data of the Texas Instruments
+// SensorTags, reporting the state of their keys.
+type TISensorTagData struct {
+	DeviceID uint16
+	Keys     uint8 // TISensorTagKey bits
+}
+
+// TI SensorTag key bits
+const (
+	TISensorTagKeyLeft  = 0x01 // the left, or user, key is pressed
+	TISensorTagKeyRight = 0x02 // the right, or power, key is pressed
+	TISensorTagReed     = 0x04 // the reed relay is closed
+)
+
+func decodeTISensorTag(b []byte) interface{} {
+	if len(b) != 3 {
+		return nil
+	}
+	return &TISensorTagData{DeviceID: binary.LittleEndian.Uint16(b), Keys: b[2]}
+}
+
+// NordicBeaconData is the manufacturer specific data of the beacons of the
+// Nordic Semiconductor SDK, laid out as an iBeacon.
+type NordicBeaconData struct {
+	IBeacon
+}
+
+func decodeNordicBeacon(b []byte) interface{} {
+	ib, ok := decodeIBeaconPayload(b)
+	if !ok {
+		return nil
+	}
+	return &NordicBeaconData{*ib}
+}
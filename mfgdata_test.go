@@ -0,0 +1,165 @@
+package gatt
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/grutz/gatt/constants"
+)
+
+func TestManufacturerDecoders(t *testing.T) {
+	cases := []struct {
+		name string
+		md   []byte
+		want interface{}
+	}{
+		{
+			name: "Apple Nearby Info",
+			md:   unhex("4C00 10 05 0B1C 6FA231"),
+			want: &AppleData{
+				Messages:   []AppleMessage{{Type: AppleNearbyInfo, Data: unhex("0B1C 6FA231")}},
+				NearbyInfo: &AppleNearbyInfoData{StatusFlags: 0x0, ActionCode: 0x0B, DataFlags: 0x1C, AuthTag: unhex("6FA231")},
+			},
+		},
+		{
+			name: "Apple Nearby Action and Info",
+			md:   unhex("4C00 0F 05 9013 A1B2C3 10 02 711C"),
+			want: &AppleData{
+				Messages: []AppleMessage{
+					{Type: AppleNearbyAction, Data: unhex("9013 A1B2C3")},
+					{Type: AppleNearbyInfo, Data: unhex("711C")},
+				},
+				NearbyAction: &AppleNearbyActionData{Flags: 0x90, Type: 0x13, Data: unhex("A1B2C3")},
+				NearbyInfo:   &AppleNearbyInfoData{StatusFlags: 0x7, ActionCode: 0x1, DataFlags: 0x1C, AuthTag: []byte{}},
+			},
+		},
+		{
+			name: "Apple Handoff",
+			md:   unhex("4C00 0C 0E 08 3412 AB 00112233445566778899"),
+			want: &AppleData{
+				Messages: []AppleMessage{{Type: AppleHandoff, Data: unhex("08 3412 AB 00112233445566778899")}},
+				Handoff:  &AppleHandoffData{Clipboard: true, Sequence: 0x1234, AuthTag: 0xAB, Payload: unhex("00112233445566778899")},
+			},
+		},
+		{
+			name: "Apple truncated",
+			md:   unhex("4C00 10 05 0B"),
+		},
+		{
+			name: "Swift Pair LE",
+			md:   append(unhex("0600 03 00 80"), "Mouse"...),
+			want: &SwiftPairData{SubScenario: SwiftPairLE, DisplayName: "Mouse"},
+		},
+		{
+			name: "Swift Pair BR/EDR",
+			md:   append(unhex("0600 03 01 80 050403020100 040540"), "Keyboard"...),
+			want: &SwiftPairData{
+				SubScenario:   SwiftPairBREDR,
+				BREDRAddress:  net.HardwareAddr{0x00, 0x01, 0x02, 0x03, 0x04, 0x05},
+				ClassOfDevice: 0x400504,
+				DisplayName:   "Keyboard",
+			},
+		},
+		{
+			name: "Microsoft not Swift Pair",
+			md:   unhex("0600 01 09 2002"),
+		},
+		{
+			name: "TI SensorTag",
+			md:   unhex("0D00 0300 01"),
+			want: &TISensorTagData{DeviceID: 0x0003, Keys: TISensorTagKeyLeft},
+		},
+		{
+			name: "Nordic beacon",
+			md:   unhex("5900 02 15 01122334455667788990AABBCCDDEEFF 0001 0002 C3"),
+			want: &NordicBeaconData{IBeacon{
+				UUID:          constants.MustParseUUID("01122334-4556-6778-8990-AABBCCDDEEFF"),
+				Major:         1,
+				Minor:         2,
+				MeasuredPower: -61,
+			}},
+		},
+		{
+			name: "no decoder",
+			md:   unhex("FFFF 0102"),
+		},
+	}
+
+	for _, tt := range cases {
+		a := &Advertisement{}
+		if err := a.unmarshall((&AdvPacket{}).AppendField(typeManufacturerData, tt.md).b); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(a.Manufacturer, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, a.Manufacturer, tt.want)
+		}
+	}
+}
+
+func TestFastPairDecoder(t *testing.T) {
+	cases := []struct {
+		name string
+		b    []byte
+		want interface{}
+	}{
+		{
+			name: "discoverable",
+			b:    []byte{0x2C, 0x4D, 0x36},
+			want: &FastPairData{Discoverable: true, ModelID: 0x2C4D36},
+		},
+		{
+			name: "not discoverable",
+			b:    []byte{0x00, 0x40, 0x0A, 0x0B, 0x0C, 0x0D, 0x11, 0x42},
+			want: &FastPairData{AccountKeyFilter: []byte{0x0A, 0x0B, 0x0C, 0x0D}, ShowUI: true, Salt: []byte{0x42}},
+		},
+		{
+			name: "no account keys",
+			b:    []byte{0x00, 0x00},
+			want: &FastPairData{AccountKeyFilter: []byte{}},
+		},
+		{
+			name: "unknown version",
+			b:    []byte{0x20, 0x00},
+		},
+	}
+
+	for _, tt := range cases {
+		a := &Advertisement{}
+		if err := a.unmarshall((&AdvPacket{}).AppendServiceData(fastPairUUID, tt.b).b); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := a.ServiceData[0].Decoded; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterDecoders(t *testing.T) {
+	const company = 0xFFFE
+	u := constants.UUID16(0xFFFE)
+	decode := func(b []byte) interface{} { return string(b) }
+	RegisterManufacturerDecoder(company, decode)
+	RegisterServiceDataDecoder(u, decode)
+
+	p := (&AdvPacket{}).AppendManufacturerData(company, []byte("mfg")).AppendServiceData(u, []byte("svc"))
+	a := &Advertisement{}
+	if err := a.unmarshall(p.b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Manufacturer != "mfg" || a.ServiceData[0].Decoded != "svc" {
+		t.Errorf("got %v and %v, want mfg and svc", a.Manufacturer, a.ServiceData[0].Decoded)
+	}
+
+	RegisterManufacturerDecoder(company, nil)
+	RegisterServiceDataDecoder(u, nil)
+	a = &Advertisement{}
+	if err := a.unmarshall(p.b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Manufacturer != nil || a.ServiceData[0].Decoded != nil {
+		t.Errorf("unregistered: got %v and %v, want nil", a.Manufacturer, a.ServiceData[0].Decoded)
+	}
+}
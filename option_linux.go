@@ -2,8 +2,13 @@ package gatt
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"time"
 
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/linux"
 	"github.com/grutz/gatt/linux/cmd"
 )
 
@@ -39,6 +44,8 @@ func LnxSetAdvertisingEnable(en bool) Option {
 		if dd == nil {
 			return errors.New("device is not initialized")
 		}
+		dd.advmu.Lock()
+		defer dd.advmu.Unlock()
 		if err := dd.update(); err != nil {
 			return err
 		}
@@ -50,7 +57,10 @@ func LnxSetAdvertisingEnable(en bool) Option {
 // This option can be used with NewDevice or Option on Linux implementation.
 func LnxSetAdvertisingData(c *cmd.LESetAdvertisingData) Option {
 	return func(d Device) error {
-		d.(*device).advData = c
+		dd := d.(*device)
+		dd.advmu.Lock()
+		dd.advData = c
+		dd.advmu.Unlock()
 		return nil
 	}
 }
@@ -59,7 +69,10 @@ func LnxSetAdvertisingData(c *cmd.LESetAdvertisingData) Option {
 // This option can be used with NewDevice or Option on Linux implementation.
 func LnxSetScanResponseData(c *cmd.LESetScanResponseData) Option {
 	return func(d Device) error {
-		d.(*device).scanResp = c
+		dd := d.(*device)
+		dd.advmu.Lock()
+		dd.scanResp = c
+		dd.advmu.Unlock()
 		return nil
 	}
 }
@@ -68,7 +81,10 @@ func LnxSetScanResponseData(c *cmd.LESetScanResponseData) Option {
 // This option can be used with NewDevice or Option on Linux implementation.
 func LnxSetAdvertisingParameters(c *cmd.LESetAdvertisingParameters) Option {
 	return func(d Device) error {
-		d.(*device).advParam = c
+		dd := d.(*device)
+		dd.advmu.Lock()
+		dd.advParam = c
+		dd.advmu.Unlock()
 		return nil
 	}
 }
@@ -110,3 +126,254 @@ func LnxSetScanMode(active bool) Option {
 		return nil
 	}
 }
+
+// LnxExtendedScan sets whether the extended scanning is used, if the
+// controller supports it, to discover the extended advertisements, e.g. of
+// the Bluetooth 5 devices, as well as the legacy ones. The scan parameters
+// set with LnxSetScanParameters and LnxSetScanMode apply on the LE 1M PHY.
+// The controllers reject the legacy advertising commands once the extended
+// ones have been used; advertise with AdvertiseSet along with this option.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxExtendedScan(en bool) Option {
+	return func(d Device) error {
+		d.(*device).extScan = en
+		return nil
+	}
+}
+
+// LnxBondStore sets the store of bonded devices.
+// The IRKs of the bonds are used to resolve the private addresses of
+// advertisers and connecting centrals. If the controller supports it, the
+// resolution is offloaded to its resolving list, which is reloaded every
+// time this option is applied; apply it again after changing the store.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxBondStore(s BondStore) Option {
+	return func(d Device) error {
+		d.(*device).bonds = s
+		if d.(*device).state != StatePoweredOn {
+			return nil
+		}
+		return d.(*device).loadResolvingList()
+	}
+}
+
+// LnxAddToAcceptList adds a device to the filter accept list (white list) of the HCI device.
+// Advertising, scanning and connecting with the accept list are suspended while the list changes.
+// This option can be used with Option on Linux implementation.
+func LnxAddToAcceptList(t constants.AddressType, addr net.HardwareAddr) Option {
+	return func(d Device) error {
+		a, err := bdaddr(addr)
+		if err != nil {
+			return err
+		}
+		return d.(*device).hci.AddToWhiteList(t, a)
+	}
+}
+
+// LnxRemoveFromAcceptList removes a device from the filter accept list (white list) of the HCI device.
+// This option can be used with Option on Linux implementation.
+func LnxRemoveFromAcceptList(t constants.AddressType, addr net.HardwareAddr) Option {
+	return func(d Device) error {
+		a, err := bdaddr(addr)
+		if err != nil {
+			return err
+		}
+		return d.(*device).hci.RemoveFromWhiteList(t, a)
+	}
+}
+
+// LnxClearAcceptList removes all the devices from the filter accept list (white list) of the HCI device.
+// This option can be used with Option on Linux implementation.
+func LnxClearAcceptList() Option {
+	return func(d Device) error {
+		return d.(*device).hci.ClearWhiteList()
+	}
+}
+
+// LnxScanAcceptList sets whether scanning only reports the devices in the filter accept list.
+// It takes effect on the next Scan.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxScanAcceptList(en bool) Option {
+	return func(d Device) error {
+		if d.(*device).scanParam == nil {
+			d.(*device).scanParam = cmd.NewLESetScanParameters()
+		}
+		d.(*device).scanParam.ScanningFilterPolicy = btoi(en)
+		return nil
+	}
+}
+
+// LnxAdvertiseAcceptList sets whether scan requests, connection requests, or
+// both, are only accepted from the devices in the filter accept list.
+// It takes effect on the next Advertise.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxAdvertiseAcceptList(scan, conn bool) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		dd.advmu.Lock()
+		dd.pendingAdvParam().AdvertisingFilterPolicy = btoi(scan) | btoi(conn)<<1
+		dd.advmu.Unlock()
+		return nil
+	}
+}
+
+// LnxAutoConnect starts connecting to the devices in the filter accept list,
+// if en is true, or cancels it otherwise. The first device that connects is
+// reported with the PeripheralConnected handler; apply the option again to
+// connect to the next one.
+// This option can be used with Option on Linux implementation.
+func LnxAutoConnect(en bool) Option {
+	return func(d Device) error {
+		if en {
+			return d.(*device).hci.ConnectWhiteList()
+		}
+		return d.(*device).hci.CancelConnectWhiteList()
+	}
+}
+
+// LnxConnectMultiple sets whether the connections queued with Connect are
+// established several at once, through the filter accept list, rather than
+// in turn. The peripherals are then connected to in the order they show up.
+// The entries added to the list are removed once they are connected.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxConnectMultiple(en bool) Option {
+	return func(d Device) error {
+		d.(*device).connMulti = en
+		if d.(*device).hci != nil {
+			d.(*device).hci.SetConnectMultiple(en)
+		}
+		return nil
+	}
+}
+
+// LnxConnectTimeout sets the time given to each connection attempt, after
+// which the peripherals attempted are reported to the PeripheralConnected
+// handler with linux.ErrConnectTimeout, and the next queued are attempted.
+// The default is 0, which waits indefinitely.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxConnectTimeout(t time.Duration) Option {
+	return func(d Device) error {
+		d.(*device).connTimeout = t
+		if d.(*device).hci != nil {
+			d.(*device).hci.SetConnectTimeout(t)
+		}
+		return nil
+	}
+}
+
+// LnxConnParamsPolicy sets the policy applied to the connection parameters
+// update requests of the remote peripherals, sent over L2CAP or by the link
+// layer. f returns the parameters to apply, which might differ from the
+// requested ones, or false to reject the update. Requests with values out of
+// the ranges allowed by the spec are always rejected, as are invalid values
+// returned by f. Without a policy, all the valid requests are accepted as is.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxConnParamsPolicy(f func(p Peripheral, c linux.ConnParams) (linux.ConnParams, bool)) Option {
+	return func(d Device) error {
+		d.(*device).connParamsPolicy = f
+		return nil
+	}
+}
+
+// LnxConnParamsBounds sets a policy which narrows the connection parameters
+// requested by the remote peripherals to the bounds b, and rejects the
+// requests whose interval range is out of the bounds. The zero fields of b
+// don't bound the parameters.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxConnParamsBounds(b linux.ConnParamsBounds) Option {
+	return LnxConnParamsPolicy(func(p Peripheral, c linux.ConnParams) (linux.ConnParams, bool) {
+		return b.Apply(c)
+	})
+}
+
+// LnxEATTBearers sets the number of enhanced ATT bearers opened to each
+// connected peripheral which supports them, in addition to the unenhanced
+// one. Requests are then served concurrently, over the bearers available.
+// The default is 0, which leaves EATT disabled.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxEATTBearers(n int) Option {
+	return func(d Device) error {
+		d.(*device).eattBearers = n
+		return nil
+	}
+}
+
+// LnxDataLength sets the maximum number of payload octets, and the maximum
+// time in microseconds, the controller uses to transmit a single LE data
+// packet on new connections. By default, controllers which support the LE
+// Data Length Extension use the longest packets they can.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxDataLength(txOctets, txTime uint16) Option {
+	return func(d Device) error {
+		d.(*device).txOctets = txOctets
+		d.(*device).txTime = txTime
+		if d.(*device).state != StatePoweredOn {
+			return nil
+		}
+		return d.(*device).hci.SetDefaultDataLength(txOctets, txTime)
+	}
+}
+
+// LnxConnDataLength sets the maximum number of payload octets, and the
+// maximum time in microseconds, the controller uses to transmit a single LE
+// data packet on the connection to c, which is a connected Central or
+// Peripheral. The lengths actually used are negotiated with the remote device.
+// This option can be used with Option on Linux implementation.
+func LnxConnDataLength(c interface{}, txOctets, txTime uint16) Option {
+	return func(d Device) error {
+		pd := d.(*device).platData(c)
+		if pd == nil {
+			return errors.New("not connected")
+		}
+		return d.(*device).hci.SetDataLength(pd, txOctets, txTime)
+	}
+}
+
+// LnxDefaultPHY sets the PHYs the controller prefers to transmit on, tx,
+// and to receive on, rx, in the new connections; 0 leaves the choice to the
+// controller. The PHYs actually used are negotiated with the remote devices.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxDefaultPHY(tx, rx PHY) Option {
+	return func(d Device) error {
+		d.(*device).txPHY = tx
+		d.(*device).rxPHY = rx
+		if d.(*device).state != StatePoweredOn {
+			return nil
+		}
+		return d.(*device).hci.SetDefaultPHY(phyBits(tx), phyBits(rx))
+	}
+}
+
+// LnxScanPHYs sets the PHYs to scan on: PHY1M, PHYCoded, or both, e.g. to
+// discover the long range devices advertising on the LE Coded PHY. The
+// connections are then initiated on the same PHYs. It enables the extended
+// scanning, see LnxExtendedScan.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxScanPHYs(phys ...PHY) Option {
+	return func(d Device) error {
+		for _, p := range phys {
+			if p != PHY1M && p != PHYCoded {
+				return fmt.Errorf("can't scan on the %v PHY", p)
+			}
+		}
+		d.(*device).scanPHYs = phys
+		d.(*device).extScan = true
+		return nil
+	}
+}
+
+func bdaddr(addr net.HardwareAddr) ([6]byte, error) {
+	var a [6]byte
+	if len(addr) != len(a) {
+		return a, fmt.Errorf("invalid device address %v", addr)
+	}
+	copy(a[:], addr)
+	return a, nil
+}
+
+func btoi(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -2,7 +2,11 @@ package gatt
 
 import (
 	"bytes"
+	"net"
+	"time"
 
+	"github.com/grutz/gatt/constants"
+	"github.com/grutz/gatt/linux"
 	"github.com/grutz/gatt/linux/cmd"
 )
 
@@ -67,6 +71,22 @@ func ExampleLnxSetScanParameters() {
 	d.Option(o)          // Or dynamically with Option.
 }
 
+func ExampleLnxAddToAcceptList() {
+	d, _ := NewDevice(LnxScanAcceptList(true)) // Only report the devices in the accept list.
+	addr, _ := net.ParseMAC("C0:11:22:33:44:55")
+	d.Option(LnxAddToAcceptList(constants.AddressTypeRandom, addr)) // Can only be used with Option.
+	d.Scan(nil, false)
+}
+
+func ExampleLnxAutoConnect() {
+	d, _ := NewDevice()
+	addr, _ := net.ParseMAC("C0:11:22:33:44:55")
+	d.Option(
+		LnxAddToAcceptList(constants.AddressTypeRandom, addr),
+		LnxAutoConnect(true), // Connect to whichever device of the accept list shows up first.
+	)
+}
+
 func ExampleLnxSendHCIRawCommand_predefinedCommand() {
 	// Send a predefined command of cmd package.
 	c := &cmd.LESetScanResponseData{
@@ -110,3 +130,77 @@ func ExampleLnxSendHCIRawCommand_customCommand() {
 	d, _ := NewDevice()
 	d.Option(LnxSendHCIRawCommand(c, nil)) // Can only be used with Option
 }
+
+func ExampleLnxConnParamsPolicy() {
+	// Don't let the peripherals slow down the connections beyond 100 ms.
+	o := LnxConnParamsPolicy(func(p Peripheral, c linux.ConnParams) (linux.ConnParams, bool) {
+		if c.IntervalMax > 80 { // 1.25 ms * 80 = 100 ms
+			c.IntervalMax = 80
+		}
+		return c, c.IntervalMin <= c.IntervalMax
+	})
+	d, _ := NewDevice(o)
+	d.Option(o)
+}
+
+func ExampleLnxConnParamsBounds() {
+	o := LnxConnParamsBounds(linux.ConnParamsBounds{
+		IntervalMin: 0x0018, // 1.25 ms * 24 = 30 ms
+		IntervalMax: 0x0050, // 1.25 ms * 80 = 100 ms
+		LatencyMax:  4,      // connection events
+		TimeoutMin:  0x0064, // 10 ms * 100 = 1 s
+		TimeoutMax:  0x0258, // 10 ms * 600 = 6 s
+	})
+	d, _ := NewDevice(o)
+	d.Option(o)
+}
+
+func ExampleLnxConnDataLength() {
+	d, _ := NewDevice()
+	d.Handle(PeripheralConnected(func(p Peripheral, err error) {
+		// Send up to 251 octets in a single LE data packet.
+		d.Option(LnxConnDataLength(p, 251, 2120))
+	}))
+}
+
+func ExampleLnxConnectMultiple() {
+	d, _ := NewDevice(
+		LnxConnectMultiple(true),          // Connect to the peripherals in the order they show up.
+		LnxConnectTimeout(30*time.Second), // Give up on those which don't within 30 seconds.
+	)
+	d.Handle(PeripheralConnected(func(p Peripheral, err error) {
+		if err != nil {
+			// Handle the failure of this peripheral only.
+		}
+	}))
+}
+
+func ExampleLnxExtendedScan() {
+	d, _ := NewDevice(LnxExtendedScan(true))
+	d.Handle(PeripheralDiscovered(func(p Peripheral, a *Advertisement, rssi int) {
+		if a.Extended && a.SecondaryPHY == PHYCoded {
+			// A long range advertisement.
+		}
+	}))
+}
+
+func ExampleLnxScanPHYs() {
+	d, _ := NewDevice(LnxScanPHYs(PHY1M, PHYCoded))
+	d.Handle(PeripheralDiscovered(func(p Peripheral, a *Advertisement, rssi int) {
+		if a.PrimaryPHY == PHYCoded {
+			// A long range advertisement; the connection is initiated on the
+			// LE Coded PHY as well.
+			d.Connect(p)
+		}
+	}))
+}
+
+func ExampleLnxDefaultPHY() {
+	d, _ := NewDevice(LnxDefaultPHY(PHY2M, PHY2M))
+	d.Handle(PeripheralConnected(func(p Peripheral, err error) {
+		// Or per connection, e.g. before a bulk transfer.
+		if err := p.SetPHY(PHY2M, PHY2M); err != nil {
+			return
+		}
+	}))
+}
@@ -0,0 +1,36 @@
+package gatt
+
+import (
+	"time"
+)
+
+// A PeriodicReport is the data of an event of a periodic advertising train.
+type PeriodicReport struct {
+	Data      []byte
+	TxPower   int  // TX power of the advertiser, 127 if not available
+	RSSI      int  // 127 if not available
+	Truncated bool // the data was truncated by the controller
+}
+
+// A PeriodicSync is a synchronization to the periodic advertising of an
+// advertising set, established with Device.SyncPeriodic.
+type PeriodicSync struct {
+	SID      uint8         // Advertising set identifier.
+	PHY      PHY           // PHY of the periodic advertising.
+	Interval time.Duration // Interval of the periodic advertising.
+
+	// Reports delivers the data of the periodic advertising events. The
+	// reports are dropped while the channel is full. It's closed once the
+	// sync is lost, or closed.
+	Reports <-chan PeriodicReport
+
+	err   error // why the sync ended, set before Reports is closed
+	close func() error
+}
+
+// Err returns why the sync ended once Reports is closed, or nil if it was
+// closed with Close.
+func (s *PeriodicSync) Err() error { return s.err }
+
+// Close terminates the sync.
+func (s *PeriodicSync) Close() error { return s.close() }
@@ -1,7 +1,9 @@
 package gatt
 
 import (
+	"context"
 	"errors"
+	"net"
 	"sync"
 
 	"github.com/grutz/gatt/constants"
@@ -65,6 +67,21 @@ type Peripheral interface {
 
 	// SetMTU sets the mtu for the remote peripheral.
 	SetMTU(mtu uint16) error
+
+	// SecurityLevel returns the current security level of the connection.
+	SecurityLevel() SecurityLevel
+
+	// ConnInfo returns the current parameters of the connection.
+	ConnInfo() ConnInfo
+
+	// SetPHY asks to transmit on the PHY tx, and to receive on the PHY rx, on
+	// the connection; 0 leaves the choice to the controller. It returns once
+	// the PHYs are negotiated with the remote device, which might keep others;
+	// ConnInfo reports the PHYs used.
+	SetPHY(tx, rx PHY) error
+
+	// DialL2CAP opens an L2CAP LE Credit Based Connection to the LE_PSM psm of the remote peripheral.
+	DialL2CAP(ctx context.Context, psm uint16) (net.Conn, error)
 }
 
 type subscriber struct {
@@ -1,8 +1,10 @@
 package gatt
 
 import (
+	"context"
 	"errors"
 	"log"
+	"net"
 
 	"github.com/grutz/gatt/constants"
 	"github.com/grutz/gatt/xpc"
@@ -210,6 +212,26 @@ func (p *peripheral) SetMTU(mtu uint16) error {
 	return errors.New("Not implemented")
 }
 
+// SecurityLevel always returns SecurityLow, as the link security is not
+// reported by CoreBluetooth.
+func (p *peripheral) SecurityLevel() SecurityLevel {
+	return SecurityLow
+}
+
+// ConnInfo always returns the zero value, as the connection parameters are
+// not reported by CoreBluetooth.
+func (p *peripheral) ConnInfo() ConnInfo {
+	return ConnInfo{}
+}
+
+func (p *peripheral) SetPHY(tx, rx PHY) error {
+	return notImplemented
+}
+
+func (p *peripheral) DialL2CAP(ctx context.Context, psm uint16) (net.Conn, error) {
+	return nil, notImplemented
+}
+
 func uuidSlice(uu []constants.UUID) [][]byte {
 	us := [][]byte{}
 	for _, u := range uu {
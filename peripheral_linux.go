@@ -2,6 +2,7 @@ package gatt
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/grutz/gatt/constants"
 	"github.com/grutz/gatt/linux"
@@ -31,16 +34,60 @@ type peripheral struct {
 	l2c io.ReadWriteCloser
 
 	reqc  chan message
+	attc  chan message // requests for the unenhanced bearer
 	quitc chan struct{}
 
 	pd *linux.PlatData // platform specific data
+
+	security   SecurityLevel
+	securitymu *sync.Mutex
 }
 
 func (p *peripheral) Device() Device       { return p.d }
-func (p *peripheral) ID() string           { return strings.ToUpper(net.HardwareAddr(p.pd.Address[:]).String()) }
 func (p *peripheral) Name() string         { return p.pd.Name }
 func (p *peripheral) Services() []*Service { return p.svcs }
 
+// ID returns the identity address of the peripheral if its private address
+// has been resolved, and the advertised address otherwise.
+func (p *peripheral) ID() string {
+	if p.pd.Resolved {
+		return strings.ToUpper(net.HardwareAddr(p.pd.IdentityAddress[:]).String())
+	}
+	return strings.ToUpper(net.HardwareAddr(p.pd.Address[:]).String())
+}
+
+func (p *peripheral) SecurityLevel() SecurityLevel {
+	p.securitymu.Lock()
+	defer p.securitymu.Unlock()
+	return p.security
+}
+
+func (p *peripheral) ConnInfo() ConnInfo {
+	ci, ok := p.d.hci.ConnInfo(p.pd)
+	if !ok {
+		return ConnInfo{}
+	}
+	return connInfo(ci)
+}
+
+func (p *peripheral) SetPHY(tx, rx PHY) error {
+	return p.d.setPHY(p.pd, tx, rx)
+}
+
+func (p *peripheral) setSecurityLevel(l SecurityLevel) {
+	p.securitymu.Lock()
+	p.security = l
+	p.securitymu.Unlock()
+}
+
+func (p *peripheral) DialL2CAP(ctx context.Context, psm uint16) (net.Conn, error) {
+	ch, err := p.d.hci.DialCoC(ctx, p.pd, psm)
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
 func finish(op byte, h uint16, b []byte) (bool, error) {
 	done := b[0] == constants.AttOpError && b[1] == op && b[2] == byte(h) && b[3] == byte(h>>8)
 	var err error
@@ -384,76 +431,183 @@ func (p *peripheral) sendCmd(op byte, b []byte) {
 
 func (p *peripheral) sendReq(op byte, b []byte) []byte {
 	m := message{op: op, b: b, rspc: make(chan []byte)}
-	p.reqc <- m
+	if op == constants.AttOpMtuReq {
+		// The MTU can only be exchanged over the unenhanced bearer.
+		p.attc <- m
+	} else {
+		p.reqc <- m
+	}
 	return <-m.rspc
 }
 
 func (p *peripheral) loop() {
+	p.serveBearer(p.l2c, p.attc, p.quitc)
+}
+
+// serveBearer serializes the requests over an ATT bearer, and handles the
+// responses and notifications/indications received on it, until the bearer
+// is closed. The requests are taken from p.reqc, which the bearers share,
+// and from attc, if not nil. quitc is closed when the bearer is closed.
+func (p *peripheral) serveBearer(l2c io.ReadWriter, attc chan message, quitc chan struct{}) {
 	// Serialize the request.
 	rspc := make(chan []byte)
 
 	// Dequeue request loop
 	go func() {
 		for {
+			var req message
 			select {
-			case req := <-p.reqc:
-				p.l2c.Write(req.b)
-				if req.rspc == nil {
-					break
-				}
-
-				for {
-					r := <-rspc
-					reqOp, rspOp := req.b[0], r[0]
-					if rspOp == constants.AttRspFor[reqOp] || (rspOp == constants.AttOpError && r[1] == reqOp) {
-						req.rspc <- r
-						break
-					}
-					log.Printf("Request 0x%02x got a mismatched response: 0x%02x", reqOp, rspOp)
-					p.l2c.Write(constants.AttErrorRsp(rspOp, 0x0000, constants.AttEcodeReqNotSupp))
-				}
+			case req = <-p.reqc:
+			case req = <-attc:
+			case <-quitc:
+				return
 			case <-p.quitc:
 				return
 			}
+			l2c.Write(req.b)
+			if req.rspc == nil {
+				continue
+			}
+
+			for {
+				var r []byte
+				select {
+				case r = <-rspc:
+				case <-quitc:
+					req.rspc <- constants.AttErrorRsp(req.b[0], 0x0000, constants.AttEcodeUnlikely)
+					return
+				}
+				reqOp, rspOp := req.b[0], r[0]
+				if rspOp == constants.AttRspFor[reqOp] || (rspOp == constants.AttOpError && r[1] == reqOp) {
+					req.rspc <- r
+					break
+				}
+				log.Printf("Request 0x%02x got a mismatched response: 0x%02x", reqOp, rspOp)
+				l2c.Write(constants.AttErrorRsp(rspOp, 0x0000, constants.AttEcodeReqNotSupp))
+			}
 		}
 	}()
 
 	// L2CAP implementations shall support a minimum MTU size of 48 bytes.
 	// The default value is 672 bytes
-	buf := make([]byte, 672)
+	size := 672
+	if ch, ok := l2c.(*linux.CoC); ok && ch.MTU() > size {
+		size = ch.MTU()
+	}
+	buf := make([]byte, size)
 
 	// Handling response or notification/indication
 	for {
-		n, err := p.l2c.Read(buf)
+		n, err := l2c.Read(buf)
 		if n == 0 || err != nil {
-			close(p.quitc)
+			close(quitc)
 			return
 		}
 
 		b := make([]byte, n)
 		copy(b, buf)
 
-		if (b[0] != constants.AttOpHandleNotify) && (b[0] != constants.AttOpHandleInd) {
+		switch b[0] {
+		case constants.AttOpHandleNotify, constants.AttOpHandleInd:
+			p.notify(binary.LittleEndian.Uint16(b[1:3]), b[3:])
+			if b[0] == constants.AttOpHandleInd {
+				// write aknowledgement for indication
+				l2c.Write([]byte{constants.AttOpHandleCnf})
+			}
+		case constants.AttOpMultiHandleNotify:
+			for d := b[1:]; len(d) >= 4; {
+				h := binary.LittleEndian.Uint16(d[0:2])
+				l := int(binary.LittleEndian.Uint16(d[2:4]))
+				if len(d) < 4+l {
+					log.Printf("malformed multiple handle value notification")
+					break
+				}
+				p.notify(h, d[4:4+l])
+				d = d[4+l:]
+			}
+		default:
 			log.Printf("response 0x%x", b[0])
-			rspc <- b
-			continue
+			select {
+			case rspc <- b:
+			case <-quitc:
+			}
 		}
+	}
+}
 
-		h := binary.LittleEndian.Uint16(b[1:3])
-		f := p.sub.fn(h)
-		if f == nil {
-			log.Printf("notified by unsubscribed handle")
-			// FIXME: terminate the connection?
-		} else {
-			go f(b[3:], nil)
-		}
+// notify hands a value notified or indicated for the handle h to its subscriber.
+func (p *peripheral) notify(h uint16, v []byte) {
+	f := p.sub.fn(h)
+	if f == nil {
+		log.Printf("notified by unsubscribed handle")
+		// FIXME: terminate the connection?
+		return
+	}
+	go f(v, nil)
+}
 
-		if b[0] == constants.AttOpHandleInd {
-			// write aknowledgement for indication
-			p.l2c.Write([]byte{constants.AttOpHandleCnf})
+// openEATT opens up to n enhanced ATT bearers to the peripheral, if it
+// supports them. Bearers with an MTU lower than the unenhanced bearer's
+// are dropped, as the requests are sized for the latter.
+func (p *peripheral) openEATT(n int) {
+	f, err := p.readByType(constants.AttrServerSupportedFeaturesUUID)
+	if err != nil || len(f.v) == 0 || f.v[0]&constants.GATTServerEATT == 0 {
+		return
+	}
+	cf, err := p.readByType(constants.AttrClientSupportedFeaturesUUID)
+	if err != nil {
+		return
+	}
+	b := []byte{constants.AttOpWriteReq, uint8(cf.h), uint8(cf.h >> 8),
+		constants.GATTClientEATT | constants.GATTClientMultiHandleNotify}
+	if _, err := finish(constants.AttOpWriteReq, cf.h, p.sendReq(constants.AttOpWriteReq, b)); err != nil {
+		log.Printf("enable EATT error: %v", err)
+		return
+	}
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), eattTimeout)
+		conn, err := p.DialL2CAP(ctx, psmEATT)
+		cancel()
+		if err != nil {
+			log.Printf("open EATT bearer error: %v", err)
+			return
 		}
+		if conn.(*linux.CoC).MTU() < int(p.mtu) {
+			conn.Close()
+			return
+		}
+		go func() {
+			p.serveBearer(conn, nil, make(chan struct{}))
+			conn.Close()
+		}()
+	}
+}
 
+// eattTimeout bounds the opening of an enhanced ATT bearer.
+const eattTimeout = 10 * time.Second
+
+// A handleValue is an attribute handle and value.
+type handleValue struct {
+	h uint16
+	v []byte
+}
+
+// readByType reads the first attribute of the type u on the peripheral.
+func (p *peripheral) readByType(u constants.UUID) (handleValue, error) {
+	op := byte(constants.AttOpReadByTypeReq)
+	b := make([]byte, 5, 5+u.Len())
+	b[0] = op
+	binary.LittleEndian.PutUint16(b[1:3], 0x0001)
+	binary.LittleEndian.PutUint16(b[3:5], 0xFFFF)
+	b = append(b, u.B...)
+	b = p.sendReq(op, b)
+	if b[0] == constants.AttOpError {
+		return handleValue{}, constants.AttEcode(b[4])
+	}
+	if len(b) < 2 || int(b[1]) < 2 || len(b) < 2+int(b[1]) {
+		return handleValue{}, errors.New("malformed read by type response")
 	}
+	return handleValue{h: binary.LittleEndian.Uint16(b[2:4]), v: b[4 : 2+b[1]]}, nil
 }
 
 func (p *peripheral) SetMTU(mtu uint16) error {
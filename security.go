@@ -0,0 +1,18 @@
+package gatt
+
+// SecurityLevel is the security level of a connection.
+type SecurityLevel int
+
+const (
+	SecurityLow    SecurityLevel = iota // The link is not encrypted.
+	SecurityMedium                      // The link is encrypted with an unauthenticated key.
+	SecurityHigh                        // The link is encrypted with an authenticated key.
+)
+
+var securityLevelName = map[SecurityLevel]string{
+	SecurityLow:    "Low",
+	SecurityMedium: "Medium",
+	SecurityHigh:   "High",
+}
+
+func (l SecurityLevel) String() string { return securityLevelName[l] }
@@ -1,7 +1,9 @@
 package gatt
 
 import (
+	"context"
 	"errors"
+	"net"
 
 	"github.com/grutz/gatt/constants"
 )
@@ -50,6 +52,34 @@ func (d *simDevice) StopAdvertising() error {
 	return errors.New("Method not supported")
 }
 
+func (d *simDevice) AdvertiseEddystoneUID(namespace [10]byte, instance [6]byte, pwr int8) error {
+	return errors.New("Method not supported")
+}
+
+func (d *simDevice) AdvertiseEddystoneURL(url string, pwr int8) error {
+	return errors.New("Method not supported")
+}
+
+func (d *simDevice) AdvertiseAltBeacon(mfgID uint16, id [20]byte, refRSSI int8) error {
+	return errors.New("Method not supported")
+}
+
+func (d *simDevice) AdvertiseWithOptions(a *AdvPacket, o AdvertiseOptions) error {
+	return errors.New("Method not supported")
+}
+
+func (d *simDevice) AdvertiseSet(s *AdvSet) error {
+	return errors.New("Method not supported")
+}
+
+func (d *simDevice) StopAdvertiseSet(s *AdvSet) error {
+	return errors.New("Method not supported")
+}
+
+func (d *simDevice) SyncPeriodic(ctx context.Context, p Peripheral, sid uint8) (*PeriodicSync, error) {
+	return nil, errors.New("Method not supported")
+}
+
 func (d *simDevice) RemoveAllServices() error {
 	return errors.New("Method not supported")
 }
@@ -83,11 +113,11 @@ func (d *simDevice) Stop() error {
 }
 
 func (d *simDevice) Connect(p Peripheral) {
-	go d.peripheralConnected(p, nil)
+	d.reportPeripheralConnected(p, nil)
 }
 
 func (d *simDevice) CancelConnection(p Peripheral) {
-	go d.peripheralDisconnected(p, nil)
+	go d.reportPeripheralDisconnected(p, nil)
 }
 
 func (d *simDevice) Handle(hh ...Handler) {
@@ -96,6 +126,14 @@ func (d *simDevice) Handle(hh ...Handler) {
 	}
 }
 
+func (d *simDevice) Centrals() []Central {
+	return nil
+}
+
+func (d *simDevice) ListenL2CAP(psm uint16) (net.Listener, error) {
+	return nil, errors.New("Method not supported")
+}
+
 func (d *simDevice) Option(o ...Option) error {
 	return errors.New("Method not supported")
 }
@@ -204,3 +242,19 @@ func (p *simPeripheral) ReadRSSI() int {
 func (p *simPeripheral) SetMTU(mtu uint16) error {
 	return errors.New("Method not supported")
 }
+
+func (p *simPeripheral) DialL2CAP(ctx context.Context, psm uint16) (net.Conn, error) {
+	return nil, errors.New("Method not supported")
+}
+
+func (p *simPeripheral) SecurityLevel() SecurityLevel {
+	return SecurityLow
+}
+
+func (p *simPeripheral) ConnInfo() ConnInfo {
+	return ConnInfo{}
+}
+
+func (p *simPeripheral) SetPHY(tx, rx PHY) error {
+	return errors.New("Method not supported")
+}
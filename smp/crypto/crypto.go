@@ -0,0 +1,204 @@
+// Package crypto implements the cryptographic toolbox of the Bluetooth
+// Security Manager (Vol 3, Part H, 2.2).
+//
+// All keys, values and results are represented most significant octet
+// first, as they are printed in the spec and its sample data. Values
+// received from or sent over the air, which are least significant octet
+// first, must be reversed with Reverse.
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+// Reverse returns a copy of b with the order of the octets reversed.
+func Reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// E is the security function e, AES-128 encryption of plaintextData with key.
+func E(key, plaintextData [16]byte) [16]byte {
+	c, _ := aes.NewCipher(key[:]) // never fails with a 16-byte key
+	var r [16]byte
+	c.Encrypt(r[:], plaintextData[:])
+	return r
+}
+
+// AESCMAC computes the AES-CMAC message authentication code of m with the
+// key k, as defined in RFC 4493.
+func AESCMAC(k [16]byte, m []byte) [16]byte {
+	c, _ := aes.NewCipher(k[:])
+
+	// Generate the subkeys.
+	var l, k1, k2 [16]byte
+	c.Encrypt(l[:], l[:])
+	k1 = shiftXor(l)
+	k2 = shiftXor(k1)
+
+	// Split the message into blocks, the last of which is padded and
+	// masked with one of the subkeys.
+	n := (len(m) + 15) / 16
+	var last [16]byte
+	if n == 0 || len(m)%16 != 0 {
+		if n == 0 {
+			n = 1
+		}
+		r := m[(n-1)*16:]
+		copy(last[:], r)
+		last[len(r)] = 0x80
+		xor(last[:], last[:], k2[:])
+	} else {
+		copy(last[:], m[(n-1)*16:])
+		xor(last[:], last[:], k1[:])
+	}
+
+	var x [16]byte
+	for i := 0; i < n-1; i++ {
+		xor(x[:], x[:], m[i*16:(i+1)*16])
+		c.Encrypt(x[:], x[:])
+	}
+	xor(x[:], x[:], last[:])
+	c.Encrypt(x[:], x[:])
+	return x
+}
+
+// shiftXor is the subkey generation step of RFC 4493: b << 1, XORed with
+// Rb if the most significant bit of b was set.
+func shiftXor(b [16]byte) [16]byte {
+	var r [16]byte
+	for i := 0; i < 15; i++ {
+		r[i] = b[i]<<1 | b[i+1]>>7
+	}
+	r[15] = b[15] << 1
+	if b[0]&0x80 != 0 {
+		r[15] ^= 0x87
+	}
+	return r
+}
+
+func xor(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+// Ah is the random address hash function ah, which generates the hash
+// part of a resolvable private address from the IRK k and prand r.
+func Ah(k [16]byte, r [3]byte) [3]byte {
+	var rr [16]byte
+	copy(rr[13:], r[:])
+	e := E(k, rr)
+	return [3]byte{e[13], e[14], e[15]}
+}
+
+// VerifyRPA reports whether the resolvable private address addr was
+// generated from the IRK k.
+func VerifyRPA(k [16]byte, addr [6]byte) bool {
+	if addr[0]&0xC0 != 0x40 {
+		return false
+	}
+	h := Ah(k, [3]byte{addr[0], addr[1], addr[2]})
+	return subtle.ConstantTimeCompare(h[:], addr[3:]) == 1
+}
+
+// C1 is the LE legacy pairing confirm value generation function c1.
+// iat and rat are the address types (0 or 1) of the initiating and the
+// responding devices, ia and ra their addresses.
+func C1(k, r [16]byte, preq, pres [7]byte, iat, rat uint8, ia, ra [6]byte) [16]byte {
+	var p1, p2, t [16]byte
+	copy(p1[0:], pres[:])
+	copy(p1[7:], preq[:])
+	p1[14] = rat & 0x01
+	p1[15] = iat & 0x01
+	copy(p2[4:], ia[:])
+	copy(p2[10:], ra[:])
+
+	xor(t[:], r[:], p1[:])
+	t = E(k, t)
+	xor(t[:], t[:], p2[:])
+	return E(k, t)
+}
+
+// S1 is the LE legacy pairing key generation function s1, which generates
+// the STK from the TK k, and the random values r1 and r2.
+func S1(k, r1, r2 [16]byte) [16]byte {
+	var r [16]byte
+	copy(r[0:], r1[8:])
+	copy(r[8:], r2[8:])
+	return E(k, r)
+}
+
+// F4 is the LE Secure Connections confirm value generation function f4.
+func F4(u, v [32]byte, x [16]byte, z uint8) [16]byte {
+	m := make([]byte, 0, 65)
+	m = append(m, u[:]...)
+	m = append(m, v[:]...)
+	m = append(m, z)
+	return AESCMAC(x, m)
+}
+
+// saltF5 is the SALT of the f5 function.
+var saltF5 = [16]byte{
+	0x6c, 0x88, 0x83, 0x91, 0xaa, 0xf5, 0xa5, 0x38,
+	0x60, 0x37, 0x0b, 0xdb, 0x5a, 0x60, 0x83, 0xbe,
+}
+
+// F5 is the LE Secure Connections key generation function f5, which derives
+// the MacKey and the LTK from the DHKey w. a1 and a2 are the address types
+// followed by the addresses of the two devices.
+func F5(w [32]byte, n1, n2 [16]byte, a1, a2 [7]byte) (macKey, ltk [16]byte) {
+	t := AESCMAC(saltF5, w[:])
+
+	m := make([]byte, 0, 53)
+	m = append(m, 0x00)                   // Counter
+	m = append(m, 0x62, 0x74, 0x6c, 0x65) // keyID "btle"
+	m = append(m, n1[:]...)
+	m = append(m, n2[:]...)
+	m = append(m, a1[:]...)
+	m = append(m, a2[:]...)
+	m = append(m, 0x01, 0x00) // Length, 256
+	macKey = AESCMAC(t, m)
+	m[0] = 0x01
+	ltk = AESCMAC(t, m)
+	return macKey, ltk
+}
+
+// F6 is the LE Secure Connections check value generation function f6.
+func F6(w, n1, n2, r [16]byte, ioCap [3]byte, a1, a2 [7]byte) [16]byte {
+	m := make([]byte, 0, 65)
+	m = append(m, n1[:]...)
+	m = append(m, n2[:]...)
+	m = append(m, r[:]...)
+	m = append(m, ioCap[:]...)
+	m = append(m, a1[:]...)
+	m = append(m, a2[:]...)
+	return AESCMAC(w, m)
+}
+
+// G2 is the LE Secure Connections numeric comparison value generation
+// function g2. The six least significant decimal digits of the result are
+// the value to display.
+func G2(u, v [32]byte, x, y [16]byte) uint32 {
+	m := make([]byte, 0, 80)
+	m = append(m, u[:]...)
+	m = append(m, v[:]...)
+	m = append(m, y[:]...)
+	r := AESCMAC(x, m)
+	return binary.BigEndian.Uint32(r[12:])
+}
+
+// H6 is the link key conversion function h6.
+func H6(w [16]byte, keyID [4]byte) [16]byte {
+	return AESCMAC(w, keyID[:])
+}
+
+// H7 is the link key conversion function h7.
+func H7(salt, w [16]byte) [16]byte {
+	return AESCMAC(salt, w[:])
+}
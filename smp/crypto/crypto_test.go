@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// h decodes a hex string as printed in the spec, ignoring spaces.
+func h(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func h16(s string) (r [16]byte) { copy(r[:], h(s)); return }
+func h32(s string) (r [32]byte) { copy(r[:], h(s)); return }
+func h7(s string) (r [7]byte)   { copy(r[:], h(s)); return }
+func h6(s string) (r [6]byte)   { copy(r[:], h(s)); return }
+
+// Sample data of Vol 3, Part H, Appendix D.
+var (
+	u  = h32("20b003d2 f297be2c 5e2c83a7 e9f9a5b9 eff49111 acf4fddb cc030148 0e359de6")
+	v  = h32("55188b3d 32f6bb9a 900afcfb eed4e72a 59cb9ac2 f19d7cfb 6b4fdd49 f47fc5fd")
+	x  = h16("d5cb8454 d177733e ffffb2ec 712baeab")
+	y  = h16("a6e8e7cc 25a75f6e 216583f7 ff3dc4cf")
+	w  = h32("ec0234a3 57c8ad05 341010a6 0a397d9b 99796b13 b4f866f1 868d34f3 73bfa698")
+	a1 = h7("00561237 37bfce")
+	a2 = h7("00a71370 2dcfc1")
+)
+
+func TestE(t *testing.T) {
+	// FIPS-197, Appendix C.1
+	got := E(h16("00010203 04050607 08090a0b 0c0d0e0f"), h16("00112233 44556677 8899aabb ccddeeff"))
+	if want := h16("69c4e0d8 6a7b0430 d8cdb780 70b4c55a"); got != want {
+		t.Errorf("E got %x want %x", got, want)
+	}
+}
+
+func TestAESCMAC(t *testing.T) {
+	// RFC 4493, 4. Test Vectors
+	k := h16("2b7e1516 28aed2a6 abf71588 09cf4f3c")
+	m := h("6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51" +
+		"30c81c46 a35ce411 e5fbc119 1a0a52ef f69f2445 df4f9b17 ad2b417b e66c3710")
+	cases := []struct {
+		n    int
+		want string
+	}{
+		{0, "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{16, "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{40, "dfa66747 de9ae630 30ca3261 1497c827"},
+		{64, "51f0bebf 7e3b9d92 fc497417 79363cfe"},
+	}
+	for _, tt := range cases {
+		if got := AESCMAC(k, m[:tt.n]); got != h16(tt.want) {
+			t.Errorf("AESCMAC(%d bytes) got %x want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestAh(t *testing.T) {
+	irk := h16("ec0234a3 57c8ad05 341010a6 0a397d9b")
+	got := Ah(irk, [3]byte{0x70, 0x81, 0x94})
+	if want := [3]byte{0x0d, 0xfb, 0xaa}; got != want {
+		t.Errorf("Ah got %x want %x", got, want)
+	}
+	if !VerifyRPA(irk, h6("708194 0dfbaa")) {
+		t.Errorf("VerifyRPA(708194 0dfbaa) got false want true")
+	}
+	if VerifyRPA(irk, h6("708194 0dfbab")) {
+		t.Errorf("VerifyRPA(708194 0dfbab) got true want false")
+	}
+}
+
+func TestC1(t *testing.T) {
+	// Vol 3, Part H, 2.2.3
+	var k [16]byte
+	r := h16("5783D521 56AD6F0E 6388274E C6702EE0")
+	preq := h7("07071000 000101")
+	pres := h7("05000800 000302")
+	got := C1(k, r, preq, pres, 1, 0, h6("A1A2A3A4A5A6"), h6("B1B2B3B4B5B6"))
+	if want := h16("1e1e3fef 878988ea d2a74dc5 bef13b86"); got != want {
+		t.Errorf("C1 got %x want %x", got, want)
+	}
+}
+
+func TestS1(t *testing.T) {
+	// Vol 3, Part H, 2.2.4
+	var k [16]byte
+	got := S1(k, h16("000F0E0D 0C0B0A09 11223344 55667788"), h16("01020304 05060708 99AABBCC DDEEFF00"))
+	if want := h16("9a1fe1f0 e8b0f49b 5b4216ae 796da062"); got != want {
+		t.Errorf("S1 got %x want %x", got, want)
+	}
+}
+
+func TestF4(t *testing.T) {
+	got := F4(u, v, x, 0x00)
+	if want := h16("f2c916f1 07a9bd1c f1eda1be a974872d"); got != want {
+		t.Errorf("F4 got %x want %x", got, want)
+	}
+}
+
+func TestF5(t *testing.T) {
+	macKey, ltk := F5(w, x, y, a1, a2)
+	if want := h16("2965f176 a1084a02 fd3f6a20 ce636e20"); macKey != want {
+		t.Errorf("F5 MacKey got %x want %x", macKey, want)
+	}
+	if want := h16("69867911 69d7cd23 980522b5 94750a38"); ltk != want {
+		t.Errorf("F5 LTK got %x want %x", ltk, want)
+	}
+}
+
+func TestF6(t *testing.T) {
+	got := F6(h16("2965f176 a1084a02 fd3f6a20 ce636e20"), x, y,
+		h16("12a3343b b453bb54 08da42d2 0c2d0fc8"), [3]byte{0x01, 0x01, 0x02}, a1, a2)
+	if want := h16("e3c47398 9cd0e8c5 d26c0b09 da958f61"); got != want {
+		t.Errorf("F6 got %x want %x", got, want)
+	}
+}
+
+func TestG2(t *testing.T) {
+	if got, want := G2(u, v, x, y), uint32(0x2f9ed5ba); got != want {
+		t.Errorf("G2 got %08x want %08x", got, want)
+	}
+}
+
+func TestH6(t *testing.T) {
+	got := H6(h16("ec0234a3 57c8ad05 341010a6 0a397d9b"), [4]byte{0x6c, 0x65, 0x62, 0x72})
+	if want := h16("2d9ae102 e76dc91c e8d3a9e2 80b16399"); got != want {
+		t.Errorf("H6 got %x want %x", got, want)
+	}
+}
+
+func TestH7(t *testing.T) {
+	got := H7(h16("00000000 00000000 00000000 746D7031"), h16("ec0234a3 57c8ad05 341010a6 0a397d9b"))
+	if want := h16("fb173597 c6a3c0ec d2998c2a 75a57011"); got != want {
+		t.Errorf("H7 got %x want %x", got, want)
+	}
+}